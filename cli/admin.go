@@ -0,0 +1,388 @@
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Orlion/hersql/config"
+	"github.com/Orlion/hersql/log"
+	"github.com/Orlion/hersql/sidecar"
+	"github.com/Orlion/hersql/transport"
+)
+
+// the timeout of the requests of the tooling when the configuration sets none
+const defaultAdminTimeout = 10 * time.Second
+
+// AdminTokenEnv is the environment variable of the admin token of the transports
+const AdminTokenEnv = "HERSQL_ADMIN_TOKEN"
+
+// adminFlags are the flags of the commands reaching the transports with the sidecar configuration
+type adminFlags struct {
+	fs         *flag.FlagSet
+	configFile *string
+	overrides  *config.Flags
+	transport  *string
+	adminToken *string
+	json       *bool
+}
+
+func defineAdminFlags(fs *flag.FlagSet) *adminFlags {
+	return &adminFlags{
+		fs:         fs,
+		configFile: fs.String("conf", "", "hersql sidecar config file, the transports are reached with its transports, certificates, proxy, headers and encryption key"),
+		transport:  fs.String("transport", "", "only reach the transport of this url, which need not be configured"),
+		adminToken: fs.String("admin-token", "", "admin token of the transports listing every session, defaults to $"+AdminTokenEnv+". Without it transports only list the sessions of the sidecar to its client certificate"),
+		json:       fs.Bool("json", false, "print the result as json"),
+		overrides:  config.NewFlags(fs, new(config.SidecarConfig)),
+	}
+}
+
+// token returns the admin token of the flag, or else of the environment. The environment is not the default
+// of the flag, the usage would print the token
+func (f *adminFlags) token() string {
+	if *f.adminToken != "" {
+		return *f.adminToken
+	}
+
+	return os.Getenv(AdminTokenEnv)
+}
+
+// client returns the sidecar server the requests to the transports are made with, and the transports to reach
+func (f *adminFlags) client() (*sidecar.Server, []string, int) {
+	// the tooling prints its results, the logs of the sidecar code it runs would get in the way
+	log.Init(&log.Config{StdoutLevel: "fatal", Level: "fatal"})
+
+	if *f.transport != "" {
+		// a transport given on the command line does not have to be configured
+		f.fs.Set("server.transport_addr", *f.transport)
+	}
+
+	conf, err := config.LoadSidecarConfig(*f.configFile, f.overrides)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "configuration error: "+err.Error())
+		return nil, nil, ExitConfig
+	}
+
+	if conf.Server.TransportTimeout == 0 {
+		conf.Server.TransportTimeout = defaultAdminTimeout
+	}
+
+	srv, err := sidecar.NewServer(conf.Server)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "configuration error: "+err.Error())
+		return nil, nil, ExitConfig
+	}
+
+	addrs := srv.TransportAddrs()
+	if *f.transport != "" {
+		addrs = []string{*f.transport}
+	}
+
+	return srv, addrs, ExitOK
+}
+
+func printJSON(v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "json error: "+err.Error())
+		return
+	}
+
+	fmt.Println(string(b))
+}
+
+// listSessions lists the sessions of the transport, without the admin token those of other sidecars are left out
+// by transports authenticating the sidecars by their client certificates, and the other transports list none
+func listSessions(srv *sidecar.Server, addr, adminToken string) (*transport.SessionsResponseData, error) {
+	form := url.Values{}
+	if adminToken != "" {
+		form.Set(transport.AdminTokenField, adminToken)
+	}
+
+	response := new(transport.SessionsResponse)
+	if err := srv.CallTransport(addr, "/sessions", form, response); err != nil {
+		return nil, err
+	}
+
+	if !response.Success {
+		return nil, response.Err()
+	}
+
+	return response.Data, nil
+}
+
+// TransportStatus is the status of a transport as printed by the status command
+type TransportStatus struct {
+	Addr     string                     `json:"addr"`
+	Up       bool                       `json:"up"`
+	Error    string                     `json:"error,omitempty"`
+	Latency  string                     `json:"latency,omitempty"`
+	Runid    string                     `json:"runid,omitempty"`
+	Sessions int                        `json:"sessions"`
+	Backends []*transport.BackendStatus `json:"backends,omitempty"`
+}
+
+var statusCommand = &command{
+	name:    "status",
+	summary: "report whether the transports are up, their sessions and the health of their backends",
+	setup: func(fs *flag.FlagSet) func(args []string) int {
+		flags := defineAdminFlags(fs)
+
+		return func(args []string) int {
+			if len(args) > 0 {
+				return usageError(fs, "unexpected arguments %v", args)
+			}
+
+			srv, addrs, code := flags.client()
+			if code != ExitOK {
+				return code
+			}
+
+			code = ExitOK
+			statuses := make([]*TransportStatus, 0, len(addrs))
+			for _, addr := range addrs {
+				status := transportStatus(srv, addr, flags.token())
+				if !status.Up {
+					code = ExitUnavailable
+				}
+				for _, backend := range status.Backends {
+					for _, addr := range backend.Addrs {
+						if !addr.Healthy {
+							code = ExitUnavailable
+						}
+					}
+				}
+				statuses = append(statuses, status)
+			}
+
+			if *flags.json {
+				printJSON(statuses)
+				return code
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "TRANSPORT\tSTATUS\tLATENCY\tRUNID\tSESSIONS")
+			for _, status := range statuses {
+				if !status.Up {
+					fmt.Fprintf(w, "%s\tdown: %s\t\t\t\n", status.Addr, status.Error)
+					continue
+				}
+				fmt.Fprintf(w, "%s\tup\t%s\t%s\t%d\n", status.Addr, status.Latency, status.Runid, status.Sessions)
+			}
+			w.Flush()
+
+			for _, status := range statuses {
+				if len(status.Backends) == 0 {
+					continue
+				}
+
+				fmt.Printf("\nbackends of %s\n", status.Addr)
+				w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(w, "BACKEND\tADDR\tROLE\tHEALTH\tLATENCY\tCHECKED AT")
+				for _, backend := range status.Backends {
+					for _, addr := range backend.Addrs {
+						health := "healthy"
+						if !addr.Healthy {
+							health = "unhealthy: " + addr.Error
+						}
+						fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", backend.Name, addr.Addr, addr.Role, health, addr.Latency, addr.CheckedAt)
+					}
+				}
+				w.Flush()
+			}
+
+			return code
+		}
+	},
+}
+
+func transportStatus(srv *sidecar.Server, addr, adminToken string) *TransportStatus {
+	status := &TransportStatus{Addr: addr}
+
+	start := time.Now()
+	if err := srv.PingTransport(addr); err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Up = true
+	status.Latency = time.Since(start).Round(time.Microsecond).String()
+
+	// the sessions are only listed with the encryption key of the transport
+	sessions, err := listSessions(srv, addr, adminToken)
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		status.Runid = sessions.Runid
+		status.Sessions = len(sessions.Sessions)
+	}
+
+	backends := new(transport.BackendsResponse)
+	if err := srv.CallTransport(addr, "/backends", url.Values{}, backends); err == nil && backends.Success {
+		status.Backends = backends.Data
+	}
+
+	return status
+}
+
+// TransportSessions are the sessions of a transport as printed by the sessions command
+type TransportSessions struct {
+	Addr     string                     `json:"addr"`
+	Error    string                     `json:"error,omitempty"`
+	Runid    string                     `json:"runid,omitempty"`
+	Sessions []*transport.SessionStatus `json:"sessions"`
+}
+
+var sessionsCommand = &command{
+	name:    "sessions",
+	summary: "list the sessions of the transports",
+	setup: func(fs *flag.FlagSet) func(args []string) int {
+		flags := defineAdminFlags(fs)
+
+		return func(args []string) int {
+			if len(args) > 0 {
+				return usageError(fs, "unexpected arguments %v", args)
+			}
+
+			srv, addrs, code := flags.client()
+			if code != ExitOK {
+				return code
+			}
+
+			code = ExitOK
+			list := make([]*TransportSessions, 0, len(addrs))
+			for _, addr := range addrs {
+				sessions := &TransportSessions{Addr: addr, Sessions: make([]*transport.SessionStatus, 0)}
+				data, err := listSessions(srv, addr, flags.token())
+				if err != nil {
+					sessions.Error = err.Error()
+					code = ExitUnavailable
+				} else {
+					sessions.Runid = data.Runid
+					sessions.Sessions = data.Sessions
+				}
+				list = append(list, sessions)
+			}
+
+			if *flags.json {
+				printJSON(list)
+				return code
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "TRANSPORT\tSESSION\tUSER\tBACKEND\tDATABASE\tIDENTITY\tTHREAD\tCREATED AT\tSTATE")
+			for _, sessions := range list {
+				if sessions.Error != "" {
+					fmt.Fprintf(os.Stderr, "transport %s error: %s\n", sessions.Addr, sessions.Error)
+					continue
+				}
+				for _, session := range sessions.Sessions {
+					backend := session.Addr
+					if session.Backend != "" {
+						backend = session.Backend + " (" + session.Addr + ")"
+					}
+					fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", sessions.Addr, session.ConnId, session.User, backend,
+						session.Dbname, session.Identity, session.ThreadId, session.CreateAt, sessionState(session))
+				}
+			}
+			w.Flush()
+
+			return code
+		}
+	},
+}
+
+func sessionState(session *transport.SessionStatus) string {
+	switch {
+	case session.Running:
+		return "running"
+	case session.InTransaction:
+		return "in transaction"
+	default:
+		return "idle"
+	}
+}
+
+var killCommand = &command{
+	name:    "kill",
+	args:    "<session>",
+	summary: "kill a session listed by the sessions command, or only its running query",
+	setup: func(fs *flag.FlagSet) func(args []string) int {
+		flags := defineAdminFlags(fs)
+		query := fs.Bool("query", false, "only kill the query running in the session")
+
+		return func(args []string) int {
+			if len(args) != 1 {
+				return usageError(fs, "please give the session to kill")
+			}
+
+			connId, err := strconv.ParseUint(args[0], 10, 64)
+			if err != nil {
+				return usageError(fs, "session %s is not a session number", args[0])
+			}
+
+			srv, addrs, code := flags.client()
+			if code != ExitOK {
+				return code
+			}
+
+			// the session numbers are per transport, the session has to be found on one of them
+			var found []string
+			var runid string
+			for _, addr := range addrs {
+				data, err := listSessions(srv, addr, flags.token())
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "transport %s error: %s\n", addr, err.Error())
+					continue
+				}
+				for _, session := range data.Sessions {
+					if session.ConnId == connId {
+						found = append(found, addr)
+						runid = data.Runid
+					}
+				}
+			}
+
+			switch len(found) {
+			case 0:
+				fmt.Fprintf(os.Stderr, "session %d not found\n", connId)
+				return ExitFailure
+			case 1:
+			default:
+				fmt.Fprintf(os.Stderr, "session %d exists on the transports %v, please choose one with -transport\n", connId, found)
+				return ExitUsage
+			}
+
+			killType := transport.KillConnection
+			if *query {
+				killType = transport.KillQuery
+			}
+
+			form := url.Values{}
+			form.Set("runid", runid)
+			form.Set("connId", strconv.FormatUint(connId, 10))
+			form.Set("type", killType)
+			if token := flags.token(); token != "" {
+				form.Set(transport.AdminTokenField, token)
+			}
+			response := new(transport.Response)
+			if err := srv.CallTransport(found[0], "/kill", form, response); err != nil {
+				fmt.Fprintf(os.Stderr, "transport %s error: %s\n", found[0], err.Error())
+				return ExitUnavailable
+			}
+			if !response.Success {
+				fmt.Fprintf(os.Stderr, "kill session %d error: %s\n", connId, response.Err().Error())
+				return ExitFailure
+			}
+
+			fmt.Printf("session %d killed (%s)\n", connId, killType)
+
+			return ExitOK
+		}
+	},
+}
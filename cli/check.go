@@ -0,0 +1,23 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+)
+
+var checkConfigCommand = &command{
+	name:    "check-config",
+	summary: "validate the configuration of the sidecar or the transport and print all the problems",
+	kindOf:  "check-config",
+}
+
+func checkConfig(load func() error) int {
+	if err := load(); err != nil {
+		fmt.Fprintln(os.Stderr, "configuration error: "+err.Error())
+		return ExitConfig
+	}
+
+	fmt.Println("configuration ok")
+
+	return ExitOK
+}
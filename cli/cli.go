@@ -0,0 +1,171 @@
+// Package cli implements the hersql command, hersql-sidecar and hersql-transport are the sidecar and transport
+// commands of it
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+)
+
+// Version is the version of hersql, it may be set with -ldflags "-X github.com/Orlion/hersql/cli.Version=..."
+var Version = "0.1.0"
+
+// the exit codes of the commands
+const (
+	ExitOK = 0
+	// the command failed, e.g. the server stopped with an error or the transport refused to kill a session
+	ExitFailure = 1
+	// the command line is invalid
+	ExitUsage = 2
+	// the configuration is invalid
+	ExitConfig = 3
+	// a transport or a backend is unreachable, reported by status and doctor
+	ExitUnavailable = 4
+)
+
+type command struct {
+	name string
+	// the arguments following the flags in the usage
+	args    string
+	summary string
+	// setup defines the flags of the command on the flag set and returns the function running it with the arguments
+	setup func(fs *flag.FlagSet) func(args []string) int
+	// set instead of setup by the commands which apply to the sidecar or the transport, the first argument
+	// names the command they are handed to along with the other arguments
+	kindOf string
+}
+
+var commands []*command
+
+func init() {
+	// the completion command lists the commands, declaring them in the var would be an initialization cycle
+	commands = []*command{
+		sidecarCommand,
+		transportCommand,
+		statusCommand,
+		sessionsCommand,
+		killCommand,
+		checkConfigCommand,
+		versionCommand,
+		doctorCommand,
+		completionCommand,
+	}
+}
+
+// Main runs the command named by the first argument and returns its exit code
+func Main(args []string) int {
+	if len(args) == 0 {
+		usage(os.Stderr)
+		return ExitUsage
+	}
+
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		usage(os.Stdout)
+		return ExitOK
+	}
+
+	cmd := lookupCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "hersql: unknown command %s\n\n", args[0])
+		usage(os.Stderr)
+		return ExitUsage
+	}
+
+	return cmd.run(args[1:])
+}
+
+func lookupCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+
+	return nil
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: hersql <command> [flags] [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-14s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run 'hersql <command> -h' for the flags of a command.")
+}
+
+func (c *command) run(args []string) int {
+	if c.kindOf != "" {
+		if len(args) == 0 || (args[0] != sidecarCommand.name && args[0] != transportCommand.name) {
+			fmt.Fprintf(os.Stderr, "Usage: hersql %s {sidecar | transport} [flags]\n\n%s\n", c.name, c.summary)
+			return ExitUsage
+		}
+		return lookupCommand(args[0]).run(append(args[1:], c.kindOf))
+	}
+
+	fs := c.flagSet()
+	run := c.setup(fs)
+
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+
+	return run(positional)
+}
+
+func (c *command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("hersql "+c.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: hersql %s [flags] %s\n\n%s\n\nFlags:\n", c.name, c.args, c.summary)
+		fs.PrintDefaults()
+	}
+
+	return fs
+}
+
+// parseFlags parses the flags wherever they are among the arguments and returns the other arguments
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// usageError reports a wrong command line
+func usageError(fs *flag.FlagSet, format string, args ...interface{}) int {
+	fmt.Fprintf(fs.Output(), format+"\n\n", args...)
+	fs.Usage()
+
+	return ExitUsage
+}
+
+var versionCommand = &command{
+	name:    "version",
+	summary: "print the version of hersql",
+	setup: func(fs *flag.FlagSet) func(args []string) int {
+		return func(args []string) int {
+			fmt.Printf("hersql %s %s %s/%s\n", Version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+			return ExitOK
+		}
+	},
+}
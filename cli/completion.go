@@ -0,0 +1,138 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var completionCommand = &command{
+	name:    "completion",
+	args:    "{bash | zsh | fish}",
+	summary: "print the shell completion script, e.g. source <(hersql completion bash)",
+	setup: func(fs *flag.FlagSet) func(args []string) int {
+		return func(args []string) int {
+			if len(args) != 1 {
+				return usageError(fs, "please give the shell")
+			}
+
+			switch args[0] {
+			case "bash":
+				bashCompletion(os.Stdout)
+			case "zsh":
+				fmt.Fprintln(os.Stdout, "autoload -U +X bashcompinit && bashcompinit")
+				bashCompletion(os.Stdout)
+			case "fish":
+				fishCompletion(os.Stdout)
+			default:
+				return usageError(fs, "shell %s is not supported, please use bash, zsh or fish", args[0])
+			}
+
+			return ExitOK
+		}
+	},
+}
+
+// the arguments completed after the flags of the commands
+var completionArgs = map[string][]string{
+	"sidecar":    {"check-config", "doctor"},
+	"transport":  {"check-config", "doctor"},
+	"completion": {"bash", "zsh", "fish"},
+}
+
+// the flags whose value is a file
+var fileFlags = []string{"conf", "encrypt-secrets"}
+
+func commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for _, cmd := range commands {
+		names = append(names, cmd.name)
+	}
+
+	return names
+}
+
+// commandFlags returns the flags of the command, the commands which apply to the sidecar or the transport have none
+func commandFlags(cmd *command) []string {
+	if cmd.kindOf != "" {
+		return nil
+	}
+
+	fs := cmd.flagSet()
+	cmd.setup(fs)
+
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) {
+		names = append(names, f.Name)
+	})
+
+	return names
+}
+
+func bashCompletion(w io.Writer) {
+	fmt.Fprintln(w, "# bash completion of hersql")
+	fmt.Fprintln(w, "_hersql() {")
+	fmt.Fprintln(w, `    local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}" cmd="${COMP_WORDS[1]}" words=""`)
+	fmt.Fprintln(w, `    if [[ $COMP_CWORD -eq 1 ]]; then`)
+	fmt.Fprintf(w, "        COMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(commandNames(), " "))
+	fmt.Fprintln(w, "        return")
+	fmt.Fprintln(w, "    fi")
+	fmt.Fprintln(w, `    case "$prev" in`)
+	fmt.Fprintf(w, "        -%s)\n", strings.Join(fileFlags, "|-"))
+	fmt.Fprintln(w, `            COMPREPLY=($(compgen -f -- "$cur"))`)
+	fmt.Fprintln(w, "            return ;;")
+	fmt.Fprintln(w, "    esac")
+	fmt.Fprintln(w, `    case "$cmd" in`)
+	fmt.Fprintln(w, "        check-config|doctor)")
+	fmt.Fprintln(w, `            if [[ $COMP_CWORD -eq 2 ]]; then`)
+	fmt.Fprintln(w, `                COMPREPLY=($(compgen -W "sidecar transport" -- "$cur"))`)
+	fmt.Fprintln(w, "                return")
+	fmt.Fprintln(w, "            fi")
+	fmt.Fprintln(w, `            cmd="${COMP_WORDS[2]}" ;;`)
+	fmt.Fprintln(w, "    esac")
+	fmt.Fprintln(w, `    if [[ "$cur" == -* ]]; then`)
+	fmt.Fprintln(w, `        case "$cmd" in`)
+	for _, cmd := range commands {
+		if flags := commandFlags(cmd); len(flags) > 0 {
+			fmt.Fprintf(w, "            %s) words=%q ;;\n", cmd.name, "-"+strings.Join(flags, " -"))
+		}
+	}
+	fmt.Fprintln(w, "        esac")
+	fmt.Fprintln(w, "    else")
+	fmt.Fprintln(w, `        case "${COMP_WORDS[1]}" in`)
+	for _, name := range []string{"sidecar", "transport", "completion"} {
+		fmt.Fprintf(w, "            %s) words=%q ;;\n", name, strings.Join(completionArgs[name], " "))
+	}
+	fmt.Fprintln(w, "        esac")
+	fmt.Fprintln(w, "    fi")
+	fmt.Fprintln(w, `    COMPREPLY=($(compgen -W "$words" -- "$cur"))`)
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "complete -F _hersql hersql")
+}
+
+func fishCompletion(w io.Writer) {
+	fmt.Fprintln(w, "# fish completion of hersql")
+	fmt.Fprintln(w, "complete -c hersql -f")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "complete -c hersql -n __fish_use_subcommand -a %s -d %q\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w, "complete -c hersql -n '__fish_seen_subcommand_from check-config doctor; and not __fish_seen_subcommand_from sidecar transport' -a 'sidecar transport'")
+
+	for _, cmd := range commands {
+		for _, arg := range completionArgs[cmd.name] {
+			fmt.Fprintf(w, "complete -c hersql -n '__fish_seen_subcommand_from %s' -a %s\n", cmd.name, arg)
+		}
+
+		for _, name := range commandFlags(cmd) {
+			option := fmt.Sprintf("-o %s", name)
+			for _, fileFlag := range fileFlags {
+				if name == fileFlag {
+					option += " -r -F"
+				}
+			}
+			fmt.Fprintf(w, "complete -c hersql -n '__fish_seen_subcommand_from %s' %s\n", cmd.name, option)
+		}
+	}
+}
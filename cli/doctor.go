@@ -0,0 +1,137 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Orlion/hersql/config"
+	"github.com/Orlion/hersql/log"
+	"github.com/Orlion/hersql/mysql"
+	"github.com/Orlion/hersql/sidecar"
+	"github.com/Orlion/hersql/transport"
+)
+
+var doctorCommand = &command{
+	name:    "doctor",
+	summary: "check that the sidecar or the transport can start and reach its transports or backends",
+	kindOf:  "doctor",
+}
+
+// doctor runs the checks and prints their results, it remembers whether one failed
+type doctor struct {
+	failed bool
+}
+
+func (d *doctor) check(name string, err error) bool {
+	if err != nil {
+		d.failed = true
+		fmt.Printf("[fail] %s: %s\n", name, err.Error())
+		return false
+	}
+
+	fmt.Printf("[ok]   %s\n", name)
+	return true
+}
+
+func (d *doctor) exitCode() int {
+	if d.failed {
+		return ExitUnavailable
+	}
+
+	return ExitOK
+}
+
+// checkListen checks that the address can be listened on, it fails if the server is already running
+func checkListen(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return ln.Close()
+}
+
+func doctorSidecar(load func() (*config.SidecarConfig, error)) int {
+	// the results are printed, the logs of the sidecar code would get in the way
+	log.Init(&log.Config{StdoutLevel: "fatal", Level: "fatal"})
+
+	d := new(doctor)
+	conf, err := load()
+	if !d.check("configuration", err) {
+		return ExitConfig
+	}
+
+	if conf.Server.TransportTimeout == 0 {
+		conf.Server.TransportTimeout = defaultAdminTimeout
+	}
+
+	srv, err := sidecar.NewServer(conf.Server)
+	if !d.check("server", err) {
+		return ExitConfig
+	}
+
+	d.check("listen on "+conf.Server.Addr, checkListen(conf.Server.Addr))
+
+	for _, addr := range srv.TransportAddrs() {
+		if !d.check("transport "+addr+" reachable", srv.PingTransport(addr)) {
+			continue
+		}
+
+		// the sessions are listed with the encryption key and the client certificate, as the sessions are opened.
+		// Transports which only list them with the admin token accepted the sidecar if they deny the listing
+		_, err := listSessions(srv, addr, "")
+		var sqlErr *mysql.SqlError
+		if errors.As(err, &sqlErr) && sqlErr.Code == mysql.ER_SPECIFIC_ACCESS_DENIED_ERROR {
+			err = nil
+		}
+		d.check("transport "+addr+" accepts the sidecar", err)
+	}
+
+	return d.exitCode()
+}
+
+func doctorTransport(load func() (*config.TransportConfig, error)) int {
+	// the results are printed, the logs of the transport code would get in the way
+	log.Init(&log.Config{StdoutLevel: "fatal", Level: "fatal"})
+
+	d := new(doctor)
+	conf, err := load()
+	if !d.check("configuration", err) {
+		return ExitConfig
+	}
+
+	// loads the credentials, the secret providers and the certificates, and fills in the defaults
+	if _, err := transport.NewServer(conf.Server); !d.check("server", err) {
+		return ExitConfig
+	}
+
+	d.check("listen on "+conf.Server.Addr, checkListen(conf.Server.Addr))
+
+	if conf.Server.HandoffSocket != "" {
+		_, err := os.Stat(filepath.Dir(conf.Server.HandoffSocket))
+		d.check("handoff socket directory", err)
+	}
+
+	for _, backend := range conf.Server.Backends {
+		addrs := append([]string{backend.Primary}, backend.Fallbacks...)
+		addrs = append(addrs, backend.Replicas...)
+		for _, addr := range addrs {
+			d.check(fmt.Sprintf("backend %s %s reachable", backend.Name, addr), checkDial(addr, conf.Server.DialTimeout))
+		}
+	}
+
+	return d.exitCode()
+}
+
+func checkDial(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
@@ -0,0 +1,152 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Orlion/hersql/config"
+	"github.com/Orlion/hersql/log"
+	"github.com/Orlion/hersql/sidecar"
+)
+
+var sidecarCommand = &command{
+	name:    "sidecar",
+	args:    "[check-config | doctor]",
+	summary: "serve the mysql protocol locally and relay the packets to the transports",
+	setup: func(fs *flag.FlagSet) func(args []string) int {
+		configFile := fs.String("conf", "", "hersql sidecar config file, the settings may also be given by the HERSQL_* environment variables and the flags")
+		// the flags overriding the settings of the configuration file, such as -server.addr
+		overrides := config.NewFlags(fs, new(config.SidecarConfig))
+
+		return func(args []string) int {
+			load := func() (*config.SidecarConfig, error) {
+				return config.LoadSidecarConfig(*configFile, overrides)
+			}
+
+			switch {
+			case len(args) == 0:
+				return serveSidecar(load)
+			case len(args) == 1 && args[0] == "check-config":
+				return checkConfig(func() error {
+					_, err := load()
+					return err
+				})
+			case len(args) == 1 && args[0] == "doctor":
+				return doctorSidecar(load)
+			default:
+				return usageError(fs, "unexpected arguments %v", args)
+			}
+		}
+	},
+}
+
+func serveSidecar(load func() (*config.SidecarConfig, error)) int {
+	conf, err := load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "configuration error: "+err.Error())
+		return ExitConfig
+	}
+
+	// the settings as written in the file, the diff of a reload is computed against them
+	settings, err := config.Snapshot(conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "configuration snapshot error: "+err.Error())
+		return ExitFailure
+	}
+
+	log.Init(conf.Log)
+
+	srv, err := sidecar.NewServer(conf.Server)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "server error: "+err.Error())
+		return ExitConfig
+	}
+
+	go func() {
+		// the server is closed by the shutdown, which exits once the drain is over
+		if err = srv.ListenAndServe(); err != nil && !errors.Is(err, sidecar.ErrServerClosed) {
+			fmt.Fprintln(os.Stderr, "server error: "+err.Error())
+			os.Exit(ExitFailure)
+		}
+	}()
+
+	waitSidecarStop(srv, load, settings, conf.Server.DrainTimeout)
+
+	return ExitOK
+}
+
+func waitSidecarStop(srv *sidecar.Server, load func() (*config.SidecarConfig, error), settings config.Settings, drainTimeout time.Duration) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
+	for {
+		s := <-c
+		switch s {
+		case syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT:
+			log.Infow("received stop signal", "signal", s.String())
+			ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+			srv.Shutdown(ctx)
+			cancel()
+			log.Shutdown()
+			time.Sleep(500 * time.Millisecond)
+			return
+		case syscall.SIGHUP:
+			log.Infow("received reload signal", "signal", s.String())
+			settings = reloadSidecar(srv, load, settings)
+		default:
+		}
+	}
+}
+
+// reloadSidecar applies the configuration to the running server, the running configuration is kept
+// if the configuration is invalid. It returns the settings of the configuration in effect
+func reloadSidecar(srv *sidecar.Server, load func() (*config.SidecarConfig, error), settings config.Settings) config.Settings {
+	conf, err := load()
+	if err != nil {
+		log.Errorw("reload configuration error, keeping the running configuration", "error", err.Error())
+		return settings
+	}
+
+	reloaded, err := config.Snapshot(conf)
+	if err != nil {
+		log.Errorw("reload configuration snapshot error, keeping the running configuration", "error", err.Error())
+		return settings
+	}
+
+	if err := srv.Reload(conf.Server); err != nil {
+		log.Errorw("reload configuration is invalid, keeping the running configuration", "error", err.Error())
+		return settings
+	}
+
+	log.SetLevels(conf.Log)
+
+	return logChanges(settings, reloaded, config.SidecarReloadable)
+}
+
+// logChanges logs the changes of a reload and returns the settings in effect, the changes of the settings
+// which are not reloadable are reported again on the next reload
+func logChanges(settings, reloaded config.Settings, reloadable []string) config.Settings {
+	changes := config.Diff(settings, reloaded)
+	for _, change := range changes {
+		if change.Reloadable(reloadable) {
+			log.Infow("reload configuration changed", "change", change.String())
+		} else {
+			log.Warnw("reload configuration changed, it takes effect after a restart", "change", change.String())
+			// the setting in effect is still the running one
+			if prev, exists := settings[change.Path]; exists {
+				reloaded[change.Path] = prev
+			} else {
+				delete(reloaded, change.Path)
+			}
+		}
+	}
+
+	log.Infow("reload configuration success", "changes", len(changes))
+
+	return reloaded
+}
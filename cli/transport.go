@@ -0,0 +1,163 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Orlion/hersql/config"
+	"github.com/Orlion/hersql/log"
+	"github.com/Orlion/hersql/transport"
+)
+
+var transportCommand = &command{
+	name:    "transport",
+	args:    "[check-config | doctor]",
+	summary: "serve the http tunnel and relay the packets to the backend mysql servers",
+	setup: func(fs *flag.FlagSet) func(args []string) int {
+		configFile := fs.String("conf", "", "hersql transport config file, the settings may also be given by the HERSQL_* environment variables and the flags")
+		encryptSecrets := fs.String("encrypt-secrets", "", "yaml file of secrets to encrypt for an encrypted_file secret provider, the result is written to stdout")
+		secretsKeyEnv := fs.String("secrets-key-env", "HERSQL_SECRETS_KEY", "environment variable holding the key of -encrypt-secrets")
+		// the flags overriding the settings of the configuration file, such as -server.addr
+		overrides := config.NewFlags(fs, new(config.TransportConfig))
+
+		return func(args []string) int {
+			if *encryptSecrets != "" {
+				return doEncryptSecrets(*encryptSecrets, *secretsKeyEnv)
+			}
+
+			load := func() (*config.TransportConfig, error) {
+				return config.LoadTransportConfig(*configFile, overrides)
+			}
+
+			switch {
+			case len(args) == 0:
+				return serveTransport(load)
+			case len(args) == 1 && args[0] == "check-config":
+				return checkConfig(func() error {
+					_, err := load()
+					return err
+				})
+			case len(args) == 1 && args[0] == "doctor":
+				return doctorTransport(load)
+			default:
+				return usageError(fs, "unexpected arguments %v", args)
+			}
+		}
+	},
+}
+
+func doEncryptSecrets(file, keyEnv string) int {
+	plaintext, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "read secrets error: "+err.Error())
+		return ExitFailure
+	}
+
+	sealed, err := transport.EncryptSecrets(os.Getenv(keyEnv), plaintext)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "encrypt secrets error: "+err.Error())
+		return ExitFailure
+	}
+
+	os.Stdout.Write(sealed)
+
+	return ExitOK
+}
+
+func serveTransport(load func() (*config.TransportConfig, error)) int {
+	conf, err := load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "configuration error: "+err.Error())
+		return ExitConfig
+	}
+
+	// the settings as written in the file, the diff of a reload is computed against them
+	settings, err := config.Snapshot(conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "configuration snapshot error: "+err.Error())
+		return ExitFailure
+	}
+
+	log.Init(conf.Log)
+
+	srv, err := transport.NewServer(conf.Server)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "server error: "+err.Error())
+		return ExitConfig
+	}
+
+	go func() {
+		// the server is closed by the shutdown, which exits once the drain is over
+		if err = srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Fprintln(os.Stderr, "server error: "+err.Error())
+			os.Exit(ExitFailure)
+		}
+	}()
+
+	waitTransportStop(srv, load, settings, conf.Server.DrainTimeout)
+
+	return ExitOK
+}
+
+func waitTransportStop(srv *transport.Server, load func() (*config.TransportConfig, error), settings config.Settings, drainTimeout time.Duration) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
+	for {
+		var s os.Signal
+		select {
+		case s = <-c:
+		case <-srv.HandedOff():
+			// the new transport process serves the sessions now
+			log.Infow("sessions handed off, exiting")
+			log.Shutdown()
+			return
+		}
+
+		switch s {
+		case syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT:
+			log.Infow("received stop signal", "signal", s.String())
+			ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+			srv.Shutdown(ctx)
+			cancel()
+			log.Shutdown()
+			time.Sleep(1 * time.Second)
+			return
+		case syscall.SIGHUP:
+			log.Infow("received reload signal", "signal", s.String())
+			settings = reloadTransport(srv, load, settings)
+		default:
+		}
+	}
+}
+
+// reloadTransport applies the configuration to the running server, the running configuration is kept
+// if the configuration is invalid. It returns the settings of the configuration in effect
+func reloadTransport(srv *transport.Server, load func() (*config.TransportConfig, error), settings config.Settings) config.Settings {
+	conf, err := load()
+	if err != nil {
+		log.Errorw("reload configuration error, keeping the running configuration", "error", err.Error())
+		return settings
+	}
+
+	reloaded, err := config.Snapshot(conf)
+	if err != nil {
+		log.Errorw("reload configuration snapshot error, keeping the running configuration", "error", err.Error())
+		return settings
+	}
+
+	if err := srv.Reload(conf.Server); err != nil {
+		log.Errorw("reload configuration is invalid, keeping the running configuration", "error", err.Error())
+		return settings
+	}
+
+	log.SetLevels(conf.Log)
+
+	return logChanges(settings, reloaded, config.TransportReloadable)
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+
+	"github.com/Orlion/hersql/cli"
+)
+
+func main() {
+	os.Exit(cli.Main(os.Args[1:]))
+}
@@ -1,62 +1,12 @@
 package main
 
 import (
-	"context"
-	"flag"
-	"fmt"
 	"os"
-	"os/signal"
-	"syscall"
-	"time"
 
-	"github.com/Orlion/hersql/config"
-	"github.com/Orlion/hersql/log"
-	"github.com/Orlion/hersql/sidecar"
+	"github.com/Orlion/hersql/cli"
 )
 
-var configFile *string = flag.String("conf", "", "hersql sidecar config file")
-
+// hersql-sidecar is hersql sidecar, e.g. hersql-sidecar -conf=sidecar.yaml or hersql-sidecar check-config -conf=sidecar.yaml
 func main() {
-	flag.Parse()
-	conf, err := config.ParseSidecarConfig(*configFile)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "configuration file parse error: "+err.Error())
-		os.Exit(1)
-	}
-
-	log.Init(conf.Log)
-
-	srv, err := sidecar.NewServer(conf.Server)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "server error: "+err.Error())
-		os.Exit(1)
-	}
-
-	go func() {
-		if err = srv.ListenAndServe(); err != nil {
-			fmt.Fprintln(os.Stderr, "server error: "+err.Error())
-			os.Exit(1)
-		}
-	}()
-
-	waitGracefulStop(srv)
-}
-
-func waitGracefulStop(srv *sidecar.Server) {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
-	for {
-		s := <-c
-		switch s {
-		case syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT:
-			log.Infow("received stop signal", "signal", s.String())
-			ctx, _ := context.WithTimeout(context.Background(), 3000*time.Millisecond)
-			srv.Shutdown(ctx)
-			log.Shutdown()
-			time.Sleep(500 * time.Millisecond)
-			return
-		case syscall.SIGHUP:
-		default:
-		}
-	}
+	os.Exit(cli.Main(append([]string{"sidecar"}, os.Args[1:]...)))
 }
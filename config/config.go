@@ -1,8 +1,12 @@
 package config
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"io"
 	"os"
+	"strings"
 
 	"github.com/Orlion/hersql/log"
 	"github.com/Orlion/hersql/sidecar"
@@ -20,22 +24,30 @@ type TransportConfig struct {
 	Server *transport.Config `yaml:"server"`
 }
 
+// Problems are all the problems found in a configuration
+type Problems []error
+
+func (p Problems) Error() string {
+	if len(p) == 1 {
+		return p[0].Error()
+	}
+
+	lines := make([]string, 0, len(p))
+	for _, problem := range p {
+		lines = append(lines, problem.Error())
+	}
+
+	return fmt.Sprintf("%d problems:\n\t%s", len(p), strings.Join(lines, "\n\t"))
+}
+
 func ParseSidecarConfig(filename string) (conf *SidecarConfig, err error) {
 	if filename == "" {
 		err = errors.New("please enter a configuration file name")
 		return
 	}
 
-	fileData, err := os.ReadFile(filename)
-	if err != nil {
-		return
-	}
-
 	conf = new(SidecarConfig)
-	err = yaml.Unmarshal(fileData, conf)
-	if err != nil {
-		return
-	}
+	err = decodeFile(filename, conf)
 
 	return
 }
@@ -46,16 +58,100 @@ func ParseTransportConfig(filename string) (conf *TransportConfig, err error) {
 		return
 	}
 
+	conf = new(TransportConfig)
+	err = decodeFile(filename, conf)
+
+	return
+}
+
+// decodeFile decodes the file into the configuration, the unknown keys are rejected as they are mostly typos
+func decodeFile(filename string, conf interface{}) error {
 	fileData, err := os.ReadFile(filename)
 	if err != nil {
-		return
+		return err
 	}
 
-	conf = new(TransportConfig)
-	err = yaml.Unmarshal(fileData, conf)
+	decoder := yaml.NewDecoder(bytes.NewReader(fileData))
+	decoder.KnownFields(true)
+	// an empty file is an empty configuration
+	if err := decoder.Decode(conf); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	return nil
+}
+
+// LoadSidecarConfig loads the configuration from the file, which may be empty, applies the
+// environment variables and the flags over it, see Flags, and validates it. The problems found
+// are returned together as Problems
+func LoadSidecarConfig(filename string, flags *Flags) (*SidecarConfig, error) {
+	conf := new(SidecarConfig)
+	problems, err := load(filename, flags, conf)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	return
+	if conf.Server == nil {
+		conf.Server = new(sidecar.Config)
+	}
+
+	problems = appendProblems(problems, "log", conf.Log.Validate())
+	problems = appendProblems(problems, "server", conf.Server.Validate())
+	if len(problems) > 0 {
+		return nil, problems
+	}
+
+	return conf, nil
+}
+
+// LoadTransportConfig loads the configuration from the file, which may be empty, applies the
+// environment variables and the flags over it, see Flags, and validates it. The problems found
+// are returned together as Problems
+func LoadTransportConfig(filename string, flags *Flags) (*TransportConfig, error) {
+	conf := new(TransportConfig)
+	problems, err := load(filename, flags, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.Server == nil {
+		conf.Server = new(transport.Config)
+	}
+
+	problems = appendProblems(problems, "log", conf.Log.Validate())
+	problems = appendProblems(problems, "server", conf.Server.Validate())
+	if len(problems) > 0 {
+		return nil, problems
+	}
+
+	return conf, nil
+}
+
+// load decodes the file and applies the overrides. The unknown keys and the invalid values are returned
+// as problems, the decoding goes on past them so they are reported along with the other problems
+func load(filename string, flags *Flags, conf interface{}) (Problems, error) {
+	var problems Problems
+	if filename != "" {
+		if err := decodeFile(filename, conf); err != nil {
+			var typeErr *yaml.TypeError
+			if !errors.As(err, &typeErr) {
+				return nil, err
+			}
+			for _, e := range typeErr.Errors {
+				problems = append(problems, fmt.Errorf("%s %s", filename, e))
+			}
+		}
+	}
+
+	problems = append(problems, override(conf, flags)...)
+
+	return problems, nil
+}
+
+func appendProblems(problems Problems, section string, errs []error) Problems {
+	for _, err := range errs {
+		problems = append(problems, fmt.Errorf("%s: %w", section, err))
+	}
+
+	return problems
 }
@@ -0,0 +1,177 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// the settings applied by reloading the configuration, the other settings need a restart
+var (
+	SidecarReloadable = []string{
+		"log.stdout_level", "log.level",
+		"server.transport_addr", "server.transports", "server.headers", "server.backends",
+		"server.max_conns", "server.conn_queue_size", "server.conn_queue_timeout",
+	}
+	TransportReloadable = []string{
+		"log.stdout_level", "log.level",
+		"server.policies", "server.quotas", "server.backends",
+	}
+)
+
+// the values of the settings whose keys contain one of these are masked in a diff
+var sensitiveKeys = []string{"passwd", "password", "secret", "key", "token", "dsn", "headers"}
+
+// Change is a setting which differs between two configurations, sensitive values are masked
+type Change struct {
+	Path string
+	Old  string
+	New  string
+}
+
+func (c *Change) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.Path, c.Old, c.New)
+}
+
+// Reloadable reports whether the setting is one of the reloadable settings
+func (c *Change) Reloadable(reloadable []string) bool {
+	for _, path := range reloadable {
+		if c.Path == path || strings.HasPrefix(c.Path, path+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Settings are the settings of a configuration by dotted path
+type Settings map[string]setting
+
+type setting struct {
+	value string
+	// the value with the sensitive values masked
+	shown string
+}
+
+// Snapshot flattens the configuration into its settings, lists are compared as a whole.
+// It must be taken before the configuration is given to a server, which fills in the defaults
+func Snapshot(conf interface{}) (Settings, error) {
+	data, err := yaml.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	var tree interface{}
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return nil, err
+	}
+
+	settings := make(Settings)
+	flatten("", tree, settings)
+
+	return settings, nil
+}
+
+func flatten(path string, node interface{}, settings Settings) {
+	if m, ok := node.(map[string]interface{}); ok {
+		for key, value := range m {
+			if path != "" {
+				key = path + "." + key
+			}
+			flatten(key, value, settings)
+		}
+		return
+	}
+
+	if isSensitive(path) {
+		settings[path] = setting{value: render(node), shown: "******"}
+		return
+	}
+
+	settings[path] = setting{value: render(node), shown: render(mask(node))}
+}
+
+func isSensitive(path string) bool {
+	for _, key := range sensitiveKeys {
+		if strings.Contains(path, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mask masks the sensitive values within lists
+func mask(node interface{}) interface{} {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		masked := make(map[string]interface{}, len(n))
+		for key, value := range n {
+			if isSensitive(key) {
+				masked[key] = "******"
+			} else {
+				masked[key] = mask(value)
+			}
+		}
+		return masked
+	case []interface{}:
+		masked := make([]interface{}, len(n))
+		for i, value := range n {
+			masked[i] = mask(value)
+		}
+		return masked
+	default:
+		return node
+	}
+}
+
+// render renders lists in the yaml flow style on one line
+func render(node interface{}) string {
+	if _, ok := node.([]interface{}); !ok {
+		return fmt.Sprint(node)
+	}
+
+	var doc yaml.Node
+	if err := doc.Encode(node); err != nil {
+		return fmt.Sprint(node)
+	}
+	setFlowStyle(&doc)
+
+	data, err := yaml.Marshal(&doc)
+	if err != nil {
+		return fmt.Sprint(node)
+	}
+
+	return strings.TrimSpace(string(data))
+}
+
+func setFlowStyle(node *yaml.Node) {
+	node.Style |= yaml.FlowStyle
+	for _, child := range node.Content {
+		setFlowStyle(child)
+	}
+}
+
+// Diff returns the settings which differ between the configurations, ordered by path
+func Diff(old, new Settings) []*Change {
+	changes := make([]*Change, 0)
+	for path, value := range old {
+		if newValue, exists := new[path]; !exists || newValue.value != value.value {
+			changes = append(changes, &Change{Path: path, Old: value.shown, New: newValue.shown})
+		}
+	}
+
+	for path, value := range new {
+		if _, exists := old[path]; !exists {
+			changes = append(changes, &Change{Path: path, New: value.shown})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+
+	return changes
+}
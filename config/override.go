@@ -0,0 +1,191 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix prefixes the environment variables overriding the settings, HERSQL_SERVER_ADDR overrides server.addr
+const EnvPrefix = "HERSQL_"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Flags are the command line flags overriding the settings, there is one per setting named by its dotted path
+// such as -server.addr. The settings are taken from the configuration file, then from the HERSQL_* environment
+// variables, then from the flags, each overriding the previous ones. Lists and maps are given in the yaml flow style
+type Flags struct {
+	values map[string]string
+}
+
+// NewFlags defines the flags of the settings of the configuration on the flag set
+func NewFlags(fs *flag.FlagSet, conf interface{}) *Flags {
+	f := &Flags{values: make(map[string]string)}
+	walk(reflect.TypeOf(conf), "", func(path string, typ reflect.Type) {
+		fs.Var(&flagValue{path: path, typ: typ, values: f.values}, path, usage(path, typ))
+	})
+
+	return f
+}
+
+type flagValue struct {
+	path   string
+	typ    reflect.Type
+	values map[string]string
+}
+
+func (v *flagValue) String() string {
+	return ""
+}
+
+func (v *flagValue) Set(value string) error {
+	// the value is checked now so the mistakes are reported along with the usage
+	if err := decode(reflect.New(v.typ).Elem(), value); err != nil {
+		return err
+	}
+	v.values[v.path] = value
+
+	return nil
+}
+
+func (v *flagValue) IsBoolFlag() bool {
+	return v.typ.Kind() == reflect.Bool
+}
+
+func usage(path string, typ reflect.Type) string {
+	var name string
+	switch {
+	case typ == durationType:
+		name = "duration"
+	case typ.Kind() == reflect.Slice:
+		name = "list"
+	case typ.Kind() == reflect.Map:
+		name = "map"
+	default:
+		name = typ.Kind().String()
+	}
+
+	return fmt.Sprintf("overrides the `%s` setting %s, also set by %s", name, path, envName(path))
+}
+
+func envName(path string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
+
+// walk calls fn with the dotted path and the type of every setting, the sections are walked into
+func walk(typ reflect.Type, path string, fn func(path string, typ reflect.Type)) {
+	if typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name := yamlName(field)
+		if name == "" {
+			continue
+		}
+		if path != "" {
+			name = path + "." + name
+		}
+
+		if isSection(field.Type) {
+			walk(field.Type, name, fn)
+		} else {
+			fn(name, field.Type)
+		}
+	}
+}
+
+func isSection(typ reflect.Type) bool {
+	return typ.Kind() == reflect.Pointer && typ.Elem().Kind() == reflect.Struct
+}
+
+func yamlName(field reflect.StructField) string {
+	if !field.IsExported() {
+		return ""
+	}
+
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+
+	return name
+}
+
+// override applies the environment variables and then the flags over the configuration,
+// empty environment variables are ignored. It returns the invalid values
+func override(conf interface{}, flags *Flags) []error {
+	var errs []error
+	walk(reflect.TypeOf(conf), "", func(path string, typ reflect.Type) {
+		if value := os.Getenv(envName(path)); value != "" {
+			if err := set(conf, path, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s invalid value %q: %w", envName(path), value, err))
+			}
+		}
+
+		if value, exists := flags.lookup(path); exists {
+			if err := set(conf, path, value); err != nil {
+				errs = append(errs, fmt.Errorf("-%s invalid value %q: %w", path, value, err))
+			}
+		}
+	})
+
+	return errs
+}
+
+func (f *Flags) lookup(path string) (string, bool) {
+	if f == nil {
+		return "", false
+	}
+
+	value, exists := f.values[path]
+	return value, exists
+}
+
+// set sets the setting at the dotted path, the missing sections are created
+func set(conf interface{}, path string, value string) error {
+	v := reflect.ValueOf(conf)
+	for _, name := range strings.Split(path, ".") {
+		if v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+
+		for i := 0; i < v.NumField(); i++ {
+			if yamlName(v.Type().Field(i)) == name {
+				v = v.Field(i)
+				break
+			}
+		}
+	}
+
+	return decode(v, value)
+}
+
+// decode decodes the value into v, strings are taken as they are and the other values are decoded as yaml
+func decode(v reflect.Value, value string) error {
+	if v.Kind() == reflect.String {
+		v.SetString(value)
+		return nil
+	}
+
+	// the value replaces lists and maps instead of being merged into them
+	decoded := reflect.New(v.Type())
+	if err := yaml.Unmarshal([]byte(value), decoded.Interface()); err != nil {
+		return err
+	}
+	v.Set(decoded.Elem())
+
+	return nil
+}
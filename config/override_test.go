@@ -0,0 +1,230 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Orlion/hersql/sidecar"
+)
+
+const testSidecarConfig = `
+server:
+  addr: 127.0.0.1:3306
+  transport_addr: http://file:8080
+  dial_timeout: 5s
+  max_conns: 10
+  headers:
+    X-From: file
+  transports:
+    - addr: http://a:8080
+    - addr: http://b:8080
+`
+
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "sidecar.yaml")
+	if err := os.WriteFile(filename, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return filename
+}
+
+// parseFlags defines the flags of the sidecar settings and parses the arguments
+func parseFlags(t *testing.T, args []string) (*Flags, error) {
+	t.Helper()
+
+	fs := flag.NewFlagSet("sidecar", flag.ContinueOnError)
+	fs.SetOutput(new(strings.Builder))
+	flags := NewFlags(fs, new(SidecarConfig))
+
+	return flags, fs.Parse(args)
+}
+
+func TestLoadSidecarConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		check func(conf *sidecar.Config) interface{}
+		want  interface{}
+	}{
+		{
+			name:  "file",
+			check: func(conf *sidecar.Config) interface{} { return conf.TransportAddr },
+			want:  "http://file:8080",
+		},
+		{
+			name:  "environment over file",
+			env:   map[string]string{"HERSQL_SERVER_TRANSPORT_ADDR": "http://env:8080"},
+			check: func(conf *sidecar.Config) interface{} { return conf.TransportAddr },
+			want:  "http://env:8080",
+		},
+		{
+			name:  "flag over environment",
+			env:   map[string]string{"HERSQL_SERVER_TRANSPORT_ADDR": "http://env:8080"},
+			args:  []string{"-server.transport_addr", "http://flag:8080"},
+			check: func(conf *sidecar.Config) interface{} { return conf.TransportAddr },
+			want:  "http://flag:8080",
+		},
+		{
+			name:  "empty environment ignored",
+			env:   map[string]string{"HERSQL_SERVER_TRANSPORT_ADDR": ""},
+			check: func(conf *sidecar.Config) interface{} { return conf.TransportAddr },
+			want:  "http://file:8080",
+		},
+		{
+			name:  "duration",
+			env:   map[string]string{"HERSQL_SERVER_DIAL_TIMEOUT": "2s"},
+			check: func(conf *sidecar.Config) interface{} { return conf.DialTimeout },
+			want:  2 * time.Second,
+		},
+		{
+			name:  "int",
+			args:  []string{"-server.max_conns=20"},
+			check: func(conf *sidecar.Config) interface{} { return conf.MaxConns },
+			want:  20,
+		},
+		{
+			name:  "bool flag without value",
+			args:  []string{"-server.insecure_skip_verify"},
+			check: func(conf *sidecar.Config) interface{} { return conf.InsecureSkipVerify },
+			want:  true,
+		},
+		{
+			name:  "map replaced",
+			env:   map[string]string{"HERSQL_SERVER_HEADERS": "{X-From: env}"},
+			check: func(conf *sidecar.Config) interface{} { return conf.Headers },
+			want:  map[string]string{"X-From": "env"},
+		},
+		{
+			name: "list replaced",
+			args: []string{"-server.transports", "[{addr: 'http://c:8080', weight: 2}]"},
+			check: func(conf *sidecar.Config) interface{} {
+				var addrs []string
+				for _, endpoint := range conf.Transports {
+					addrs = append(addrs, endpoint.Addr)
+				}
+				return addrs
+			},
+			want: []string{"http://c:8080"},
+		},
+	}
+
+	filename := writeConfig(t, testSidecarConfig)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			flags, err := parseFlags(t, tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conf, err := LoadSidecarConfig(filename, flags)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := tt.check(conf.Server); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadSidecarConfigWithoutFile(t *testing.T) {
+	t.Setenv("HERSQL_SERVER_TRANSPORT_ADDR", "http://env:8080")
+	t.Setenv("HERSQL_LOG_STDOUT_LEVEL", "debug")
+
+	conf, err := LoadSidecarConfig("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the missing sections are created
+	if conf.Server.TransportAddr != "http://env:8080" || conf.Log == nil || conf.Log.StdoutLevel != "debug" {
+		t.Errorf("LoadSidecarConfig() = %+v %+v", conf.Server, conf.Log)
+	}
+}
+
+func TestLoadSidecarConfigProblems(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		// the problems expected, each one by a part of its message
+		want []string
+	}{
+		{
+			name: "invalid environment",
+			file: testSidecarConfig,
+			env:  map[string]string{"HERSQL_SERVER_MAX_CONNS": "many"},
+			want: []string{"HERSQL_SERVER_MAX_CONNS"},
+		},
+		{
+			name: "unknown key and invalid environment together",
+			file: testSidecarConfig + "  max_conn: 10\n",
+			env:  map[string]string{"HERSQL_SERVER_DIAL_TIMEOUT": "soon"},
+			want: []string{"max_conn", "HERSQL_SERVER_DIAL_TIMEOUT"},
+		},
+		{
+			name: "overridden value validated",
+			file: testSidecarConfig,
+			env:  map[string]string{"HERSQL_SERVER_COMPRESSION": "brotli"},
+			want: []string{"compression brotli"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			_, err := LoadSidecarConfig(writeConfig(t, tt.file), nil)
+			problems, ok := err.(Problems)
+			if !ok {
+				t.Fatalf("LoadSidecarConfig() error = %v, want Problems", err)
+			}
+			if len(problems) != len(tt.want) {
+				t.Fatalf("LoadSidecarConfig() problems = %v, want %d", problems, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(problems[i].Error(), want) {
+					t.Errorf("problem %d = %v, want %q in it", i, problems[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestFlagsRejectInvalidValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{"valid", []string{"-server.dial_timeout", "1s"}, false},
+		{"invalid duration", []string{"-server.dial_timeout", "soon"}, true},
+		{"invalid int", []string{"-server.max_conns", "many"}, true},
+		{"invalid list", []string{"-server.transports", "[{addr: "}, true},
+		{"unknown setting", []string{"-server.max_conn", "1"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseFlags(t, tt.args); (err != nil) != tt.wantErr {
+				t.Errorf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
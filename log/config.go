@@ -1,5 +1,12 @@
 package log
 
+import (
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap/zapcore"
+)
+
 type Config struct {
 	StdoutLevel string `yaml:"stdout_level"`
 	Level       string `yaml:"level"`
@@ -29,3 +36,27 @@ func withDefaultConf(conf *Config) *Config {
 
 	return conf
 }
+
+// Validate returns the problems of the configuration, a nil configuration is valid
+func (conf *Config) Validate() []error {
+	var problems []error
+	if conf == nil {
+		return problems
+	}
+
+	levels := []struct{ key, level string }{{"stdout_level", conf.StdoutLevel}, {"level", conf.Level}}
+	for _, l := range levels {
+		if l.level == "" {
+			continue
+		}
+		if _, err := zapcore.ParseLevel(l.level); err != nil {
+			problems = append(problems, fmt.Errorf("%s %s is not a log level, please use debug, info, warn or error", l.key, l.level))
+		}
+	}
+
+	if conf.MaxSize < 0 || conf.MaxAge < 0 || conf.MaxBackups < 0 {
+		problems = append(problems, errors.New("maxsize, maxage and maxbackups cannot be negative"))
+	}
+
+	return problems
+}
@@ -1,6 +1,7 @@
 package log
 
 import (
+	"fmt"
 	"os"
 
 	"go.uber.org/zap"
@@ -10,30 +11,24 @@ import (
 
 var logger *zap.SugaredLogger
 
+// the levels of the stdout and the file outputs, they can be changed while logging
+var (
+	stdoutLevel = zap.NewAtomicLevel()
+	fileLevel   = zap.NewAtomicLevel()
+)
+
 func Init(conf *Config) {
 	conf = withDefaultConf(conf)
+	SetLevels(conf)
 
 	encoderConfig := zap.NewProductionEncoderConfig()
 	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
 	encoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
 
-	level, err := zapcore.ParseLevel(conf.StdoutLevel)
-	if err != nil {
-		level = zapcore.InfoLevel
-	}
-
 	cores := make([]zapcore.Core, 1)
-	cores[0] = zapcore.NewCore(zapcore.NewConsoleEncoder(encoderConfig), zapcore.AddSync(os.Stdout), level)
+	cores[0] = zapcore.NewCore(zapcore.NewConsoleEncoder(encoderConfig), zapcore.AddSync(os.Stdout), stdoutLevel)
 
 	if conf.Filename != "" {
-		level, err = zapcore.ParseLevel(conf.Level)
-		if err != nil {
-			level = zapcore.ErrorLevel
-		}
-
-		priority := zap.LevelEnablerFunc(func(lev zapcore.Level) bool {
-			return lev >= level
-		})
 		infoFileWriteSyncer := zapcore.AddSync(&lumberjack.Logger{
 			Filename:   conf.Filename,
 			MaxSize:    conf.MaxSize,
@@ -43,35 +38,52 @@ func Init(conf *Config) {
 		})
 
 		encoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
-		core := zapcore.NewCore(zapcore.NewConsoleEncoder(encoderConfig), infoFileWriteSyncer, priority)
+		core := zapcore.NewCore(zapcore.NewConsoleEncoder(encoderConfig), infoFileWriteSyncer, fileLevel)
 		cores = append(cores, core)
 	}
 
 	logger = zap.New(zapcore.NewTee(cores...)).Sugar()
 }
 
+// SetLevels applies the levels of the configuration, the other settings only take effect in Init
+func SetLevels(conf *Config) {
+	conf = withDefaultConf(conf)
+
+	level, err := zapcore.ParseLevel(conf.StdoutLevel)
+	if err != nil {
+		level = zapcore.InfoLevel
+	}
+	stdoutLevel.SetLevel(level)
+
+	level, err = zapcore.ParseLevel(conf.Level)
+	if err != nil {
+		level = zapcore.ErrorLevel
+	}
+	fileLevel.SetLevel(level)
+}
+
 func Panicf(template string, args ...interface{}) {
-	logger.Panicf(template, args...)
+	logger.Panic(Redact(fmt.Sprintf(template, args...)))
 }
 
 func Debugw(msg string, keysAndValues ...interface{}) {
-	logger.Debugw(msg, keysAndValues...)
+	logger.Debugw(Redact(msg), redactKeysAndValues(keysAndValues)...)
 }
 
 func Infow(msg string, keysAndValues ...interface{}) {
-	logger.Infow(msg, keysAndValues...)
+	logger.Infow(Redact(msg), redactKeysAndValues(keysAndValues)...)
 }
 
 func Warnw(msg string, keysAndValues ...interface{}) {
-	logger.Warnw(msg, keysAndValues...)
+	logger.Warnw(Redact(msg), redactKeysAndValues(keysAndValues)...)
 }
 
 func Errorw(msg string, keysAndValues ...interface{}) {
-	logger.Errorw(msg, keysAndValues...)
+	logger.Errorw(Redact(msg), redactKeysAndValues(keysAndValues)...)
 }
 
 func Panicw(msg string, keysAndValues ...interface{}) {
-	logger.Panicw(msg, keysAndValues...)
+	logger.Panicw(Redact(msg), redactKeysAndValues(keysAndValues)...)
 }
 
 func Sync() {
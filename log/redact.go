@@ -0,0 +1,109 @@
+package log
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	redacted     = "******"
+	minSecretLen = 4
+)
+
+// sensitiveKeys are the keys whose values are never logged
+var sensitiveKeys = map[string]bool{
+	"passwd":   true,
+	"password": true,
+	"secret":   true,
+	"authData": true,
+	"authResp": true,
+}
+
+var secrets = struct {
+	sync.RWMutex
+	// the secrets of the configuration, kept for the life of the process
+	values map[string]bool
+	// the secrets of the sessions by the number of sessions holding them
+	held map[string]int
+}{values: make(map[string]bool), held: make(map[string]int)}
+
+// AddSecret registers a secret of the configuration, e.g. a backend password, which is replaced in every log entry.
+// Secrets shorter than minSecretLen would make the logs unreadable and are not registered
+func AddSecret(secret string) {
+	if len(secret) < minSecretLen {
+		return
+	}
+
+	secrets.Lock()
+	defer secrets.Unlock()
+	secrets.values[secret] = true
+}
+
+// HoldSecret registers a secret of a session, e.g. the password a client sent, until ReleaseSecret is called
+// as many times, so the secrets of the ended sessions are not redacted from every log entry forever
+func HoldSecret(secret string) {
+	if len(secret) < minSecretLen {
+		return
+	}
+
+	secrets.Lock()
+	defer secrets.Unlock()
+	secrets.held[secret]++
+}
+
+// ReleaseSecret releases a secret registered by HoldSecret
+func ReleaseSecret(secret string) {
+	if len(secret) < minSecretLen {
+		return
+	}
+
+	secrets.Lock()
+	defer secrets.Unlock()
+	if secrets.held[secret] <= 1 {
+		delete(secrets.held, secret)
+	} else {
+		secrets.held[secret]--
+	}
+}
+
+// Redact replaces the registered secrets in s
+func Redact(s string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+
+	for secret := range secrets.values {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	for secret := range secrets.held {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+
+	return s
+}
+
+// redactKeysAndValues redacts the values of sensitive keys and the secrets in string and error values
+func redactKeysAndValues(keysAndValues []interface{}) []interface{} {
+	redactedKeysAndValues := make([]interface{}, len(keysAndValues))
+	for i, v := range keysAndValues {
+		if i%2 == 1 {
+			if key, ok := keysAndValues[i-1].(string); ok && sensitiveKeys[key] {
+				redactedKeysAndValues[i] = redacted
+				continue
+			}
+		}
+
+		switch value := v.(type) {
+		case string:
+			redactedKeysAndValues[i] = Redact(value)
+		case error:
+			redactedKeysAndValues[i] = Redact(value.Error())
+		case fmt.Stringer:
+			redactedKeysAndValues[i] = Redact(value.String())
+		default:
+			redactedKeysAndValues[i] = v
+		}
+	}
+
+	return redactedKeysAndValues
+}
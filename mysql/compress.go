@@ -0,0 +1,135 @@
+package mysql
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+)
+
+// payloads shorter than this are sent uncompressed, the same as the mysql server does
+const MinCompressLength = 50
+
+// compressedReader unwraps the packets of the compressed protocol
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_basic_compression.html
+type compressedReader struct {
+	p   *PacketIO
+	r   io.Reader
+	buf []byte
+}
+
+func (r *compressedReader) Read(b []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if err := r.readCompressedPacket(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, r.buf)
+	r.buf = r.buf[n:]
+
+	return n, nil
+}
+
+func (r *compressedReader) readCompressedPacket() error {
+	header := []byte{0, 0, 0, 0, 0, 0, 0}
+
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		return err
+	}
+
+	compressedLength := int(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
+	uncompressedLength := int(uint32(header[4]) | uint32(header[5])<<8 | uint32(header[6])<<16)
+
+	// mysql and mariadb do not check the sequence of compressed packets either, just follow the peer
+	r.p.compressedSequence = header[3] + 1
+
+	payload := make([]byte, compressedLength)
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		return err
+	}
+
+	// uncompressed length 0 means the payload is not compressed
+	if uncompressedLength == 0 {
+		r.buf = payload
+		return nil
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	r.buf = make([]byte, uncompressedLength)
+	if _, err := io.ReadFull(zr, r.buf); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// compressedWriter wraps the written packets into packets of the compressed protocol
+type compressedWriter struct {
+	p *PacketIO
+	w io.Writer
+}
+
+func (w *compressedWriter) Write(data []byte) (int, error) {
+	for n := 0; n < len(data); {
+		payload := data[n:]
+		if len(payload) > MaxPayloadLen {
+			payload = payload[:MaxPayloadLen]
+		}
+
+		if err := w.writeCompressedPacket(payload); err != nil {
+			return n, err
+		}
+
+		n += len(payload)
+	}
+
+	return len(data), nil
+}
+
+func (w *compressedWriter) writeCompressedPacket(payload []byte) error {
+	uncompressedLength := 0
+
+	if len(payload) >= MinCompressLength {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		if _, err := zw.Write(payload); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+
+		// keep the payload uncompressed if compression does not make it smaller
+		if buf.Len() < len(payload) {
+			uncompressedLength = len(payload)
+			payload = buf.Bytes()
+		}
+	}
+
+	data := make([]byte, 7, 7+len(payload))
+
+	data[0] = byte(len(payload))
+	data[1] = byte(len(payload) >> 8)
+	data[2] = byte(len(payload) >> 16)
+	data[3] = w.p.compressedSequence
+	data[4] = byte(uncompressedLength)
+	data[5] = byte(uncompressedLength >> 8)
+	data[6] = byte(uncompressedLength >> 16)
+
+	data = append(data, payload...)
+
+	if n, err := w.w.Write(data); err != nil {
+		return err
+	} else if n != len(data) {
+		return io.ErrShortWrite
+	}
+
+	w.p.compressedSequence++
+
+	return nil
+}
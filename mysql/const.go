@@ -32,6 +32,17 @@ const (
 	SERVER_STATUS_METADATA_CHANGED     uint16 = 0x0400
 	SERVER_QUERY_WAS_SLOW              uint16 = 0x0800
 	SERVER_PS_OUT_PARAMS               uint16 = 0x1000
+	SERVER_STATUS_IN_TRANS_READONLY    uint16 = 0x2000
+	SERVER_SESSION_STATE_CHANGED       uint16 = 0x4000
+)
+
+const (
+	SESSION_TRACK_SYSTEM_VARIABLES byte = iota
+	SESSION_TRACK_SCHEMA
+	SESSION_TRACK_STATE_CHANGE
+	SESSION_TRACK_GTIDS
+	SESSION_TRACK_TRANSACTION_CHARACTERISTICS
+	SESSION_TRACK_TRANSACTION_STATE
 )
 
 const (
@@ -97,6 +108,54 @@ const (
 	CLIENT_DEPRECATE_EOF
 )
 
+const (
+	MYSQL_TYPE_DECIMAL byte = iota
+	MYSQL_TYPE_TINY
+	MYSQL_TYPE_SHORT
+	MYSQL_TYPE_LONG
+	MYSQL_TYPE_FLOAT
+	MYSQL_TYPE_DOUBLE
+	MYSQL_TYPE_NULL
+	MYSQL_TYPE_TIMESTAMP
+	MYSQL_TYPE_LONGLONG
+	MYSQL_TYPE_INT24
+	MYSQL_TYPE_DATE
+	MYSQL_TYPE_TIME
+	MYSQL_TYPE_DATETIME
+	MYSQL_TYPE_YEAR
+	MYSQL_TYPE_NEWDATE
+	MYSQL_TYPE_VARCHAR
+	MYSQL_TYPE_BIT
+)
+
+const (
+	MYSQL_TYPE_JSON byte = iota + 0xf5
+	MYSQL_TYPE_NEWDECIMAL
+	MYSQL_TYPE_ENUM
+	MYSQL_TYPE_SET
+	MYSQL_TYPE_TINY_BLOB
+	MYSQL_TYPE_MEDIUM_BLOB
+	MYSQL_TYPE_LONG_BLOB
+	MYSQL_TYPE_BLOB
+	MYSQL_TYPE_VAR_STRING
+	MYSQL_TYPE_STRING
+	MYSQL_TYPE_GEOMETRY
+)
+
+const (
+	NOT_NULL_FLAG       uint16 = 1
+	PRI_KEY_FLAG        uint16 = 2
+	UNIQUE_KEY_FLAG     uint16 = 4
+	BLOB_FLAG           uint16 = 16
+	UNSIGNED_FLAG       uint16 = 32
+	ZEROFILL_FLAG       uint16 = 64
+	BINARY_FLAG         uint16 = 128
+	ENUM_FLAG           uint16 = 256
+	AUTO_INCREMENT_FLAG uint16 = 512
+	TIMESTAMP_FLAG      uint16 = 1024
+	SET_FLAG            uint16 = 2048
+)
+
 const (
 	CachingSha2PasswordRequestPublicKey          = 2
 	CachingSha2PasswordFastAuthSuccess           = 3
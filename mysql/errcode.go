@@ -868,3 +868,7 @@ const (
 	ER_ROW_IN_WRONG_PARTITION                                                  = 1863
 	ER_ERROR_LAST                                                              = 1863
 )
+
+const (
+	ER_QUERY_TIMEOUT uint16 = 3024
+)
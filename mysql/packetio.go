@@ -5,18 +5,27 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"time"
 )
 
 type PacketIO struct {
-	rb *bufio.Reader
-	wb io.Writer
+	conn net.Conn
+	rb   *bufio.Reader
+	wb   io.Writer
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
 
 	Sequence uint8
+
+	compressed         bool
+	compressedSequence uint8
 }
 
 func NewPacketIO(conn net.Conn) *PacketIO {
 	p := new(PacketIO)
 
+	p.conn = conn
 	p.rb = bufio.NewReaderSize(conn, 1024)
 	p.wb = conn
 
@@ -25,7 +34,33 @@ func NewPacketIO(conn net.Conn) *PacketIO {
 	return p
 }
 
+// SetTimeout sets the timeouts applied to every packet read and write, zero means no timeout
+func (p *PacketIO) SetTimeout(readTimeout, writeTimeout time.Duration) {
+	p.readTimeout = readTimeout
+	p.writeTimeout = writeTimeout
+}
+
+// EnableCompression switches to the compressed protocol, it must be called right after
+// the handshake when CLIENT_COMPRESS has been negotiated
+func (p *PacketIO) EnableCompression() {
+	p.rb = bufio.NewReaderSize(&compressedReader{p: p, r: p.rb}, 1024)
+	p.wb = &compressedWriter{p: p, w: p.wb}
+	p.compressed = true
+}
+
+// ResetSequence resets the sequence at the start of a new command
+func (p *PacketIO) ResetSequence() {
+	p.Sequence = 0
+	p.compressedSequence = 0
+}
+
 func (p *PacketIO) ReadPacket() ([]byte, error) {
+	if p.readTimeout > 0 {
+		if err := p.conn.SetReadDeadline(time.Now().Add(p.readTimeout)); err != nil {
+			return nil, ErrBadConn
+		}
+	}
+
 	header := []byte{0, 0, 0, 0}
 
 	if _, err := io.ReadFull(p.rb, header); err != nil {
@@ -39,11 +74,12 @@ func (p *PacketIO) ReadPacket() ([]byte, error) {
 
 	sequence := uint8(header[3])
 
-	if sequence != p.Sequence {
+	// the sequence of the packets inside compressed packets is not checked, the same as the mysql server does
+	if sequence != p.Sequence && !p.compressed {
 		return nil, fmt.Errorf("invalid sequence %d != %d", sequence, p.Sequence)
 	}
 
-	p.Sequence++
+	p.Sequence = sequence + 1
 
 	data := make([]byte, length)
 	if _, err := io.ReadFull(p.rb, data); err != nil {
@@ -65,6 +101,12 @@ func (p *PacketIO) ReadPacket() ([]byte, error) {
 
 // data already have header
 func (p *PacketIO) WritePacket(data []byte) error {
+	if p.writeTimeout > 0 {
+		if err := p.conn.SetWriteDeadline(time.Now().Add(p.writeTimeout)); err != nil {
+			return ErrBadConn
+		}
+	}
+
 	length := len(data) - 4
 
 	for length >= MaxPayloadLen {
@@ -97,6 +139,13 @@ func (p *PacketIO) WritePacket(data []byte) error {
 		return ErrBadConn
 	} else {
 		p.Sequence++
+
+		// every write is flushed as compressed packets, the mysql server continues
+		// with the sequence of the compressed packets after a flush
+		if p.compressed {
+			p.Sequence = p.compressedSequence
+		}
+
 		return nil
 	}
 }
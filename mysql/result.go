@@ -1,8 +1,41 @@
 package mysql
 
 type Result struct {
-	Status uint16
+	Status   uint16
+	Warnings uint16
 
 	InsertId     uint64
 	AffectedRows uint64
+
+	Info                string
+	SessionStateChanges []SessionStateChange
+}
+
+// SessionStateChange is a single entry of the session state information
+// carried by an OK packet when CLIENT_SESSION_TRACK is negotiated
+type SessionStateChange struct {
+	Type byte
+	Data []byte
+}
+
+func ParseSessionStateChanges(b []byte) ([]SessionStateChange, error) {
+	changes := make([]SessionStateChange, 0)
+	for pos := 0; pos < len(b); {
+		typ := b[pos]
+		pos++
+
+		if pos >= len(b) {
+			return nil, ErrMalformPacket
+		}
+
+		data, _, n, err := LengthEncodedString(b[pos:])
+		if err != nil {
+			return nil, ErrMalformPacket
+		}
+		pos += n
+
+		changes = append(changes, SessionStateChange{Type: typ, Data: data})
+	}
+
+	return changes, nil
 }
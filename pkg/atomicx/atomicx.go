@@ -27,3 +27,11 @@ func (b *Bool) SetTrue() {
 func (b *Bool) SetFalse() {
 	atomic.StoreInt32((*int32)(b), 0)
 }
+
+func (b *Bool) Set(v bool) {
+	if v {
+		b.SetTrue()
+	} else {
+		b.SetFalse()
+	}
+}
@@ -0,0 +1,75 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket refilled with rate tokens per second up to burst tokens.
+// Take may drive the tokens negative, so a large amount delays the following requests
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(rate, burst float64) *Limiter {
+	return &Limiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Allow reports whether n tokens are available and takes them if so
+func (l *Limiter) Allow(n float64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+	if l.tokens < n {
+		return false
+	}
+
+	l.tokens -= n
+	return true
+}
+
+// Available reports whether any token is available
+func (l *Limiter) Available() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+	return l.tokens > 0
+}
+
+// Take takes n tokens even if they are not available
+func (l *Limiter) Take(n float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+	l.tokens -= n
+}
+
+// Full reports whether the bucket is full, the limiter then behaves like a new one
+func (l *Limiter) Full() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+	return l.tokens >= l.burst
+}
+
+func (l *Limiter) refill() {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
@@ -0,0 +1,153 @@
+package semaphore
+
+import (
+	"sync"
+	"time"
+)
+
+// Semaphore limits the number of holders, when it is full at most maxWaiters wait
+// for a slot for at most timeout. A nil Semaphore is unlimited
+type Semaphore struct {
+	mu sync.Mutex
+	// the holders at most, zero means unlimited
+	size    int
+	holders int
+	// the waiters in the order they came, a waiter is granted a slot by closing its channel
+	waiters    []chan struct{}
+	maxWaiters int
+	timeout    time.Duration
+}
+
+// New returns nil if size is zero
+func New(size, maxWaiters int, timeout time.Duration) *Semaphore {
+	if size <= 0 {
+		return nil
+	}
+
+	return NewResizable(size, maxWaiters, timeout)
+}
+
+// NewResizable returns a semaphore which may be resized later, it is unlimited if size is zero
+// but still counts its holders, so a resize takes them into account
+func NewResizable(size, maxWaiters int, timeout time.Duration) *Semaphore {
+	return &Semaphore{
+		size:       size,
+		maxWaiters: maxWaiters,
+		timeout:    timeout,
+	}
+}
+
+// Acquire takes a slot, it returns false if the wait queue is full or the wait timed out
+func (s *Semaphore) Acquire() bool {
+	if s == nil {
+		return true
+	}
+
+	s.mu.Lock()
+	if s.freeLocked() {
+		s.holders++
+		s.mu.Unlock()
+		return true
+	}
+
+	if len(s.waiters) >= s.maxWaiters {
+		s.mu.Unlock()
+		return false
+	}
+
+	granted := make(chan struct{})
+	s.waiters = append(s.waiters, granted)
+	timeout := s.timeout
+	s.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-granted:
+		return true
+	case <-timer.C:
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, waiter := range s.waiters {
+		if waiter == granted {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			return false
+		}
+	}
+
+	// the slot was granted as the wait timed out
+	return true
+}
+
+// TryAcquire takes a slot if one is free, it does not wait
+func (s *Semaphore) TryAcquire() bool {
+	if s == nil {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.freeLocked() {
+		return false
+	}
+
+	s.holders++
+
+	return true
+}
+
+func (s *Semaphore) Release() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.holders--
+	s.grantLocked()
+}
+
+// Resize changes the size, the wait queue and the timeout of the semaphore. The holders keep their slots,
+// when it shrinks below them new holders wait until enough of them released their slots
+func (s *Semaphore) Resize(size, maxWaiters int, timeout time.Duration) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.size, s.maxWaiters, s.timeout = size, maxWaiters, timeout
+	s.grantLocked()
+}
+
+// Len returns the number of holders
+func (s *Semaphore) Len() int {
+	if s == nil {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.holders
+}
+
+func (s *Semaphore) freeLocked() bool {
+	return s.size <= 0 || s.holders < s.size
+}
+
+// grantLocked hands the free slots to the waiters
+func (s *Semaphore) grantLocked() {
+	for len(s.waiters) > 0 && s.freeLocked() {
+		s.holders++
+		close(s.waiters[0])
+		s.waiters = s.waiters[1:]
+	}
+}
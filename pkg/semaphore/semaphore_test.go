@@ -0,0 +1,166 @@
+package semaphore
+
+import (
+	"testing"
+	"time"
+)
+
+// waitWaiters waits until n acquires wait in the queue of the semaphore, it returns false if they never do
+func waitWaiters(s *Semaphore, n int) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		waiters := len(s.waiters)
+		s.mu.Unlock()
+
+		if waiters == n {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	return false
+}
+
+func TestNil(t *testing.T) {
+	s := New(0, 10, time.Second)
+	if s != nil {
+		t.Fatal("New() of size zero is not nil")
+	}
+
+	for i := 0; i < 3; i++ {
+		if !s.Acquire() || !s.TryAcquire() {
+			t.Fatal("a nil semaphore is not unlimited")
+		}
+	}
+	s.Release()
+	s.Resize(1, 0, 0)
+
+	if n := s.Len(); n != 0 {
+		t.Errorf("Len() = %d, want 0", n)
+	}
+}
+
+func TestAcquireQueue(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxWaiters int
+		timeout    time.Duration
+		// whether the holder releases its slot while the acquire waits
+		release bool
+		want    bool
+		// the acquire returns no earlier than this, and no later than a second after it
+		wantWait time.Duration
+	}{
+		{"queue full", 0, time.Minute, false, false, 0},
+		{"queue timeout", 1, 50 * time.Millisecond, false, false, 50 * time.Millisecond},
+		{"released while waiting", 1, time.Minute, true, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(1, tt.maxWaiters, tt.timeout)
+			if !s.Acquire() {
+				t.Fatal("Acquire() of a free slot = false")
+			}
+
+			if tt.release {
+				go func() {
+					if !waitWaiters(s, 1) {
+						t.Error("the acquire did not wait in the queue")
+					}
+					s.Release()
+				}()
+			}
+
+			start := time.Now()
+			got := s.Acquire()
+			waited := time.Since(start)
+
+			if got != tt.want {
+				t.Errorf("Acquire() = %v, want %v", got, tt.want)
+			}
+			if waited < tt.wantWait || waited > tt.wantWait+time.Second {
+				t.Errorf("Acquire() returned after %s, want %s", waited, tt.wantWait)
+			}
+
+			// a timed out acquire leaves the queue and holds no slot
+			if !waitWaiters(s, 0) {
+				t.Error("the acquire stayed in the queue")
+			}
+			if n := s.Len(); n != 1 {
+				t.Errorf("Len() = %d, want 1", n)
+			}
+		})
+	}
+}
+
+func TestAcquireOrder(t *testing.T) {
+	s := New(1, 3, 5*time.Second)
+	s.Acquire()
+
+	granted := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			if s.Acquire() {
+				granted <- i
+			}
+		}(i)
+		if !waitWaiters(s, i+1) {
+			t.Fatalf("waiter %d did not wait in the queue", i)
+		}
+	}
+
+	// the waiters are granted the slot in the order they came
+	for want := 0; want < 3; want++ {
+		s.Release()
+		if got := <-granted; got != want {
+			t.Fatalf("waiter %d granted the slot, want %d", got, want)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	s := NewResizable(0, 1, 5*time.Second)
+	for i := 0; i < 3; i++ {
+		if !s.TryAcquire() {
+			t.Fatal("TryAcquire() of an unlimited semaphore = false")
+		}
+	}
+
+	// the holders keep their slots when the semaphore shrinks below them
+	s.Resize(2, 1, 5*time.Second)
+	if s.TryAcquire() {
+		t.Fatal("TryAcquire() below the holders = true")
+	}
+	s.Release()
+	if s.TryAcquire() {
+		t.Fatal("TryAcquire() at the size = true")
+	}
+
+	s.Release()
+	if !s.TryAcquire() {
+		t.Fatal("TryAcquire() after the holders went below the size = false")
+	}
+
+	// growing grants the slots to the waiters
+	acquired := make(chan bool)
+	go func() { acquired <- s.Acquire() }()
+	if !waitWaiters(s, 1) {
+		t.Fatal("the acquire did not wait in the queue")
+	}
+	s.Resize(3, 1, 5*time.Second)
+
+	select {
+	case ok := <-acquired:
+		if !ok {
+			t.Error("Acquire() = false after the semaphore grew")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the waiter was not granted the slot the semaphore grew by")
+	}
+
+	if n := s.Len(); n != 3 {
+		t.Errorf("Len() = %d, want 3", n)
+	}
+}
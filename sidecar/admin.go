@@ -0,0 +1,51 @@
+package sidecar
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// the hersql command reaches the transports through these without serving, with the certificates,
+// the proxy, the headers and the encryption key of the sidecar configuration
+
+// TransportAddrs returns the addresses of the transports of the server
+func (s *Server) TransportAddrs() []string {
+	endpoints := s.getEndpoints()
+	addrs := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		addrs = append(addrs, endpoint.Addr)
+	}
+
+	return addrs
+}
+
+// PingTransport probes the transport the way the server probes its transports
+func (s *Server) PingTransport(addr string) error {
+	return s.probeEndpoint(s.findEndpoint(addr))
+}
+
+// CallTransport posts the form to the transport the way the sessions do and decodes the response into v
+func (s *Server) CallTransport(addr, path string, form url.Values, v interface{}) error {
+	body, err := s.callTransport(s.findEndpoint(addr), path, form)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("transport response body unmarshal error: %w", err)
+	}
+
+	return nil
+}
+
+// findEndpoint returns the endpoint of the address, a transport which is not configured is reached all the same
+func (s *Server) findEndpoint(addr string) *TransportEndpoint {
+	for _, endpoint := range s.getEndpoints() {
+		if endpoint.Addr == addr {
+			return endpoint
+		}
+	}
+
+	return &TransportEndpoint{Addr: addr, Weight: 1}
+}
@@ -0,0 +1,177 @@
+package sidecar
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/Orlion/hersql/log"
+	"github.com/Orlion/hersql/mysql"
+	mysql_driver "github.com/go-sql-driver/mysql"
+)
+
+// DefaultBackend is the name of the backend given by the dsn of the client handshake
+const DefaultBackend = "default"
+
+// Backend names a backend the clients can switch to with USE <name> or a /* hersql:target=<name> */ hint
+type Backend struct {
+	Name string `yaml:"name"`
+	// [username[:password]@][protocol[(address)]]/dbname
+	DSN string `yaml:"dsn"`
+
+	dsn *mysql_driver.Config
+}
+
+func (b *Backend) init() error {
+	if b.Name == "" {
+		return fmt.Errorf("backend name cannot be empty")
+	}
+
+	if b.Name == DefaultBackend {
+		return fmt.Errorf("backend name %s is reserved", DefaultBackend)
+	}
+
+	dsn, err := mysql_driver.ParseDSN(b.DSN)
+	if err != nil {
+		return fmt.Errorf("backend %s dsn parse error: %w", b.Name, err)
+	}
+	b.dsn = dsn
+	log.AddSecret(dsn.Passwd)
+
+	return nil
+}
+
+// backendSession is a transport session to a backend the client switched away from
+type backendSession struct {
+	dsn      *mysql_driver.Config
+	endpoint *TransportEndpoint
+	runid    string
+	connId   uint64
+}
+
+var (
+	useRegexp    = regexp.MustCompile("(?i)^\\s*USE\\s+`?([^`\\s;]+)`?\\s*;?\\s*$")
+	targetRegexp = regexp.MustCompile(`/\*\s*hersql:target=([^\s*]+)\s*\*/`)
+)
+
+// handleRoute handles USE <name> and COM_INIT_DB aimed at a backend name, which switch the backend of the
+// following commands, and the /* hersql:target=<name> */ hint, which switches the backend before the query
+// is relayed. Names which are not backend names are left to the backend as database names
+func (c *Conn) handleRoute(data []byte) (bool, error) {
+	switch data[0] {
+	case mysql.COM_INIT_DB:
+		name := string(data[1:])
+		if !c.isBackend(name) {
+			return false, nil
+		}
+
+		return true, c.switchBackend(name)
+	case mysql.COM_QUERY:
+		if matches := useRegexp.FindSubmatch(data[1:]); matches != nil {
+			name := string(matches[1])
+			if !c.isBackend(name) {
+				return false, nil
+			}
+
+			return true, c.switchBackend(name)
+		}
+
+		if matches := targetRegexp.FindSubmatch(data[1:]); matches != nil {
+			name := string(matches[1])
+			if !c.isBackend(name) {
+				return true, mysql.NewError(mysql.ER_BAD_DB_ERROR, fmt.Sprintf("Unknown backend '%s'", name))
+			}
+
+			if err := c.switchBackend(name); err != nil {
+				return true, err
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// switchBackend parks the transport session of the current backend and resumes the session of the backend,
+// a session is opened if the connection has none to the backend yet
+func (c *Conn) switchBackend(name string) error {
+	if name == c.backend {
+		return nil
+	}
+
+	// the backend may have been removed by reloading the configuration
+	backend := c.server.getBackend(name)
+	if _, exists := c.sessions[name]; !exists && backend == nil {
+		return fmt.Errorf("backend %s not found", name)
+	}
+
+	log.Infow("conn switch backend", "conn", c.name(), "backend", name)
+
+	prev := c.backend
+	c.sessions[prev] = &backendSession{dsn: c.dsn, endpoint: c.endpoint, runid: c.transportRunid, connId: c.transportConnId}
+
+	if c.resumeSession(name) {
+		return nil
+	}
+
+	c.backend = name
+	c.dsn = backend.dsn
+	c.endpoint = nil
+	c.transportRunid = ""
+	c.transportConnId = 0
+
+	if err := c.transportConnect(); err != nil {
+		if c.transportConnId > 0 {
+			if err := c.transportDisconnect(c.endpoint, c.transportRunid, c.transportConnId); err != nil {
+				log.Warnw("conn switch backend transportDisconnect error occurred", "conn", c.name(), "error", err.Error())
+			}
+		}
+
+		c.resumeSession(prev)
+
+		return fmt.Errorf("switch to backend %s error: %w", name, err)
+	}
+
+	return nil
+}
+
+func (c *Conn) resumeSession(name string) bool {
+	session, exists := c.sessions[name]
+	if !exists {
+		return false
+	}
+
+	delete(c.sessions, name)
+
+	c.backend = name
+	c.dsn = session.dsn
+	c.endpoint = session.endpoint
+	c.transportRunid = session.runid
+	c.transportConnId = session.connId
+
+	return true
+}
+
+// closeSessions disconnects the parked transport sessions
+func (c *Conn) closeSessions() {
+	for name, session := range c.sessions {
+		delete(c.sessions, name)
+
+		if err := c.transportDisconnect(session.endpoint, session.runid, session.connId); err != nil {
+			log.Warnw("conn closeSessions transportDisconnect error occurred", "conn", c.name(), "backend", name, "error", err.Error())
+		}
+	}
+}
+
+// isBackend reports whether the name is a configured backend or the backend of a session of the connection
+func (c *Conn) isBackend(name string) bool {
+	if _, exists := c.sessions[name]; exists || name == c.backend {
+		return true
+	}
+
+	return c.server.getBackend(name) != nil
+}
+
+func (s *Server) getBackend(name string) *Backend {
+	s.confMu.RLock()
+	defer s.confMu.RUnlock()
+	return s.backends[name]
+}
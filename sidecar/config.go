@@ -1,12 +1,51 @@
 package sidecar
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 type Config struct {
-	Addr               string `yaml:"addr"`
-	TransportAddr      string `yaml:"transport_addr"`
-	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
-	Version            string `yaml:"version"`
+	Addr        string `yaml:"addr"`
+	Version     string `yaml:"version"`
+	Compression string `yaml:"compression"`
+	// a single transport, shorthand for a transports entry
+	TransportAddr string `yaml:"transport_addr"`
+	// the transports new sessions are spread over, the healthy ones with the lowest priority are used
+	Transports []*TransportEndpoint `yaml:"transports"`
+	// how often the transports are probed when there are several of them
+	TransportProbeInterval time.Duration `yaml:"transport_probe_interval"`
+	InsecureSkipVerify     bool          `yaml:"insecure_skip_verify"`
+	// PEM file of the CAs trusted in addition to the system ones
+	CAFile string `yaml:"ca_file"`
+	// client certificate presented to transports which authenticate the sidecars by certificate
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// empty follows HTTP_PROXY, HTTPS_PROXY and NO_PROXY, direct disables the proxy, otherwise the proxy url
+	Proxy string `yaml:"proxy"`
+	// headers added to the requests to the transports, Host overrides the host of the requests
+	Headers map[string]string `yaml:"headers"`
+	// base64 encoded 32 byte key sealing the payloads of the tunnel, it must be the key of the transports
+	EncryptionKey string `yaml:"encryption_key"`
+	// timeouts of the client connections and of the requests to the transport, zero means no timeout
+	DialTimeout      time.Duration `yaml:"dial_timeout"`
+	HandshakeTimeout time.Duration `yaml:"handshake_timeout"`
+	ReadTimeout      time.Duration `yaml:"read_timeout"`
+	WriteTimeout     time.Duration `yaml:"write_timeout"`
+	TransportTimeout time.Duration `yaml:"transport_timeout"`
+	// how long a shutdown waits for the running commands and the open transactions, defaults to 30s
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+	// cap of the client connections, zero means no limit. Connections beyond the cap wait in a queue
+	// of conn_queue_size for at most conn_queue_timeout before they receive ER_CON_COUNT_ERROR
+	MaxConns         int           `yaml:"max_conns"`
+	ConnQueueSize    int           `yaml:"conn_queue_size"`
+	ConnQueueTimeout time.Duration `yaml:"conn_queue_timeout"`
+	// named backends the clients can switch to, the name may also be given as the database of the handshake
+	Backends []*Backend `yaml:"backends"`
+	// backend whose version, capability flags and collation the clients are greeted with instead of version,
+	// the greeting is sent before the clients name their backend
+	GreetingBackend string `yaml:"greeting_backend"`
 }
 
 func withDefaultConf(conf *Config) error {
@@ -18,13 +57,68 @@ func withDefaultConf(conf *Config) error {
 		conf.Addr = DefaultServerAddr
 	}
 
-	if conf.TransportAddr == "" {
-		return errors.New("transport_addr configuration cannot be empty")
+	if conf.TransportAddr != "" {
+		conf.Transports = append([]*TransportEndpoint{{Addr: conf.TransportAddr}}, conf.Transports...)
+	}
+
+	if len(conf.Transports) == 0 {
+		return errors.New("transport_addr or transports configuration cannot be empty")
+	}
+
+	for _, endpoint := range conf.Transports {
+		if err := endpoint.init(); err != nil {
+			return err
+		}
+	}
+
+	if conf.TransportProbeInterval == 0 {
+		conf.TransportProbeInterval = DefaultTransportProbeInterval
 	}
 
 	if conf.Version == "" {
 		conf.Version = DefaultServerVersion
 	}
 
+	if conf.DialTimeout == 0 {
+		conf.DialTimeout = DefaultDialTimeout
+	}
+
+	if conf.HandshakeTimeout == 0 {
+		conf.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+
+	if conf.DrainTimeout == 0 {
+		conf.DrainTimeout = DefaultDrainTimeout
+	}
+
+	if conf.ConnQueueSize < 0 {
+		return errors.New("conn_queue_size cannot be negative")
+	}
+
+	names := make(map[string]bool, len(conf.Backends))
+	for _, backend := range conf.Backends {
+		if err := backend.init(); err != nil {
+			return err
+		}
+		if names[backend.Name] {
+			return fmt.Errorf("backend name %s is duplicated", backend.Name)
+		}
+		names[backend.Name] = true
+	}
+
+	if conf.GreetingBackend != "" && !names[conf.GreetingBackend] {
+		return fmt.Errorf("greeting_backend %s is not one of the backends", conf.GreetingBackend)
+	}
+
+	if (conf.CertFile == "") != (conf.KeyFile == "") {
+		return errors.New("cert_file and key_file must be configured together")
+	}
+
+	switch conf.Compression {
+	case "", CompressionGzip, CompressionZstd:
+	default:
+		return fmt.Errorf("compression %s is not supported, please use %s or %s", conf.Compression, CompressionGzip, CompressionZstd)
+	}
+
 	return nil
 }
@@ -7,30 +7,55 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/Orlion/hersql/log"
 	"github.com/Orlion/hersql/mysql"
+	"github.com/Orlion/hersql/transport"
 	mysql_driver "github.com/go-sql-driver/mysql"
 )
 
 var DEFAULT_CAPABILITY uint32 = mysql.CLIENT_LONG_PASSWORD | mysql.CLIENT_LONG_FLAG |
-	mysql.CLIENT_CONNECT_WITH_DB | mysql.CLIENT_PROTOCOL_41 |
+	mysql.CLIENT_CONNECT_WITH_DB | mysql.CLIENT_COMPRESS | mysql.CLIENT_PROTOCOL_41 |
 	mysql.CLIENT_TRANSACTIONS | mysql.CLIENT_SECURE_CONNECTION |
-	mysql.CLIENT_PLUGIN_AUTH
+	mysql.CLIENT_PLUGIN_AUTH | mysql.CLIENT_SESSION_TRACK |
+	mysql.CLIENT_DEPRECATE_EOF
+
+// framingCapability are the flags changing the framing of the packets relayed from the backend, the greeting is sent
+// before the client names its backend, so the transport converts the packets of backends not supporting them
+var framingCapability uint32 = mysql.CLIENT_SESSION_TRACK | mysql.CLIENT_DEPRECATE_EOF
 
 type Conn struct {
-	connId          uint32
-	server          *Server
-	rwc             net.Conn
-	remoteAddr      string
-	pkg             *mysql.PacketIO
-	salt            []byte
-	status          uint16
-	capability      uint32
-	collation       uint8
-	dsn             *mysql_driver.Config
-	transportRunid  string
-	transportConnId uint64
+	connId           uint32
+	server           *Server
+	rwc              net.Conn
+	remoteAddr       string
+	pkg              *mysql.PacketIO
+	salt             []byte
+	status           uint16
+	serverCapability uint32
+	capability       uint32
+	collation        uint8
+	dsn              *mysql_driver.Config
+	endpoint         *TransportEndpoint
+	transportRunid   string
+	transportConnId  uint64
+	// the backend of the transport session, the sessions of the backends switched away from are parked
+	backend  string
+	sessions map[string]*backendSession
+	// guards the transaction state against the drain of a shutdown waking the conn up
+	drainMu       sync.Mutex
+	inTransaction bool
+	// the password of the dsn held in the log redaction, released once the conn is served
+	heldSecret string
+	// the backend user the conn connected as, conns may only kill the conns of the same owner
+	owner string
+	// the handshake of the backend of the transport session
+	backendGreeting *greeting
 }
 
 func (c *Conn) serve() {
@@ -39,8 +64,12 @@ func (c *Conn) serve() {
 			log.Errorw("conn serve panic", "conn", c.name(), "error", err)
 		}
 
+		c.server.delConn(c.connId)
+
+		c.closeSessions()
+
 		if c.transportConnId > 0 {
-			if err := c.transportDisconnect(); err != nil {
+			if err := c.transportDisconnect(c.endpoint, c.transportRunid, c.transportConnId); err != nil {
 				log.Warnw("conn serve transportDisconnect error occurred", "conn", c.name(), "error", err.Error())
 			}
 		}
@@ -49,10 +78,17 @@ func (c *Conn) serve() {
 		} else {
 			log.Infow("conn serve closed", "conn", c.name())
 		}
+
+		log.ReleaseSecret(c.heldSecret)
 	}()
 
 	log.Infow("conn serve start", "conn", c.name())
 
+	if c.server.shuttingDown() {
+		c.writeError(errServerShutdown)
+		return
+	}
+
 	err := c.handshake()
 	if err != nil {
 		log.Errorw("conn serve handshake error occurred", "conn", c.name(), "error", err.Error())
@@ -61,8 +97,13 @@ func (c *Conn) serve() {
 
 	log.Infow("conn serve handshake success", "conn", c.name())
 
+	// the conn is visible to KILL statements of other conns from now on
+	c.server.addConn(c)
+
 	for {
-		if c.server.shuttingDown() {
+		if !c.continueServing() {
+			log.Infow("conn serve server shutdown", "conn", c.name())
+			c.writeError(errServerShutdown)
 			break
 		}
 
@@ -70,6 +111,10 @@ func (c *Conn) serve() {
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				log.Infow("conn serve read closed", "conn", c.name())
+			} else if c.server.shuttingDown() {
+				// woken up by the drain of the shutdown
+				log.Infow("conn serve server shutdown", "conn", c.name())
+				c.writeError(errServerShutdown)
 			} else {
 				log.Warnw("conn serve read packet error occurred", "conn", c.name(), "error", err.Error())
 			}
@@ -78,10 +123,41 @@ func (c *Conn) serve() {
 
 		log.Infow("conn serve read packet", "conn", c.name(), "length", len(data))
 
+		// KILL statements aimed at the connection ids of the sidecar are translated for the transport
+		if handled, err := c.handleKill(data); handled {
+			if err != nil {
+				log.Warnw("conn serve kill error occurred", "conn", c.name(), "error", err.Error())
+				c.writeError(err)
+			} else {
+				c.writeOK(nil)
+			}
+			c.pkg.ResetSequence()
+			continue
+		}
+
+		// USE statements and hints aimed at a backend name switch the backend of the conn
+		if handled, err := c.handleRoute(data); handled {
+			if err != nil {
+				log.Warnw("conn serve route error occurred", "conn", c.name(), "error", err.Error())
+				c.writeError(err)
+			} else {
+				c.writeOK(nil)
+			}
+			c.pkg.ResetSequence()
+			continue
+		}
+
 		// 发送到服务端
 		if responsePackets, err := c.transport(data); err != nil {
 			log.Errorw("conn serve transport error occurred", "conn", c.name(), "error", err.Error())
 			c.writeError(err)
+
+			// the command may still run on the backend and its response is lost, the session ends
+			// rather than leaving the client out of step with the backend
+			if isTimeout(err) {
+				log.Warnw("conn serve transport timeout, ending the session", "conn", c.name())
+				break
+			}
 		} else {
 			if len(responsePackets) < 1 {
 				c.transportConnId = 0
@@ -96,13 +172,20 @@ func (c *Conn) serve() {
 				}
 				log.Infow("conn serve write packet", "conn", c.name(), "length", len(responsePacket))
 			}
+
+			c.trackStatus(responsePackets[len(responsePackets)-1])
 		}
 
-		c.pkg.Sequence = 0
+		c.pkg.ResetSequence()
 	}
 }
 
 func (c *Conn) handshake() error {
+	if c.server.handshakeTimeout > 0 {
+		c.rwc.SetDeadline(time.Now().Add(c.server.handshakeTimeout))
+		defer c.rwc.SetDeadline(time.Time{})
+	}
+
 	if err := c.writeInitialHandshake(); err != nil {
 		return fmt.Errorf("writeInitialHandshake error: %w", err)
 	}
@@ -112,6 +195,8 @@ func (c *Conn) handshake() error {
 		return fmt.Errorf("readHandshakeResponse error: %w", err)
 	}
 
+	c.owner = fmt.Sprintf("%s@%s?%s=%s", c.dsn.User, c.dsn.Addr, CredentialParam, c.dsn.Params[CredentialParam])
+
 	if err := c.transportConnect(); err != nil {
 		err = fmt.Errorf("transportConnect error: %w", err)
 		c.writeError(err)
@@ -122,19 +207,31 @@ func (c *Conn) handshake() error {
 		return fmt.Errorf("writeOK error: %w", err)
 	}
 
-	c.pkg.Sequence = 0
+	c.pkg.ResetSequence()
+
+	if c.capability&mysql.CLIENT_COMPRESS > 0 {
+		c.pkg.EnableCompression()
+	}
 
 	return nil
 }
 
 func (c *Conn) writeInitialHandshake() error {
+	// the backend is only known from the handshake response, so the greeting follows the greeting backend if one is
+	// configured. The transport makes up for the framing flags the backend lacks and the session uses the collation of the client
+	version, capability, collation := c.server.version, DEFAULT_CAPABILITY, uint8(mysql.DEFAULT_COLLATION_ID)
+	if g := c.server.getGreeting(); g != nil {
+		version, capability, collation = g.version, g.capabilityFlags(), g.collation
+	}
+	c.serverCapability = capability
+
 	data := make([]byte, 4, 128)
 
 	//protocol version Always 10
 	data = append(data, 10)
 
 	//exit version[00]
-	data = append(data, c.server.version...)
+	data = append(data, version...)
 	data = append(data, 0)
 
 	// thread id
@@ -146,18 +243,18 @@ func (c *Conn) writeInitialHandshake() error {
 	//filter [00]
 	data = append(data, 0)
 
-	//capability flag lower 2 bytes, using default capability here
-	data = append(data, byte(DEFAULT_CAPABILITY), byte(DEFAULT_CAPABILITY>>8))
+	//capability flag lower 2 bytes
+	data = append(data, byte(capability), byte(capability>>8))
 
 	//charset, utf-8 default
-	data = append(data, uint8(mysql.DEFAULT_COLLATION_ID))
+	data = append(data, collation)
 
 	//status
 	data = append(data, byte(c.status), byte(c.status>>8))
 
 	//below 13 byte may not be used
-	//capability flag upper 2 bytes, using default capability here
-	data = append(data, byte(DEFAULT_CAPABILITY>>16), byte(DEFAULT_CAPABILITY>>24))
+	//capability flag upper 2 bytes
+	data = append(data, byte(capability>>16), byte(capability>>24))
 
 	//filter [0x15], for wireshark dump, value is 0x15
 	data = append(data, 0x15)
@@ -185,8 +282,8 @@ func (c *Conn) readHandshakeResponse() error {
 
 	pos := 0
 
-	//capability
-	c.capability = binary.LittleEndian.Uint32(data[:4])
+	//capability, only keep the flags both the client and the sidecar support
+	c.capability = binary.LittleEndian.Uint32(data[:4]) & c.serverCapability
 	pos += 4
 
 	//skip max packet size
@@ -215,10 +312,21 @@ func (c *Conn) readHandshakeResponse() error {
 
 		dsnStr := string(data[pos : pos+bytes.IndexByte(data[pos:], 0)])
 
+		// the database may be the name of a configured backend instead of a dsn
+		if backend := c.server.getBackend(dsnStr); backend != nil {
+			c.backend = backend.Name
+			c.dsn = backend.dsn
+			return nil
+		}
+
 		c.dsn, err = mysql_driver.ParseDSN(dsnStr)
 		if err != nil {
-			return fmt.Errorf(`the database "%s" failed to be parsed as a dsn, error: %w. the correct format is "[username[:password]@][protocol[(address)]]/dbname[?param1=value1&...&paramN=valueN]"`, dsnStr, err)
+			// the dsn is not repeated, it may carry a password
+			return fmt.Errorf(`the database failed to be parsed as a dsn, error: %w. the correct format is "[username[:password]@][protocol[(address)]]/dbname[?param1=value1&...&paramN=valueN]"`, err)
 		}
+		// the password of the dsn is redacted from the logs while the conn lasts
+		log.HoldSecret(c.dsn.Passwd)
+		c.heldSecret = c.dsn.Passwd
 
 		pos += len(dsnStr) + 1
 	} else {
@@ -228,6 +336,65 @@ func (c *Conn) readHandshakeResponse() error {
 	return nil
 }
 
+var killRegexp = regexp.MustCompile(`(?i)^\s*KILL\s+(?:(QUERY|CONNECTION)\s+)?(\d+)\s*;?\s*$`)
+
+// handleKill handles KILL [QUERY|CONNECTION] n and COM_PROCESS_KILL aimed at a connection of the sidecar,
+// the thread ids the client knows are the connection ids of the sidecar rather than of the backend
+func (c *Conn) handleKill(data []byte) (bool, error) {
+	var (
+		id       uint64
+		killType = transport.KillConnection
+	)
+
+	switch data[0] {
+	case mysql.COM_QUERY:
+		matches := killRegexp.FindSubmatch(data[1:])
+		if matches == nil {
+			return false, nil
+		}
+
+		if strings.EqualFold(string(matches[1]), "QUERY") {
+			killType = transport.KillQuery
+		}
+
+		var err error
+		if id, err = strconv.ParseUint(string(matches[2]), 10, 32); err != nil {
+			return false, nil
+		}
+	case mysql.COM_PROCESS_KILL:
+		if len(data) < 5 {
+			return false, nil
+		}
+		id = uint64(binary.LittleEndian.Uint32(data[1:]))
+	default:
+		return false, nil
+	}
+
+	// ids which are not connection ids of the sidecar are left to the backend
+	target, exists := c.server.getConn(uint32(id))
+	if !exists {
+		return false, nil
+	}
+
+	// like mysql, only the conns of the same backend user may be killed
+	if target.owner != c.owner {
+		log.Warnw("conn kill denied", "conn", c.name(), "target", target.name())
+		return true, mysql.NewError(mysql.ER_KILL_DENIED_ERROR, fmt.Sprintf("You are not owner of thread %d", id))
+	}
+
+	log.Infow("conn kill", "conn", c.name(), "target", target.name(), "type", killType)
+
+	if err := target.transportKill(killType); err != nil {
+		return true, fmt.Errorf("kill %d error: %w", id, err)
+	}
+
+	if killType == transport.KillConnection {
+		target.close()
+	}
+
+	return true, nil
+}
+
 func (c *Conn) writeOK(r *mysql.Result) error {
 	if r == nil {
 		r = &mysql.Result{Status: c.status}
@@ -244,13 +411,17 @@ func (c *Conn) writeOK(r *mysql.Result) error {
 		data = append(data, 0, 0)
 	}
 
+	//info, a length encoded string if CLIENT_SESSION_TRACK is set
+	if c.capability&mysql.CLIENT_SESSION_TRACK > 0 {
+		data = append(data, 0)
+	}
+
 	return c.writePacket(data)
 }
 
 func (c *Conn) writeError(e error) error {
 	var m *mysql.SqlError
-	var ok bool
-	if m, ok = e.(*mysql.SqlError); !ok {
+	if !errors.As(e, &m) {
 		m = mysql.NewError(mysql.ER_UNKNOWN_ERROR, e.Error())
 	}
 
@@ -283,5 +454,9 @@ func (c *Conn) close() error {
 }
 
 func (c *Conn) name() string {
-	return fmt.Sprintf("[id:%d, from:%s, transportConnid:%d]", c.connId, c.remoteAddr, c.transportConnId)
+	endpoint := ""
+	if c.endpoint != nil {
+		endpoint = c.endpoint.Addr
+	}
+	return fmt.Sprintf("[id:%d, from:%s, backend:%s, transport:%s, transportConnid:%d]", c.connId, c.remoteAddr, c.backend, endpoint, c.transportConnId)
 }
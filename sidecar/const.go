@@ -1,6 +1,31 @@
 package sidecar
 
+import (
+	"time"
+
+	"github.com/Orlion/hersql/transport"
+)
+
+const (
+	DefaultServerAddr       = "127.0.0.1:3306"
+	DefaultServerVersion    = "8.0.11-hersql-0.1.0"
+	DefaultDialTimeout      = 10 * time.Second
+	DefaultHandshakeTimeout = 10 * time.Second
+
+	DefaultTransportProbeInterval = 10 * time.Second
+	DefaultDrainTimeout           = 30 * time.Second
+)
+
 const (
-	DefaultServerAddr    = "127.0.0.1:3306"
-	DefaultServerVersion = "8.0.11-hersql-0.1.0"
+	CompressionGzip = transport.EncodingGzip
+	CompressionZstd = transport.EncodingZstd
+
+	// the dsn parameter referring to a credential of the transport by name
+	CredentialParam = "credential"
+
+	// the proxy configuration disabling the proxy
+	ProxyDirect = "direct"
+
+	// request bodies shorter than this are not worth compressing
+	compressMinSize = 1024
 )
@@ -0,0 +1,78 @@
+package sidecar
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/Orlion/hersql/mysql"
+)
+
+var errServerShutdown = mysql.NewError(mysql.ER_SERVER_SHUTDOWN, "Server shutdown in progress")
+
+// continueServing reports whether the conn reads its next command. Once the server shuts down the conns
+// end between commands, those in a transaction are served until the transaction ends or the drain times out
+func (c *Conn) continueServing() bool {
+	if !c.server.shuttingDown() {
+		return true
+	}
+
+	c.drainMu.Lock()
+	defer c.drainMu.Unlock()
+
+	if !c.inTransaction || c.server.drainExpired.Get() {
+		return false
+	}
+
+	// the drain may have woken the conn up before the transaction began
+	c.rwc.SetReadDeadline(time.Time{})
+
+	return true
+}
+
+// wake interrupts the read of the next command of the conn so it ends, conns in a transaction are only woken when forced
+func (c *Conn) wake(force bool) {
+	c.drainMu.Lock()
+	defer c.drainMu.Unlock()
+
+	if force || !c.inTransaction {
+		c.rwc.SetReadDeadline(time.Now())
+	}
+}
+
+// trackStatus records the server status of the OK or EOF packet ending a response
+func (c *Conn) trackStatus(packet []byte) {
+	var status uint16
+	switch {
+	case packet[0] == mysql.EOF_HEADER && len(packet) == 5 && c.capability&mysql.CLIENT_DEPRECATE_EOF == 0:
+		status = binary.LittleEndian.Uint16(packet[3:])
+	case (packet[0] == mysql.OK_HEADER || packet[0] == mysql.EOF_HEADER && c.capability&mysql.CLIENT_DEPRECATE_EOF > 0) && len(packet) >= 7:
+		// skip the affected rows and the last insert id
+		pos := 1
+		_, _, n := mysql.LengthEncodedInt(packet[pos:])
+		pos += n
+		_, _, n = mysql.LengthEncodedInt(packet[pos:])
+		pos += n
+		if len(packet) < pos+2 {
+			return
+		}
+		status = binary.LittleEndian.Uint16(packet[pos:])
+	default:
+		return
+	}
+
+	c.drainMu.Lock()
+	defer c.drainMu.Unlock()
+
+	c.status = status
+	c.inTransaction = status&mysql.SERVER_STATUS_IN_TRANS > 0
+}
+
+// wakeConns wakes up the conns waiting for their next command
+func (s *Server) wakeConns(force bool) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	for _, c := range s.conns {
+		c.wake(force)
+	}
+}
@@ -0,0 +1,168 @@
+package sidecar
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Orlion/hersql/mysql"
+	"github.com/Orlion/hersql/transport"
+)
+
+// sessionTransport relays every session to a backend which answers each query with an OK packet,
+// the sessions are in a transaction after BEGIN and until COMMIT
+func sessionTransport(t *testing.T) string {
+	t.Helper()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/connect":
+			capability, _ := strconv.ParseUint(r.FormValue("capability"), 10, 32)
+			json.NewEncoder(w).Encode(&transport.ConnectResponse{Response: transport.Response{Success: true}, Data: &transport.ConnectResponseData{
+				Runid:            "1",
+				ConnId:           1,
+				RelayCapability:  uint32(capability),
+				ServerVersion:    DefaultServerVersion,
+				ServerCapability: DEFAULT_CAPABILITY,
+				ServerCollation:  uint8(mysql.DEFAULT_COLLATION_ID),
+			}})
+		case "/transport":
+			packet := r.FormValue("packet")
+			if packet == "" || packet[0] == mysql.COM_QUIT {
+				json.NewEncoder(w).Encode(&transport.TransportResponse{Response: transport.Response{Success: true}, Data: [][]byte{}})
+				return
+			}
+
+			status := uint16(mysql.SERVER_STATUS_AUTOCOMMIT)
+			if query := strings.ToUpper(packet[1:]); strings.HasPrefix(query, "BEGIN") || strings.HasPrefix(query, "INSERT") {
+				status |= mysql.SERVER_STATUS_IN_TRANS
+			}
+			ok := []byte{mysql.OK_HEADER, 0, 0, byte(status), byte(status >> 8), 0, 0}
+			json.NewEncoder(w).Encode(&transport.TransportResponse{Response: transport.Response{Success: true}, Data: [][]byte{ok}})
+		default:
+			json.NewEncoder(w).Encode(&transport.Response{Success: true})
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	return ts.URL
+}
+
+// startSidecar serves the sidecar and opens a client session to the backend blog through it
+func startSidecar(t *testing.T) (*Server, *sql.Conn) {
+	t.Helper()
+
+	s, err := NewServer(&Config{
+		TransportAddr: sessionTransport(t),
+		Backends:      []*Backend{{Name: "blog", DSN: "root:secret@tcp(10.0.0.1:3306)/blog"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go s.serve()
+	t.Cleanup(func() { s.listener.Close() })
+
+	db, err := sql.Open("mysql", "root:secret@tcp("+s.listener.Addr().String()+")/blog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return s, conn
+}
+
+func TestShutdownDrain(t *testing.T) {
+	tests := []struct {
+		name string
+		// the statements run before the shutdown, and while it drains
+		before, during []string
+		drainTimeout   time.Duration
+		wantErr        error
+	}{
+		{"idle", nil, nil, 5 * time.Second, nil},
+		// the transaction is served until it ends
+		{"transaction committed", []string{"BEGIN"}, []string{"INSERT INTO t VALUES (1)", "COMMIT"}, 5 * time.Second, nil},
+		{"transaction left open", []string{"BEGIN"}, nil, 100 * time.Millisecond, context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, conn := startSidecar(t)
+			ctx := context.Background()
+
+			for _, query := range tt.before {
+				if _, err := conn.ExecContext(ctx, query); err != nil {
+					t.Fatalf("%s error = %v", query, err)
+				}
+			}
+
+			shutdownCtx, cancel := context.WithTimeout(ctx, tt.drainTimeout)
+			defer cancel()
+			shutdown := make(chan error, 1)
+			go func() { shutdown <- s.Shutdown(shutdownCtx) }()
+
+			for !s.shuttingDown() {
+				time.Sleep(time.Millisecond)
+			}
+			for _, query := range tt.during {
+				if _, err := conn.ExecContext(ctx, query); err != nil {
+					t.Fatalf("%s while draining error = %v", query, err)
+				}
+			}
+
+			select {
+			case err := <-shutdown:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Shutdown() error = %v, want %v", err, tt.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Shutdown() did not return")
+			}
+
+			// the session ended with the drain
+			if _, err := conn.ExecContext(ctx, "SELECT 1"); err == nil {
+				t.Error("the session outlived the shutdown")
+			}
+			within(t, 5*time.Second, func() {
+				for s.getConnNum() > 0 {
+					time.Sleep(time.Millisecond)
+				}
+			})
+		})
+	}
+}
+
+// within fails the test if fn does not return in time
+func within(t *testing.T, timeout time.Duration, fn func()) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatalf("did not return within %s", timeout)
+	}
+}
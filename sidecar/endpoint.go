@@ -0,0 +1,165 @@
+package sidecar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Orlion/hersql/log"
+	"github.com/Orlion/hersql/pkg/atomicx"
+)
+
+// TransportEndpoint is a transport the sidecar opens sessions on. New sessions go to the healthy endpoints
+// with the lowest priority, spread by weight, a session stays on the endpoint which created it
+type TransportEndpoint struct {
+	Addr     string `yaml:"addr"`
+	Priority int    `yaml:"priority"`
+	// zero means 1
+	Weight int `yaml:"weight"`
+
+	unhealthy atomicx.Bool
+	// the content coding of the request bodies, set once the transport encoded a response with it
+	encoding atomic.Value
+}
+
+// requestEncoding returns the content coding the request bodies are encoded with, empty if not known yet
+func (e *TransportEndpoint) requestEncoding() string {
+	encoding, _ := e.encoding.Load().(string)
+	return encoding
+}
+
+func (e *TransportEndpoint) init() error {
+	if e.Addr == "" {
+		return errors.New("transport addr cannot be empty")
+	}
+
+	if e.Weight < 0 {
+		return fmt.Errorf("transport %s weight cannot be negative", e.Addr)
+	}
+
+	if e.Weight == 0 {
+		e.Weight = 1
+	}
+
+	return nil
+}
+
+// pickEndpoints returns the endpoints in the order new sessions try them: the healthy ones by priority,
+// shuffled by weight within a priority, then the unhealthy ones in case the probes are stale
+func (s *Server) pickEndpoints() []*TransportEndpoint {
+	s.randMu.Lock()
+	defer s.randMu.Unlock()
+
+	type candidate struct {
+		endpoint *TransportEndpoint
+		key      float64
+	}
+
+	endpoints := s.getEndpoints()
+	candidates := make([]candidate, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		// weighted random order, the larger the weight the smaller the key tends to be
+		candidates = append(candidates, candidate{endpoint, s.rand.ExpFloat64() / float64(endpoint.Weight)})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if ah, bh := !a.endpoint.unhealthy.Get(), !b.endpoint.unhealthy.Get(); ah != bh {
+			return ah
+		}
+		if a.endpoint.Priority != b.endpoint.Priority {
+			return a.endpoint.Priority < b.endpoint.Priority
+		}
+		return a.key < b.key
+	})
+
+	picked := make([]*TransportEndpoint, len(candidates))
+	for i, c := range candidates {
+		picked[i] = c.endpoint
+	}
+
+	return picked
+}
+
+// probeEndpoints probes the endpoints every interval until the server shuts down,
+// a single endpoint is used whatever its health so it is not probed
+func (s *Server) probeEndpoints() {
+	ticker := time.NewTicker(s.probeInterval)
+	defer ticker.Stop()
+
+	for {
+		// the endpoints may change when the configuration is reloaded
+		if endpoints := s.getEndpoints(); len(endpoints) > 1 {
+			var wg sync.WaitGroup
+			for _, endpoint := range endpoints {
+				wg.Add(1)
+				go func(endpoint *TransportEndpoint) {
+					defer wg.Done()
+					s.setEndpointHealth(endpoint, s.probeEndpoint(endpoint))
+				}(endpoint)
+			}
+			wg.Wait()
+		}
+
+		select {
+		case <-s.getDoneChan():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) probeEndpoint(endpoint *TransportEndpoint) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.probeInterval)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.Addr+"/ping", nil)
+	if err != nil {
+		return err
+	}
+	s.setHeaders(req)
+
+	resp, err := s.transportClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (s *Server) setEndpointHealth(endpoint *TransportEndpoint, err error) {
+	if err == nil {
+		if endpoint.unhealthy.Get() {
+			log.Infow("transport endpoint healthy", "addr", endpoint.Addr)
+			endpoint.unhealthy.SetFalse()
+		}
+		return
+	}
+
+	if !endpoint.unhealthy.Get() {
+		log.Warnw("transport endpoint unhealthy", "addr", endpoint.Addr, "error", err.Error())
+		endpoint.unhealthy.SetTrue()
+	}
+}
+
+// getEndpoints returns the endpoints, the slice is replaced rather than modified when the configuration is reloaded
+func (s *Server) getEndpoints() []*TransportEndpoint {
+	s.confMu.RLock()
+	defer s.confMu.RUnlock()
+	return s.endpoints
+}
+
+func newRand() *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
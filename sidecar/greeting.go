@@ -0,0 +1,90 @@
+package sidecar
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Orlion/hersql/log"
+	"github.com/Orlion/hersql/mysql"
+)
+
+// backendCapability are the capability flags of the greeting which describe the backend, the other flags describe
+// the sidecar itself: the handshake with the client, the dsn given as its database and the compression between them
+var backendCapability uint32 = mysql.CLIENT_LONG_PASSWORD | mysql.CLIENT_LONG_FLAG | mysql.CLIENT_TRANSACTIONS | framingCapability
+
+// how long the clients are greeted with the configured version after the greeting of the backend could not be learned
+const greetingRetryInterval = time.Minute
+
+// greeting is the handshake of a backend as the transport reports it from /connect
+type greeting struct {
+	version    string
+	capability uint32
+	collation  uint8
+}
+
+// capabilityFlags returns the capability flags the sidecar greets with, the flags of the sidecar which the backend supports
+func (g *greeting) capabilityFlags() uint32 {
+	return DEFAULT_CAPABILITY&^backendCapability | DEFAULT_CAPABILITY&g.capability&backendCapability
+}
+
+// getGreeting returns the greeting of the greeting backend. The greeting is sent before the client names its backend,
+// so it is learned from a session opened to the greeting backend the first time a client connects. It returns nil if
+// no greeting backend is configured or it could not be reached, the clients are greeted with the configured version then
+func (s *Server) getGreeting() *greeting {
+	if s.greetingBackend == "" {
+		return nil
+	}
+
+	s.greetingMu.Lock()
+	defer s.greetingMu.Unlock()
+
+	if s.greeting != nil || time.Since(s.greetingFailedAt) < greetingRetryInterval {
+		return s.greeting
+	}
+
+	g, err := s.learnGreeting()
+	if err != nil {
+		log.Warnw("server learn the greeting of the backend error occurred, greeting with the configured version", "backend", s.greetingBackend, "error", err.Error())
+		s.greetingFailedAt = time.Now()
+		return nil
+	}
+
+	log.Infow("server greeting with the backend", "backend", s.greetingBackend, "version", g.version, "capability", g.capability, "collation", g.collation)
+	s.greeting = g
+
+	return g
+}
+
+// learnGreeting opens a transport session to the greeting backend and closes it again
+func (s *Server) learnGreeting() (*greeting, error) {
+	backend := s.getBackend(s.greetingBackend)
+	if backend == nil {
+		return nil, fmt.Errorf("backend %s is not configured", s.greetingBackend)
+	}
+
+	c := &Conn{
+		server:     s,
+		backend:    backend.Name,
+		dsn:        backend.dsn,
+		capability: DEFAULT_CAPABILITY,
+		collation:  uint8(mysql.DEFAULT_COLLATION_ID),
+	}
+	if err := c.transportConnect(); err != nil {
+		return nil, err
+	}
+
+	if err := c.transportDisconnect(c.endpoint, c.transportRunid, c.transportConnId); err != nil {
+		log.Warnw("server learn the greeting transportDisconnect error occurred", "backend", s.greetingBackend, "error", err.Error())
+	}
+
+	return c.backendGreeting, nil
+}
+
+// forgetGreeting makes the next client learn the greeting again, e.g. as the greeting backend was reloaded
+func (s *Server) forgetGreeting() {
+	s.greetingMu.Lock()
+	defer s.greetingMu.Unlock()
+
+	s.greeting = nil
+	s.greetingFailedAt = time.Time{}
+}
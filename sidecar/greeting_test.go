@@ -0,0 +1,188 @@
+package sidecar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	stdlog "log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Orlion/hersql/log"
+	"github.com/Orlion/hersql/mysql"
+	"github.com/Orlion/hersql/transport"
+	mysql_driver "github.com/go-sql-driver/mysql"
+)
+
+func TestMain(m *testing.M) {
+	// the servers log, only their failures are of interest
+	log.Init(&log.Config{StdoutLevel: "fatal"})
+	// the clients of the tests see their sessions end under them
+	mysql_driver.SetLogger(stdlog.New(io.Discard, "", 0))
+	os.Exit(m.Run())
+}
+
+// fakeTransport answers /connect with the handshake of the backend and counts the sessions opened,
+// a nil handshake fails the connects
+func fakeTransport(t *testing.T, handshake *transport.ConnectResponseData, connects *int64) string {
+	t.Helper()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/connect":
+			atomic.AddInt64(connects, 1)
+			if handshake == nil {
+				json.NewEncoder(w).Encode(&transport.Response{Msg: "handleConnect dial to 10.0.0.1:3306 failed"})
+				return
+			}
+			json.NewEncoder(w).Encode(&transport.ConnectResponse{Response: transport.Response{Success: true}, Data: handshake})
+		default:
+			json.NewEncoder(w).Encode(&transport.Response{Success: true})
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	return ts.URL
+}
+
+func TestGetGreeting(t *testing.T) {
+	// a mysql 5.7 backend supports neither CLIENT_DEPRECATE_EOF nor CLIENT_SESSION_TRACK
+	mysql57 := &transport.ConnectResponseData{
+		Runid:            "1",
+		ConnId:           1,
+		RelayCapability:  framingCapability,
+		ServerVersion:    "5.7.44-log",
+		ServerCapability: DEFAULT_CAPABILITY &^ framingCapability,
+		ServerCollation:  8,
+	}
+
+	tests := []struct {
+		name            string
+		greetingBackend string
+		handshake       *transport.ConnectResponseData
+		want            *greeting
+		wantConnects    int64
+	}{
+		{"mirrored", "blog", mysql57, &greeting{version: "5.7.44-log", capability: mysql57.ServerCapability, collation: 8}, 1},
+		{"backend unreachable", "blog", nil, nil, 1},
+		{"no greeting backend", "", mysql57, nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var connects int64
+			s, err := NewServer(&Config{
+				TransportAddr:   fakeTransport(t, tt.handshake, &connects),
+				Backends:        []*Backend{{Name: "blog", DSN: "root:secret@tcp(10.0.0.1:3306)/blog"}},
+				GreetingBackend: tt.greetingBackend,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the greeting is learned once, and not tried again right after a failure
+			for i := 0; i < 3; i++ {
+				got := s.getGreeting()
+				if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+					t.Fatalf("getGreeting() = %+v, want %+v", got, tt.want)
+				}
+			}
+
+			if n := atomic.LoadInt64(&connects); n != tt.wantConnects {
+				t.Errorf("connects = %d, want %d", n, tt.wantConnects)
+			}
+		})
+	}
+}
+
+func TestWriteInitialHandshake(t *testing.T) {
+	var connects int64
+	handshake := &transport.ConnectResponseData{
+		Runid:            "1",
+		ConnId:           1,
+		RelayCapability:  framingCapability,
+		ServerVersion:    "10.6.16-MariaDB",
+		ServerCapability: DEFAULT_CAPABILITY &^ mysql.CLIENT_DEPRECATE_EOF,
+		ServerCollation:  45,
+	}
+
+	tests := []struct {
+		name            string
+		greetingBackend string
+		wantVersion     string
+		wantCapability  uint32
+		wantCollation   uint8
+	}{
+		{"configured version", "", DefaultServerVersion, DEFAULT_CAPABILITY, uint8(mysql.DEFAULT_COLLATION_ID)},
+		{"greeting backend", "blog", "10.6.16-MariaDB", DEFAULT_CAPABILITY &^ mysql.CLIENT_DEPRECATE_EOF, 45},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewServer(&Config{
+				TransportAddr:   fakeTransport(t, handshake, &connects),
+				Backends:        []*Backend{{Name: "blog", DSN: "root:secret@tcp(10.0.0.1:3306)/blog"}},
+				GreetingBackend: tt.greetingBackend,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			server, client := net.Pipe()
+			defer client.Close()
+			c := &Conn{server: s, rwc: server, pkg: mysql.NewPacketIO(server), salt: mysql.RandomBuf(20)}
+			go func() {
+				defer server.Close()
+				c.writeInitialHandshake()
+			}()
+
+			data, err := mysql.NewPacketIO(client).ReadPacket()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// protocol version, server version, thread id, auth data, filler
+			version := string(data[1 : 1+bytes.IndexByte(data[1:], 0)])
+			pos := 1 + len(version) + 1 + 4 + 8 + 1
+			capability := uint32(binary.LittleEndian.Uint16(data[pos:])) | uint32(binary.LittleEndian.Uint16(data[pos+5:]))<<16
+			collation := data[pos+2]
+
+			if version != tt.wantVersion || capability != tt.wantCapability || collation != tt.wantCollation {
+				t.Errorf("greeting %s capability %#x collation %d, want %s %#x %d", version, capability, collation, tt.wantVersion, tt.wantCapability, tt.wantCollation)
+			}
+		})
+	}
+}
+
+func TestGreetingCapabilityFlags(t *testing.T) {
+	tests := []struct {
+		name       string
+		capability uint32
+		want       uint32
+	}{
+		{"every flag", 0xffffffff, DEFAULT_CAPABILITY},
+		{"without the framing flags", DEFAULT_CAPABILITY &^ framingCapability, DEFAULT_CAPABILITY &^ framingCapability},
+		// the flags of the sidecar's own handshake and compression stay
+		{"no flag", 0, DEFAULT_CAPABILITY &^ backendCapability},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := (&greeting{capability: tt.capability}).capabilityFlags()
+			if got != tt.want {
+				t.Errorf("capabilityFlags() = %#x, want %#x", got, tt.want)
+			}
+
+			for _, flag := range []uint32{mysql.CLIENT_PROTOCOL_41, mysql.CLIENT_SECURE_CONNECTION, mysql.CLIENT_PLUGIN_AUTH, mysql.CLIENT_CONNECT_WITH_DB} {
+				if got&flag == 0 {
+					t.Errorf("capabilityFlags() = %#x lacks the flag %#x of the sidecar", got, flag)
+				}
+			}
+		})
+	}
+}
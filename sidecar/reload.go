@@ -0,0 +1,55 @@
+package sidecar
+
+// Reload applies the backends, the transports, the headers and the connection cap of the configuration
+// to the running server without dropping the connections, the other settings take effect after a restart.
+// An invalid configuration is rejected and the running one is kept
+func (s *Server) Reload(conf *Config) error {
+	if err := withDefaultConf(conf); err != nil {
+		return err
+	}
+
+	backends := make(map[string]*Backend, len(conf.Backends))
+	for _, backend := range conf.Backends {
+		backends[backend.Name] = backend
+	}
+
+	running := make(map[string]*TransportEndpoint)
+	for _, endpoint := range s.getEndpoints() {
+		running[endpoint.Addr] = endpoint
+	}
+
+	for _, endpoint := range conf.Transports {
+		if prev, exists := running[endpoint.Addr]; exists {
+			endpoint.inherit(prev)
+		}
+	}
+
+	// the greeting backend may have changed its dsn, the greeting is forgotten once the backends are replaced.
+	// Learning the greeting reads the backends, so it is not forgotten under confMu
+	defer s.forgetGreeting()
+
+	s.confMu.Lock()
+	defer s.confMu.Unlock()
+
+	// the connections keep the sessions they opened, new sessions use the reloaded backends and transports
+	s.backends = backends
+	s.endpoints = conf.Transports
+	s.headers = conf.Headers
+
+	// the cap is resized, it still counts the connections admitted before the reload. When it shrinks below them
+	// the new connections wait until enough of them closed
+	s.connSlots.Resize(conf.MaxConns, conf.ConnQueueSize, conf.ConnQueueTimeout)
+
+	return nil
+}
+
+// inherit takes over the state of the running endpoint of the same address
+func (e *TransportEndpoint) inherit(prev *TransportEndpoint) {
+	if prev.unhealthy.Get() {
+		e.unhealthy.SetTrue()
+	}
+
+	if encoding := prev.requestEncoding(); encoding != "" {
+		e.encoding.Store(encoding)
+	}
+}
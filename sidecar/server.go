@@ -2,8 +2,8 @@ package sidecar
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
+	"math/rand"
 	"net"
 	"net/http"
 	"sync"
@@ -13,6 +13,8 @@ import (
 	"github.com/Orlion/hersql/log"
 	"github.com/Orlion/hersql/mysql"
 	"github.com/Orlion/hersql/pkg/atomicx"
+	"github.com/Orlion/hersql/pkg/semaphore"
+	"github.com/Orlion/hersql/transport"
 )
 
 var (
@@ -26,32 +28,79 @@ func genConnId() uint32 {
 }
 
 type Server struct {
-	mu              sync.Mutex
-	version         string
-	listener        net.Listener
-	connNum         int64
-	inShutdown      atomicx.Bool
-	doneChan        chan struct{}
-	addr            string
-	transportAddr   string
-	transportClient *http.Client
+	mu      sync.Mutex
+	connsMu sync.Mutex
+	conns   map[uint32]*Conn
+	// guards the backends, the endpoints, the headers and the connection cap, which are replaced
+	// when the configuration is reloaded
+	confMu           sync.RWMutex
+	backends         map[string]*Backend
+	version          string
+	listener         net.Listener
+	connNum          int64
+	inShutdown       atomicx.Bool
+	drainExpired     atomicx.Bool
+	doneChan         chan struct{}
+	addr             string
+	endpoints        []*TransportEndpoint
+	probeInterval    time.Duration
+	randMu           sync.Mutex
+	rand             *rand.Rand
+	transportClient  *http.Client
+	headers          map[string]string
+	envelope         *transport.Envelope
+	compression      string
+	handshakeTimeout time.Duration
+	readTimeout      time.Duration
+	writeTimeout     time.Duration
+	// cap of the client connections, it is resized when the configuration is reloaded
+	connSlots *semaphore.Semaphore
+	// the backend the clients are greeted as and its greeting once learned, see getGreeting
+	greetingBackend  string
+	greetingMu       sync.Mutex
+	greeting         *greeting
+	greetingFailedAt time.Time
 }
 
 func NewServer(conf *Config) (*Server, error) {
 	if err := withDefaultConf(conf); err != nil {
 		return nil, err
 	}
+
+	transportClient, err := newTransportClient(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	var envelope *transport.Envelope
+	if conf.EncryptionKey != "" {
+		if envelope, err = transport.NewEnvelope(conf.EncryptionKey); err != nil {
+			return nil, err
+		}
+	}
+
+	backends := make(map[string]*Backend, len(conf.Backends))
+	for _, backend := range conf.Backends {
+		backends[backend.Name] = backend
+	}
+
 	return &Server{
-		version:       conf.Version,
-		addr:          conf.Addr,
-		transportAddr: conf.TransportAddr,
-		transportClient: &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: conf.InsecureSkipVerify,
-				},
-			},
-		},
+		conns:            make(map[uint32]*Conn),
+		backends:         backends,
+		version:          conf.Version,
+		addr:             conf.Addr,
+		endpoints:        conf.Transports,
+		probeInterval:    conf.TransportProbeInterval,
+		rand:             newRand(),
+		compression:      conf.Compression,
+		handshakeTimeout: conf.HandshakeTimeout,
+		readTimeout:      conf.ReadTimeout,
+		writeTimeout:     conf.WriteTimeout,
+		connSlots:        semaphore.NewResizable(conf.MaxConns, conf.ConnQueueSize, conf.ConnQueueTimeout),
+		transportClient:  transportClient,
+		headers:          conf.Headers,
+		envelope:         envelope,
+		greetingBackend:  conf.GreetingBackend,
 	}, nil
 }
 
@@ -61,30 +110,39 @@ func (s *Server) ListenAndServe() (err error) {
 		return
 	}
 
+	go s.probeEndpoints()
+
 	return s.serve()
 }
 
+// Shutdown drains the server: it stops accepting, lets the running commands finish and ends the conns
+// between commands with ER_SERVER_SHUTDOWN. The conns in a transaction are waited for until ctx is done,
+// then they are ended too
 func (s *Server) Shutdown(ctx context.Context) error {
 	log.Infow("server shutdown...")
 
 	s.inShutdown.SetTrue()
 
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	lnerr := s.listener.Close()
 	s.closeDoneChanLocked()
+	s.mu.Unlock()
 
 	ticker := time.NewTicker(shutdownPollInterval)
 	defer ticker.Stop()
 	for {
+		// conns which were running a command or handshaking at the previous poll may be waiting by now
+		s.wakeConns(false)
+
 		if s.getConnNum() == 0 {
 			log.Infow("server shutdown with conn num = 0")
 			return lnerr
 		}
 		select {
 		case <-ctx.Done():
-			log.Infow("server shutdown with context done")
+			log.Infow("server shutdown with context done", "connNum", s.getConnNum())
+			s.drainExpired.SetTrue()
+			s.wakeConns(true)
 			return ctx.Err()
 		case <-ticker.C:
 		}
@@ -101,7 +159,7 @@ func (s *Server) closeDoneChanLocked() {
 }
 
 func (s *Server) serve() error {
-	log.Infow("server serve", "addr", s.addr, "version", s.version)
+	log.Infow("server serve", "addr", s.addr, "version", s.version, "transports", len(s.getEndpoints()))
 
 	var tempDelay time.Duration // how long to sleep on accept failure
 
@@ -133,8 +191,18 @@ func (s *Server) serve() error {
 		s.incrConnNum()
 		c := s.newConn(rw)
 		go func() {
+			defer s.decrConnNum()
+
+			// the client waits for the initial handshake while the connection is queued
+			if !s.connSlots.Acquire() {
+				log.Warnw("server too many connections", "conn", c.name())
+				c.writeError(mysql.NewError(mysql.ER_CON_COUNT_ERROR, "Too many connections"))
+				c.close()
+				return
+			}
+			defer s.connSlots.Release()
+
 			c.serve()
-			s.decrConnNum()
 		}()
 	}
 }
@@ -144,14 +212,19 @@ func (s *Server) shuttingDown() bool {
 }
 
 func (s *Server) newConn(rwc net.Conn) *Conn {
+	pkg := mysql.NewPacketIO(rwc)
+	pkg.SetTimeout(s.readTimeout, s.writeTimeout)
+
 	c := &Conn{
-		pkg:        mysql.NewPacketIO(rwc),
+		pkg:        pkg,
 		connId:     genConnId(),
 		salt:       mysql.RandomBuf(20),
 		server:     s,
 		rwc:        rwc,
 		remoteAddr: rwc.RemoteAddr().String(),
 		status:     mysql.SERVER_STATUS_AUTOCOMMIT,
+		backend:    DefaultBackend,
+		sessions:   make(map[string]*backendSession),
 	}
 
 	return c
@@ -170,6 +243,25 @@ func (s *Server) getDoneChanLocked() chan struct{} {
 	return s.doneChan
 }
 
+func (s *Server) addConn(c *Conn) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	s.conns[c.connId] = c
+}
+
+func (s *Server) delConn(connId uint32) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	delete(s.conns, connId)
+}
+
+func (s *Server) getConn(connId uint32) (*Conn, bool) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	c, exists := s.conns[connId]
+	return c, exists
+}
+
 func (s *Server) getConnNum() int64 {
 	return atomic.LoadInt64(&s.connNum)
 }
@@ -1,13 +1,18 @@
 package sidecar
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"net/url"
 	"strconv"
 
+	"github.com/Orlion/hersql/log"
+	"github.com/Orlion/hersql/mysql"
 	"github.com/Orlion/hersql/transport"
 )
 
@@ -15,11 +20,30 @@ func (c *Conn) transportConnect() error {
 	form := url.Values{}
 	form.Set("addr", c.dsn.Addr)
 	form.Set("dbname", c.dsn.DBName)
-	form.Set("user", c.dsn.User)
-	form.Set("passwd", c.dsn.Passwd)
+	// a credential referred to by name is resolved by the transport, the user and password are not sent
+	if credential := c.dsn.Params[CredentialParam]; credential != "" {
+		form.Set("credential", credential)
+	} else {
+		form.Set("user", c.dsn.User)
+		form.Set("passwd", c.dsn.Passwd)
+	}
 	form.Set("collation", strconv.FormatUint(uint64(c.collation), 10))
+	form.Set("capability", strconv.FormatUint(uint64(c.capability), 10))
+
+	// the session is pinned to the endpoint which created it, the runid and conn id are only known there
+	var (
+		body []byte
+		err  error
+	)
+	for _, endpoint := range c.server.pickEndpoints() {
+		c.endpoint = endpoint
+		if body, err = c.server.callTransport(endpoint, "/connect", form); err == nil {
+			break
+		}
 
-	body, err := c.callTransport("/connect", form)
+		log.Warnw("conn transportConnect endpoint error occurred", "conn", c.name(), "endpoint", endpoint.Addr, "error", err.Error())
+		c.server.setEndpointHealth(endpoint, err)
+	}
 	if err != nil {
 		return err
 	}
@@ -30,20 +54,58 @@ func (c *Conn) transportConnect() error {
 	}
 
 	if !response.Success {
-		return errors.New(response.Msg)
+		return response.Err()
 	}
 
 	c.transportRunid = response.Data.Runid
 	c.transportConnId = response.Data.ConnId
+	c.backendGreeting = &greeting{
+		version:    response.Data.ServerVersion,
+		capability: response.Data.ServerCapability,
+		collation:  response.Data.ServerCollation,
+	}
+
+	// the transport frames the relayed packets as the client negotiated, whatever the backend supports.
+	// Transports which do not report the framing relay the packets as framed by the backend
+	relayCapability := response.Data.RelayCapability
+	if relayCapability == 0 {
+		relayCapability = response.Data.Capability
+	}
+	if mismatch := (c.capability ^ relayCapability) & framingCapability; mismatch > 0 {
+		log.Warnw("conn transportConnect capability mismatch", "conn", c.name(), "capability", c.capability, "relayCapability", relayCapability)
+		return mysql.NewError(mysql.ER_HANDSHAKE_ERROR, fmt.Sprintf("the transport relays the packets of the backend %s without the capability flags %d negotiated by the client, please upgrade the transport", response.Data.ServerVersion, mismatch))
+	}
 
 	return nil
 }
 
-func (c *Conn) transportDisconnect() error {
+func (c *Conn) transportDisconnect(endpoint *TransportEndpoint, runid string, connId uint64) error {
+	form := url.Values{}
+	form.Set("runid", runid)
+	form.Set("connId", strconv.FormatUint(connId, 10))
+	body, err := c.server.callTransport(endpoint, "/disconnect", form)
+	if err != nil {
+		return err
+	}
+
+	response := new(transport.Response)
+	if err := json.Unmarshal(body, response); err != nil {
+		return fmt.Errorf("transport response body unmarshal error: %w", err)
+	}
+
+	if !response.Success {
+		return response.Err()
+	}
+
+	return nil
+}
+
+func (c *Conn) transportKill(killType string) error {
 	form := url.Values{}
 	form.Set("runid", c.transportRunid)
 	form.Set("connId", strconv.FormatUint(c.transportConnId, 10))
-	body, err := c.callTransport("/disconnect", form)
+	form.Set("type", killType)
+	body, err := c.server.callTransport(c.endpoint, "/kill", form)
 	if err != nil {
 		return err
 	}
@@ -54,7 +116,7 @@ func (c *Conn) transportDisconnect() error {
 	}
 
 	if !response.Success {
-		return errors.New(response.Msg)
+		return response.Err()
 	}
 
 	return nil
@@ -65,7 +127,7 @@ func (c *Conn) transport(data []byte) ([][]byte, error) {
 	form.Set("runid", c.transportRunid)
 	form.Set("connId", strconv.FormatUint(c.transportConnId, 10))
 	form.Set("packet", string(data))
-	body, err := c.callTransport("/transport", form)
+	body, err := c.server.callTransport(c.endpoint, "/transport", form)
 	if err != nil {
 		return nil, err
 	}
@@ -76,26 +138,127 @@ func (c *Conn) transport(data []byte) ([][]byte, error) {
 	}
 
 	if !response.Success {
-		return nil, errors.New(response.Msg)
+		return nil, response.Err()
 	}
 
 	return response.Data, nil
 }
 
-func (c *Conn) callTransport(path string, form url.Values) ([]byte, error) {
+// isTimeout reports whether the request to the transport timed out, the transport may still be running it
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (s *Server) callTransport(endpoint *TransportEndpoint, path string, form url.Values) ([]byte, error) {
 	var (
 		body []byte
 	)
-	resp, err := c.server.transportClient.PostForm(c.server.transportAddr+path, form)
+	req, sealed, err := s.newTransportRequest(endpoint, path, form)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.transportClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
 	defer resp.Body.Close()
-	body, err = io.ReadAll(resp.Body)
+
+	var reader io.Reader = resp.Body
+	// the transport encodes the responses with a coding the request accepts, the request bodies may use it from now on
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+		zr, err := transport.NewDecoder(encoding, resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("transport response body decode error: %w", err)
+		}
+		defer zr.Close()
+
+		reader = zr
+		endpoint.encoding.Store(encoding)
+	}
+
+	body, err = io.ReadAll(reader)
 	if err != nil {
 		return nil, err
 	}
 
+	if s.envelope != nil {
+		// only sealed responses are trusted, the transport rejects the request in plaintext before opening it
+		if resp.Header.Get("Content-Type") != transport.SealedContentType {
+			return nil, fmt.Errorf("the transport response is not sealed: %s", body)
+		}
+
+		if body, err = s.envelope.Open(transport.ResponseAAD(path, s.envelope.Nonce(sealed), form.Get("connId")), body); err != nil {
+			return nil, err
+		}
+
+		// the transport compresses the sealed responses before sealing them
+		if encoding := resp.Header.Get(transport.SealedEncodingHeader); encoding != "" {
+			if body, err = transport.Decompress(encoding, body); err != nil {
+				return nil, fmt.Errorf("transport response payload decode error: %w", err)
+			}
+			endpoint.encoding.Store(encoding)
+		}
+	}
+
 	return body, nil
 }
+
+// acceptEncoding returns the Accept-Encoding of the requests, the configured coding is preferred and gzip is
+// accepted from the transports which do not support it
+func acceptEncoding(compression string) string {
+	if compression == CompressionGzip {
+		return CompressionGzip
+	}
+
+	return compression + ", " + CompressionGzip
+}
+
+// newTransportRequest returns the request posting the form to the transport, and the sealed body if the form is sealed
+func (s *Server) newTransportRequest(endpoint *TransportEndpoint, path string, form url.Values) (*http.Request, []byte, error) {
+	body := []byte(form.Encode())
+	compressed := false
+	var sealed []byte
+
+	// request bodies are only compressed once the transport encoded a response, sealed ones before they are sealed
+	encoding := endpoint.requestEncoding()
+	if s.compression != "" && encoding != "" && len(body) >= compressMinSize {
+		var err error
+		if body, err = transport.Compress(encoding, body); err != nil {
+			return nil, nil, err
+		}
+		compressed = true
+	}
+
+	if s.envelope != nil {
+		var err error
+		if sealed, err = s.envelope.Seal(path, body); err != nil {
+			return nil, nil, err
+		}
+		body = sealed
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint.Addr+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.setHeaders(req)
+	if sealed != nil {
+		req.Header.Set("Content-Type", transport.SealedContentType)
+	} else {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if compressed && sealed != nil {
+		req.Header.Set(transport.SealedEncodingHeader, encoding)
+	} else if compressed {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	if s.compression != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding(s.compression))
+	}
+
+	return req, sealed, nil
+}
@@ -0,0 +1,129 @@
+package sidecar
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Orlion/hersql/transport"
+)
+
+func TestTransportTimeout(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.FormValue("packet") {
+		case "\x03SELECT SLEEP(10)":
+			<-release
+		case "\x03SELECT x":
+			json.NewEncoder(w).Encode(&transport.Response{Code: 1054, Msg: "Unknown column 'x' in 'field list'"})
+			return
+		}
+		json.NewEncoder(w).Encode(&transport.TransportResponse{Response: transport.Response{Success: true}, Data: [][]byte{}})
+	}))
+	t.Cleanup(ts.Close)
+	t.Cleanup(func() { close(release) })
+
+	s, err := NewServer(&Config{TransportAddr: ts.URL, TransportTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := s.getEndpoints()[0]
+
+	tests := []struct {
+		name        string
+		query       string
+		wantErr     bool
+		wantTimeout bool
+	}{
+		{"answered", "SELECT 1", false, false},
+		{"failed", "SELECT x", true, false},
+		// the command may still run on the transport, the session has to end
+		{"timed out", "SELECT SLEEP(10)", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conn{server: s, endpoint: endpoint, transportRunid: "1", transportConnId: 1}
+
+			_, err := c.transport(append([]byte{0x03}, tt.query...))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("transport() error = %v, want error %v", err, tt.wantErr)
+			}
+
+			if got := isTimeout(err); got != tt.wantTimeout {
+				t.Errorf("isTimeout(%v) = %v, want %v", err, got, tt.wantTimeout)
+			}
+		})
+	}
+}
+
+func TestNewTransportRequestSealed(t *testing.T) {
+	const key = "MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE="
+
+	tests := []struct {
+		name   string
+		packet string
+		// the coding the transport encoded a response with
+		encoding string
+		want     string
+	}{
+		{"compressed before sealing", strings.Repeat("SELECT 1;", compressMinSize), CompressionZstd, CompressionZstd},
+		{"short", "SELECT 1", CompressionZstd, ""},
+		{"no response encoded yet", strings.Repeat("SELECT 1;", compressMinSize), "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewServer(&Config{TransportAddr: "http://127.0.0.1:1", EncryptionKey: key, Compression: CompressionZstd})
+			if err != nil {
+				t.Fatal(err)
+			}
+			endpoint := s.getEndpoints()[0]
+			if tt.encoding != "" {
+				endpoint.encoding.Store(tt.encoding)
+			}
+
+			form := url.Values{"connId": {"1"}, "packet": {tt.packet}}
+			req, _, err := s.newTransportRequest(endpoint, "/transport", form)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the sealed bytes do not compress, the proxies in between must not see a Content-Encoding of them
+			if ce := req.Header.Get("Content-Encoding"); ce != "" {
+				t.Errorf("Content-Encoding = %q of a sealed body", ce)
+			}
+			encoding := req.Header.Get(transport.SealedEncodingHeader)
+			if encoding != tt.want {
+				t.Fatalf("%s = %q, want %q", transport.SealedEncodingHeader, encoding, tt.want)
+			}
+
+			envelope, err := transport.NewEnvelope(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sealed, err := io.ReadAll(req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := envelope.Open("/transport", sealed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encoding != "" {
+				if body, err = transport.Decompress(encoding, body); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if string(body) != form.Encode() {
+				t.Errorf("opened body of %d bytes, want the form of %d bytes", len(body), len(form.Encode()))
+			}
+		})
+	}
+}
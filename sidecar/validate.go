@@ -0,0 +1,157 @@
+package sidecar
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+
+	"github.com/Orlion/hersql/transport"
+	mysql_driver "github.com/go-sql-driver/mysql"
+)
+
+// Validate returns all the problems of the configuration instead of the first one, the configuration is not changed
+func (conf *Config) Validate() []error {
+	var problems []error
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	if conf.Addr != "" {
+		if _, _, err := net.SplitHostPort(conf.Addr); err != nil {
+			problem("addr %s is not a host:port address: %w", conf.Addr, err)
+		}
+	}
+
+	if conf.TransportAddr == "" && len(conf.Transports) == 0 {
+		problem("transport_addr or transports configuration cannot be empty")
+	}
+
+	if conf.TransportAddr != "" {
+		if err := validateTransportURL(conf.TransportAddr); err != nil {
+			problem("transport_addr %w", err)
+		}
+	}
+
+	for i, endpoint := range conf.Transports {
+		if endpoint == nil || endpoint.Addr == "" {
+			problem("transports[%d] addr cannot be empty", i)
+			continue
+		}
+		if err := validateTransportURL(endpoint.Addr); err != nil {
+			problem("transports[%d] addr %w", i, err)
+		}
+		if endpoint.Weight < 0 {
+			problem("transport %s weight cannot be negative", endpoint.Addr)
+		}
+	}
+
+	switch conf.Compression {
+	case "", CompressionGzip, CompressionZstd:
+	default:
+		problem("compression %s is not supported, please use %s or %s", conf.Compression, CompressionGzip, CompressionZstd)
+	}
+
+	if conf.Proxy != "" {
+		if _, err := transportProxy(conf.Proxy); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	if (conf.CertFile == "") != (conf.KeyFile == "") {
+		problem("cert_file and key_file must be configured together")
+	}
+
+	for _, file := range []struct{ key, path string }{{"ca_file", conf.CAFile}, {"cert_file", conf.CertFile}, {"key_file", conf.KeyFile}} {
+		if file.path == "" {
+			continue
+		}
+		if _, err := os.Stat(file.path); err != nil {
+			problem("%s %w", file.key, err)
+		}
+	}
+
+	if conf.EncryptionKey != "" {
+		if _, err := transport.NewEnvelope(conf.EncryptionKey); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	durations := []struct {
+		key   string
+		value int64
+	}{
+		{"transport_probe_interval", int64(conf.TransportProbeInterval)},
+		{"dial_timeout", int64(conf.DialTimeout)},
+		{"handshake_timeout", int64(conf.HandshakeTimeout)},
+		{"read_timeout", int64(conf.ReadTimeout)},
+		{"write_timeout", int64(conf.WriteTimeout)},
+		{"transport_timeout", int64(conf.TransportTimeout)},
+		{"drain_timeout", int64(conf.DrainTimeout)},
+		{"conn_queue_timeout", int64(conf.ConnQueueTimeout)},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			problem("%s cannot be negative", d.key)
+		}
+	}
+
+	if conf.MaxConns < 0 {
+		problem("max_conns cannot be negative")
+	}
+
+	if conf.ConnQueueSize < 0 {
+		problem("conn_queue_size cannot be negative")
+	}
+
+	names := make(map[string]bool, len(conf.Backends))
+	for i, backend := range conf.Backends {
+		if backend == nil || backend.Name == "" {
+			problem("backends[%d] name cannot be empty", i)
+			continue
+		}
+		if backend.Name == DefaultBackend {
+			problem("backend name %s is reserved", DefaultBackend)
+		}
+		if names[backend.Name] {
+			problem("backend name %s is duplicated", backend.Name)
+		}
+		names[backend.Name] = true
+
+		dsn, err := mysql_driver.ParseDSN(backend.DSN)
+		if err != nil {
+			problem("backend %s dsn parse error: %w", backend.Name, err)
+			continue
+		}
+		if dsn.Net == "tcp" {
+			if _, _, err := net.SplitHostPort(dsn.Addr); err != nil {
+				problem("backend %s dsn address %s is not a host:port address: %w", backend.Name, dsn.Addr, err)
+			}
+		}
+	}
+
+	if conf.GreetingBackend != "" && !names[conf.GreetingBackend] {
+		problem("greeting_backend %s is not one of the backends", conf.GreetingBackend)
+	}
+
+	return problems
+}
+
+// validateTransportURL checks that the address of a transport is an http or https url
+func validateTransportURL(addr string) error {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return fmt.Errorf("%s parse error: %w", addr, err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%s must be an url with the http or https scheme, e.g. http://127.0.0.1:8080", addr)
+	}
+
+	if u.Host == "" {
+		return errors.New(addr + " has no host")
+	}
+
+	return nil
+}
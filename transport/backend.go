@@ -0,0 +1,144 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the balance methods of the replicas
+const (
+	BalanceRoundRobin   = "round_robin"
+	BalanceLeastLatency = "least_latency"
+)
+
+// Backend names a primary and its replicas, sidecars connect to it by giving its name as the address.
+// Reads outside of transactions are routed to the replicas, everything else to the primary
+type Backend struct {
+	Name    string `yaml:"name"`
+	Primary string `yaml:"primary"`
+	// the addresses new sessions are opened on in order when the primary is unhealthy
+	Fallbacks []string `yaml:"fallbacks"`
+	Replicas  []string `yaml:"replicas"`
+	// round_robin or least_latency
+	Balance string `yaml:"balance"`
+	// the credential of the sessions whose sidecar refers to no credential
+	Credential string `yaml:"credential"`
+
+	next uint64
+	mu   sync.Mutex
+	// the moving average of the read latency of the replicas
+	latencies map[string]time.Duration
+	// the state of the addresses reported by the health checks
+	health map[string]*addrHealth
+}
+
+func (b *Backend) init() error {
+	if b.Name == "" {
+		return fmt.Errorf("backend name cannot be empty")
+	}
+
+	if b.Primary == "" {
+		return fmt.Errorf("backend %s primary cannot be empty", b.Name)
+	}
+
+	switch b.Balance {
+	case "":
+		b.Balance = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastLatency:
+	default:
+		return fmt.Errorf("backend %s balance %s is not supported, please use %s or %s", b.Name, b.Balance, BalanceRoundRobin, BalanceLeastLatency)
+	}
+
+	b.latencies = make(map[string]time.Duration, len(b.Replicas))
+	b.health = make(map[string]*addrHealth)
+
+	return nil
+}
+
+// pickPrimary returns the address new sessions are opened on, the primary or the first healthy fallback.
+// The primary is tried anyway if no address is healthy
+func (b *Backend) pickPrimary() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.healthyLocked(b.Primary) {
+		return b.Primary
+	}
+
+	for _, addr := range b.Fallbacks {
+		if b.healthyLocked(addr) {
+			return addr
+		}
+	}
+
+	return b.Primary
+}
+
+// pickReplica returns the address of the healthy replica the next read is routed to, empty if none is healthy
+func (b *Backend) pickReplica() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.Balance == BalanceLeastLatency {
+		// replicas without a measured latency are tried first
+		var (
+			picked  string
+			latency time.Duration = -1
+		)
+		for _, addr := range b.Replicas {
+			if !b.healthyLocked(addr) {
+				continue
+			}
+			if l := b.latencies[addr]; latency < 0 || l < latency {
+				picked, latency = addr, l
+			}
+		}
+
+		return picked
+	}
+
+	for range b.Replicas {
+		n := atomic.AddUint64(&b.next, 1)
+		if addr := b.Replicas[n%uint64(len(b.Replicas))]; b.healthyLocked(addr) {
+			return addr
+		}
+	}
+
+	return ""
+}
+
+// observe records the latency of a read routed to the replica
+func (b *Backend) observe(addr string, latency time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if prev, exists := b.latencies[addr]; exists {
+		latency = (prev*7 + latency) / 8
+	}
+	b.latencies[addr] = latency
+}
+
+// getBackend returns the backend named by the address, the name may carry the port the mysql driver
+// appends to addresses without one, nil if the address does not name a backend
+func (s *Server) getBackend(addr string) *Backend {
+	backends := s.getBackends()
+	if backend, exists := backends[addr]; exists {
+		return backend
+	}
+
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return backends[host]
+	}
+
+	return nil
+}
+
+// getBackends returns the backends by name, the map is replaced rather than modified when the configuration is reloaded
+func (s *Server) getBackends() map[string]*Backend {
+	s.confMu.RLock()
+	defer s.confMu.RUnlock()
+	return s.backends
+}
@@ -0,0 +1,200 @@
+package transport
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// the content codings of the tunnel payloads
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// encodings are the content codings the transport supports, in the order it prefers them
+var encodings = []string{EncodingZstd, EncodingGzip}
+
+// responses shorter than this are not worth compressing
+const compressMinSize = 1024
+
+// zstd encoders are costly to create, they are reset for every payload
+var zstdEncoders = sync.Pool{
+	New: func() interface{} {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return enc
+	},
+}
+
+// NewEncoder returns a writer encoding the payload written to w with the content coding
+func NewEncoder(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case EncodingGzip:
+		return gzip.NewWriter(w), nil
+	case EncodingZstd:
+		enc := zstdEncoders.Get().(*zstd.Encoder)
+		enc.Reset(w)
+		return &zstdWriter{enc}, nil
+	default:
+		return nil, fmt.Errorf("content coding %s is not supported", encoding)
+	}
+}
+
+// zstdWriter returns the encoder to the pool once the payload is written
+type zstdWriter struct {
+	*zstd.Encoder
+}
+
+func (w *zstdWriter) Close() error {
+	err := w.Encoder.Close()
+	zstdEncoders.Put(w.Encoder)
+	return err
+}
+
+// NewDecoder returns a reader decoding the payload read from r with the content coding
+func NewDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case EncodingGzip:
+		return gzip.NewReader(r)
+	case EncodingZstd:
+		dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("content coding %s is not supported", encoding)
+	}
+}
+
+// Compress returns the payload encoded with the content coding
+func Compress(encoding string, payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := NewEncoder(encoding, &buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := zw.Write(payload); err != nil {
+		zw.Close()
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decompress returns the payload decoded with the content coding
+func Decompress(encoding string, payload []byte) ([]byte, error) {
+	zr, err := NewDecoder(encoding, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	return io.ReadAll(zr)
+}
+
+// acceptedEncoding returns the first content coding of the Accept-Encoding header which the transport supports,
+// empty if none. Codings refused with q=0 are skipped, the other weights are not ranked
+func acceptedEncoding(header string) string {
+	for _, coding := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			if q, err := strconv.ParseFloat(params[2:], 64); err == nil && q == 0 {
+				continue
+			}
+		}
+
+		for _, encoding := range encodings {
+			if name == encoding {
+				return encoding
+			}
+		}
+	}
+
+	return ""
+}
+
+// withCompression decodes the request bodies by their Content-Encoding and encodes the responses
+// with the first content coding of the Accept-Encoding of the request the transport supports.
+// The sidecars learn from the Content-Encoding of the responses which coding their request bodies may use
+func withCompression(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if encoding := r.Header.Get("Content-Encoding"); encoding != "" {
+			zr, err := NewDecoder(encoding, r.Body)
+			if err != nil {
+				responseFail(w, "the request body can not be decoded: "+err.Error())
+				return
+			}
+			defer zr.Close()
+
+			r.Body = zr
+			r.Header.Del("Content-Encoding")
+			r.ContentLength = -1
+		}
+
+		encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressResponseWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressResponseWriter decides whether to compress on the first write,
+// the responses of the transport are written in one piece
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding string
+	zw       io.WriteCloser
+	decided  bool
+}
+
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.decided = true
+		// sealed payloads do not compress, they are compressed before they are sealed
+		if len(b) >= compressMinSize && w.Header().Get("Content-Type") != SealedContentType {
+			zw, err := NewEncoder(w.encoding, w.ResponseWriter)
+			if err != nil {
+				return 0, err
+			}
+			w.Header().Set("Content-Encoding", w.encoding)
+			w.Header().Del("Content-Length")
+			w.zw = zw
+		}
+	}
+
+	if w.zw != nil {
+		return w.zw.Write(b)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressResponseWriter) Close() error {
+	if w.zw != nil {
+		return w.zw.Close()
+	}
+
+	return nil
+}
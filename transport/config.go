@@ -1,13 +1,134 @@
 package transport
 
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// the actions taken when a resultset exceeds the result limits
+const (
+	ResultLimitError    = "error"
+	ResultLimitTruncate = "truncate"
+)
+
 type Config struct {
 	Addr string `yaml:"addr"`
+	// serve https, and authenticate the sidecars by their client certificates
+	TLS *TLSConfig `yaml:"tls"`
+	// base64 encoded 32 byte key sealing the payloads of the tunnel, the sidecars must share it
+	EncryptionKey string `yaml:"encryption_key"`
+	// yaml map of credential names to users and passwords, the sidecars refer to credentials by name
+	// instead of sending them. Credentials not in the file are looked up in the environment
+	CredentialsFile string `yaml:"credentials_file"`
+	// providers the passwords of the credentials are resolved from, see SecretProvider
+	SecretProviders []*SecretProviderConfig `yaml:"secret_providers"`
+	// reject sessions whose user and password are sent by the sidecar instead of referred to by name
+	DenyInlineCredentials bool `yaml:"deny_inline_credentials"`
+	// token of the tooling, requests carrying it list every session and kill the sessions of any sidecar.
+	// Without it the sessions are only listed to the sidecars authenticated by their client certificates
+	AdminToken string `yaml:"admin_token"`
+	// timeouts of the connections to the backend mysql servers, zero means no timeout
+	DialTimeout      time.Duration `yaml:"dial_timeout"`
+	HandshakeTimeout time.Duration `yaml:"handshake_timeout"`
+	ReadTimeout      time.Duration `yaml:"read_timeout"`
+	WriteTimeout     time.Duration `yaml:"write_timeout"`
+	// queries running longer than this are killed, zero means no limit
+	MaxExecutionTime time.Duration `yaml:"max_execution_time"`
+	// how long a shutdown waits for the running commands and the open transactions, defaults to 30s
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+	// unix socket a new transport process started with the same configuration takes the listener and the sessions
+	// over from, so the sessions survive an upgrade. Empty disables the handoff
+	HandoffSocket string `yaml:"handoff_socket"`
+	// limits of a single resultset relayed to the client, zero means no limit
+	MaxResultRows  int `yaml:"max_result_rows"`
+	MaxResultBytes int `yaml:"max_result_bytes"`
+	// error returns an error to the client, truncate returns the rows within the limits
+	ResultLimitAction string `yaml:"result_limit_action"`
+	// masking rules of the values relayed to the client, the first rule matching a column applies
+	Masking []*MaskingRule `yaml:"masking"`
+	// key of the hmac-sha256 the hash masking method replaces the values with, required by the rules of the method
+	MaskingKey string `yaml:"masking_key"`
+	// <provider name>:<key> of the masking key in a secret provider, it takes precedence over masking_key
+	MaskingKeySecret string `yaml:"masking_key_secret"`
+	// caps of the sessions in total and per backend address, zero means no limit
+	MaxSessions           int `yaml:"max_sessions"`
+	MaxSessionsPerBackend int `yaml:"max_sessions_per_backend"`
+	// connects beyond the caps wait in a queue of this size for at most session_queue_timeout,
+	// connects which find the queue full or time out receive ER_CON_COUNT_ERROR
+	SessionQueueSize    int           `yaml:"session_queue_size"`
+	SessionQueueTimeout time.Duration `yaml:"session_queue_timeout"`
+	// named backends the sidecars may connect to instead of an address
+	Backends []*Backend `yaml:"backends"`
+	// health checks of the addresses of the backends
+	HealthCheck *HealthCheck `yaml:"health_check"`
+	// quotas of the sidecar identities, the first quota matching an identity applies
+	Quotas []*Quota `yaml:"quotas"`
+	// statement policies, the first one matching the backend address and user of a session applies
+	Policies []*Policy `yaml:"policies"`
 }
 
 func withDefaultConf(conf *Config) error {
+	if conf == nil {
+		return errors.New("server configuration cannot be empty")
+	}
+
 	if conf.Addr == "" {
 		conf.Addr = ":8080"
 	}
 
+	if conf.DrainTimeout == 0 {
+		conf.DrainTimeout = 30 * time.Second
+	}
+
+	if conf.DialTimeout == 0 {
+		conf.DialTimeout = 10 * time.Second
+	}
+
+	if conf.HandshakeTimeout == 0 {
+		conf.HandshakeTimeout = 10 * time.Second
+	}
+
+	if conf.SessionQueueSize < 0 {
+		return errors.New("session_queue_size cannot be negative")
+	}
+
+	names := make(map[string]bool, len(conf.Backends))
+	for _, backend := range conf.Backends {
+		if err := backend.init(); err != nil {
+			return err
+		}
+		if names[backend.Name] {
+			return fmt.Errorf("backend name %s is duplicated", backend.Name)
+		}
+		names[backend.Name] = true
+	}
+
+	if conf.TLS != nil {
+		if err := conf.TLS.init(); err != nil {
+			return err
+		}
+	}
+
+	if conf.HealthCheck != nil {
+		if err := conf.HealthCheck.init(); err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range conf.Masking {
+		if err := rule.init(); err != nil {
+			return err
+		}
+	}
+
+	switch conf.ResultLimitAction {
+	case "":
+		conf.ResultLimitAction = ResultLimitError
+	case ResultLimitError, ResultLimitTruncate:
+	default:
+		return fmt.Errorf("result_limit_action %s is not supported, please use %s or %s", conf.ResultLimitAction, ResultLimitError, ResultLimitTruncate)
+	}
+
 	return nil
 }
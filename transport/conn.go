@@ -9,28 +9,78 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Orlion/hersql/log"
 	"github.com/Orlion/hersql/mysql"
+	"github.com/Orlion/hersql/pkg/atomicx"
 )
 
+// the kill types of the /kill api
+const (
+	KillQuery      = "query"
+	KillConnection = "connection"
+)
+
+// relayCapability is the set of client capability flags the transport is able to relay to the backend
+var relayCapability uint32 = mysql.CLIENT_LONG_PASSWORD | mysql.CLIENT_FOUND_ROWS | mysql.CLIENT_LONG_FLAG |
+	mysql.CLIENT_NO_SCHEMA | mysql.CLIENT_COMPRESS | mysql.CLIENT_ODBC | mysql.CLIENT_IGNORE_SPACE | mysql.CLIENT_PROTOCOL_41 |
+	mysql.CLIENT_INTERACTIVE | mysql.CLIENT_IGNORE_SIGPIPE | mysql.CLIENT_TRANSACTIONS |
+	mysql.CLIENT_SECURE_CONNECTION | mysql.CLIENT_MULTI_STATEMENTS | mysql.CLIENT_MULTI_RESULTS |
+	mysql.CLIENT_PS_MULTI_RESULTS | mysql.CLIENT_PLUGIN_AUTH | mysql.CLIENT_SESSION_TRACK |
+	mysql.CLIENT_DEPRECATE_EOF
+
+// framingCapability are the flags changing the framing of the packets relayed to the client. The sidecar negotiates
+// them with its client before it knows the backend, the packets of backends not supporting them are converted
+var framingCapability uint32 = mysql.CLIENT_SESSION_TRACK | mysql.CLIENT_DEPRECATE_EOF
+
 type Conn struct {
-	id         uint64
-	rwc        net.Conn
-	createAt   time.Time
-	server     *Server
-	pkg        *mysql.PacketIO
-	capability uint32
-	collation  uint8
-	status     uint16
-	user       string
-	passwd     string
-	dbname     string
+	id               uint64
+	rwc              net.Conn
+	createAt         time.Time
+	server           *Server
+	pkg              *mysql.PacketIO
+	addr             string
+	threadId         uint32
+	serverVersion    string
+	serverCapability uint32
+	serverCollation  uint8
+	clientCapability uint32
+	capability       uint32
+	collation        uint8
+	status           uint16
+	user             string
+	passwd           string
+	dbname           string
+	// the policy of the session, it changes when the configuration is reloaded
+	policy atomic.Pointer[Policy]
+	// the identity of the sidecar which created the conn
+	identity string
+	// serializes the commands of the session, a sidecar which gave up waiting for a command may send the next one
+	// while it still runs, and the two would interleave on the backend connection
+	commandMu sync.Mutex
+	// the sequence number of the command being executed, zero if idle
+	runningCommand uint64
+	commandSeq     uint64
+	inTransaction  atomicx.Bool
+	// the backend named by the sidecar, nil if the sidecar connected to an address
+	backend *Backend
+	// connections to the replicas of the backend by address and the one running the current command
+	replicasMu sync.Mutex
+	replicas   map[string]*replicaConn
+	routed     *Conn
+	// the SET and USE statements replayed on the replicas, reads stay on the primary once there are too many of them
+	sessionStatements []sessionStatement
+	primaryOnly       bool
+	// whether the password is held in the log redaction for the life of the session, it is released once closed
+	holdsSecret   bool
+	releaseSecret sync.Once
 }
 
 func (c *Conn) name() string {
-	return fmt.Sprintf("id: %d, createAt: %s, capability: %d, collation: %d, status: %d, user: %s, dbname: %s", c.id, c.createAt.Format("2006-01-02 15:04:05"), c.capability, c.collation, c.status, c.user, c.dbname)
+	return fmt.Sprintf("id: %d, createAt: %s, threadId: %d, serverVersion: %s, capability: %d, collation: %d, status: %d, user: %s, dbname: %s", c.id, c.createAt.Format("2006-01-02 15:04:05"), c.threadId, c.serverVersion, c.capability, c.collation, c.status, c.user, c.dbname)
 }
 
 func (c *Conn) handshake() error {
@@ -44,7 +94,7 @@ func (c *Conn) handshake() error {
 		return fmt.Errorf("auth error: %w", err)
 	}
 
-	log.Debugw("conn handshake readInitialHandshake", "authData", authData, "plugin", plugin, "authResp", authResp, "connId", c.id)
+	log.Debugw("conn handshake readInitialHandshake", "plugin", plugin, "connId", c.id)
 
 	if err := c.writeHandshakeResponse(authResp, plugin); err != nil {
 		return fmt.Errorf("writeHandshakeResponse error: %w", err)
@@ -55,7 +105,11 @@ func (c *Conn) handshake() error {
 		return fmt.Errorf("handleAuthResult error: %w", err)
 	}
 
-	c.pkg.Sequence = 0
+	c.pkg.ResetSequence()
+
+	if c.capability&mysql.CLIENT_COMPRESS > 0 {
+		c.pkg.EnableCompression()
+	}
 
 	return nil
 }
@@ -74,10 +128,14 @@ func (c *Conn) readInitialHandshake() (authData []byte, plugin string, err error
 		return nil, "", fmt.Errorf("invalid protocol version %d, must >= 10", data[0])
 	}
 
-	//skip mysql version and connection id
 	//mysql version end with 0x00
+	pos := 1 + bytes.IndexByte(data[1:], 0x00)
+	c.serverVersion = string(data[1:pos])
+
 	//connection id length is 4
-	pos := 1 + bytes.IndexByte(data[1:], 0x00) + 1 + 4
+	pos += 1
+	c.threadId = binary.LittleEndian.Uint32(data[pos : pos+4])
+	pos += 4
 
 	authData = data[pos : pos+8]
 
@@ -85,19 +143,19 @@ func (c *Conn) readInitialHandshake() (authData []byte, plugin string, err error
 	pos += 8 + 1
 
 	//capability lower 2 bytes
-	c.capability = uint32(binary.LittleEndian.Uint16(data[pos : pos+2]))
+	c.serverCapability = uint32(binary.LittleEndian.Uint16(data[pos : pos+2]))
 
 	pos += 2
 
 	if len(data) > pos {
-		//skip exit charset
-		//c.charset = data[pos]
+		//default collation of the server
+		c.serverCollation = data[pos]
 		pos += 1
 
 		c.status = binary.LittleEndian.Uint16(data[pos : pos+2])
 		pos += 2
 
-		c.capability = uint32(binary.LittleEndian.Uint16(data[pos:pos+2]))<<16 | c.capability
+		c.serverCapability = uint32(binary.LittleEndian.Uint16(data[pos:pos+2]))<<16 | c.serverCapability
 
 		pos += 2
 
@@ -142,7 +200,10 @@ func (c *Conn) writeHandshakeResponse(authResp []byte, plugin string) error {
 		mysql.CLIENT_LONG_PASSWORD |
 		mysql.CLIENT_TRANSACTIONS |
 		mysql.CLIENT_PLUGIN_AUTH |
-		c.capability&mysql.CLIENT_LONG_FLAG
+		c.serverCapability&mysql.CLIENT_LONG_FLAG
+
+	// Mirror the client's capability flags as far as both the backend and the transport support them
+	capability |= c.clientCapability & c.serverCapability & relayCapability
 
 	// encode length of the auth plugin data
 	var authRespLEIBuf [9]byte
@@ -206,6 +267,9 @@ func (c *Conn) writeHandshakeResponse(authResp []byte, plugin string) error {
 	data[pos] = 0x00
 	pos++
 
+	// From now on the packets are parsed with the negotiated capability flags
+	c.capability = capability
+
 	return c.writePacket(data)
 }
 
@@ -380,12 +444,72 @@ func (c *Conn) handleOKPacket(data []byte) (*mysql.Result, error) {
 		r.Status = binary.LittleEndian.Uint16(data[pos:])
 		c.status = r.Status
 		pos += 2
+
+		r.Warnings = binary.LittleEndian.Uint16(data[pos:])
+		pos += 2
 	} else if c.capability&mysql.CLIENT_TRANSACTIONS > 0 {
 		r.Status = binary.LittleEndian.Uint16(data[pos:])
 		c.status = r.Status
 		pos += 2
 	}
 
+	if c.capability&mysql.CLIENT_SESSION_TRACK == 0 {
+		r.Info = string(data[pos:])
+		return r, nil
+	}
+
+	if pos >= len(data) {
+		return r, nil
+	}
+
+	info, _, n, err := mysql.LengthEncodedString(data[pos:])
+	if err != nil {
+		return nil, ErrMalformPkt
+	}
+	r.Info = string(info)
+	pos += n
+
+	if r.Status&mysql.SERVER_SESSION_STATE_CHANGED > 0 && pos < len(data) {
+		state, _, _, err := mysql.LengthEncodedString(data[pos:])
+		if err != nil {
+			return nil, ErrMalformPkt
+		}
+
+		if r.SessionStateChanges, err = mysql.ParseSessionStateChanges(state); err != nil {
+			return nil, err
+		}
+
+		c.applySessionStateChanges(r.SessionStateChanges)
+	}
+
+	return r, nil
+}
+
+func (c *Conn) applySessionStateChanges(changes []mysql.SessionStateChange) {
+	for _, change := range changes {
+		switch change.Type {
+		case mysql.SESSION_TRACK_SCHEMA:
+			if schema, _, _, err := mysql.LengthEncodedString(change.Data); err == nil {
+				c.dbname = string(schema)
+			}
+		}
+	}
+}
+
+func (c *Conn) handleEOFPacket(data []byte) (*mysql.Result, error) {
+	// with CLIENT_DEPRECATE_EOF the EOF packet is replaced by an OK packet with the 0xFE header
+	if c.capability&mysql.CLIENT_DEPRECATE_EOF > 0 {
+		return c.handleOKPacket(data)
+	}
+
+	r := new(mysql.Result)
+
+	if c.capability&mysql.CLIENT_PROTOCOL_41 > 0 && len(data) >= 5 {
+		r.Warnings = binary.LittleEndian.Uint16(data[1:])
+		r.Status = binary.LittleEndian.Uint16(data[3:])
+		c.status = r.Status
+	}
+
 	return r, nil
 }
 
@@ -409,6 +533,115 @@ func (c *Conn) handleErrorPacket(data []byte) error {
 	return e
 }
 
+// exec executes a statement returning no resultset
+func (c *Conn) exec(query string) error {
+	c.pkg.ResetSequence()
+
+	data := make([]byte, 4, 5+len(query))
+	data = append(data, mysql.COM_QUERY)
+	data = append(data, query...)
+	if err := c.writePacket(data); err != nil {
+		return err
+	}
+
+	_, err := c.readOK()
+	return err
+}
+
+// noBackslashEscapes reports whether the session runs with the NO_BACKSLASH_ESCAPES sql mode, as the backend
+// announced in the status flags of its last response
+func (c *Conn) noBackslashEscapes() bool {
+	return c.status&mysql.SERVER_STATUS_NO_BACKSLASH_ESCAPED > 0
+}
+
+// relayedCapability returns the capability flags the packets relayed to the client are framed by, the framing flags
+// are those the client negotiated. Sidecars which do not send the client capability get the framing of the backend
+func (c *Conn) relayedCapability() uint32 {
+	if c.clientCapability == 0 {
+		return c.capability
+	}
+
+	return c.capability&^framingCapability | c.clientCapability&framingCapability
+}
+
+// missingFraming returns the framing flags the client negotiated and the backend does not support
+func (c *Conn) missingFraming() uint32 {
+	return c.relayedCapability() &^ c.capability
+}
+
+// relayOKPacket returns the OK packet of the backend framed for the client
+func (c *Conn) relayOKPacket(packet []byte, r *mysql.Result) []byte {
+	if c.missingFraming()&mysql.CLIENT_SESSION_TRACK == 0 {
+		return packet
+	}
+
+	data := make([]byte, 0, 16+len(r.Info))
+
+	data = append(data, mysql.OK_HEADER)
+	data = append(data, mysql.PutLengthEncodedInt(r.AffectedRows)...)
+	data = append(data, mysql.PutLengthEncodedInt(r.InsertId)...)
+	data = append(data, byte(r.Status), byte(r.Status>>8))
+	data = append(data, byte(r.Warnings), byte(r.Warnings>>8))
+	// the info is a length encoded string with CLIENT_SESSION_TRACK, the backend tracked no session state
+	data = mysql.AppendLengthEncodedInteger(data, uint64(len(r.Info)))
+	data = append(data, r.Info...)
+
+	return data
+}
+
+// relayEOFPacket returns the packet of the backend terminating a resultset framed for the client
+func (c *Conn) relayEOFPacket(packet []byte, r *mysql.Result) []byte {
+	if c.missingFraming() == 0 || c.relayedCapability()&mysql.CLIENT_DEPRECATE_EOF == 0 {
+		return packet
+	}
+
+	return c.eofPacket(r.Status, r.Warnings)
+}
+
+// eofPacket builds the payload of the packet terminating a resultset to be relayed to the client
+func (c *Conn) eofPacket(status, warnings uint16) []byte {
+	data := make([]byte, 0, 16)
+
+	data = append(data, mysql.EOF_HEADER)
+
+	capability := c.relayedCapability()
+
+	// an OK packet with the 0xFE header if CLIENT_DEPRECATE_EOF is set
+	if capability&mysql.CLIENT_DEPRECATE_EOF > 0 {
+		data = append(data, 0, 0)
+		data = append(data, byte(status), byte(status>>8))
+		data = append(data, byte(warnings), byte(warnings>>8))
+		if capability&mysql.CLIENT_SESSION_TRACK > 0 {
+			data = append(data, 0)
+		}
+		return data
+	}
+
+	if capability&mysql.CLIENT_PROTOCOL_41 > 0 {
+		data = append(data, byte(warnings), byte(warnings>>8))
+		data = append(data, byte(status), byte(status>>8))
+	}
+
+	return data
+}
+
+// errorPacket builds the payload of an ERR packet to be relayed to the client
+func (c *Conn) errorPacket(e *mysql.SqlError) []byte {
+	data := make([]byte, 0, 16+len(e.Message))
+
+	data = append(data, mysql.ERR_HEADER)
+	data = append(data, byte(e.Code), byte(e.Code>>8))
+
+	if c.capability&mysql.CLIENT_PROTOCOL_41 > 0 {
+		data = append(data, '#')
+		data = append(data, e.State...)
+	}
+
+	data = append(data, e.Message...)
+
+	return data
+}
+
 func (c *Conn) readPacket() ([]byte, error) {
 	return c.pkg.ReadPacket()
 }
@@ -418,5 +651,11 @@ func (c *Conn) writePacket(data []byte) error {
 }
 
 func (c *Conn) close() error {
+	c.closeReplicas()
+	if c.holdsSecret {
+		c.releaseSecret.Do(func() {
+			log.ReleaseSecret(c.passwd)
+		})
+	}
 	return c.rwc.Close()
 }
@@ -1,14 +1,40 @@
 package transport
 
 import (
+	"encoding/binary"
 	"fmt"
+	"sync/atomic"
+	"time"
 
 	"github.com/Orlion/hersql/log"
 	"github.com/Orlion/hersql/mysql"
 )
 
 func (c *Conn) transport(packet []byte) ([][]byte, error) {
-	c.pkg.Sequence = 0
+	// statements denied by the policy never reach the backend
+	if policy := c.policy.Load(); policy != nil {
+		if err := policy.check(packet, c.noBackslashEscapes()); err != nil {
+			log.Warnw("conn statement denied by policy", "connId", c.id, "cmd", mysql.Cmd2Str(packet[0]), "error", err.Error())
+			return [][]byte{c.errorPacket(err)}, nil
+		}
+	}
+
+	// reads outside of transactions run on the replicas of the backend
+	if c.routable(packet) {
+		if packets, ok := c.transportReplica(packet); ok {
+			return packets, nil
+		}
+	}
+
+	seq := atomic.AddUint64(&c.commandSeq, 1)
+	atomic.StoreUint64(&c.runningCommand, seq)
+	defer func() {
+		// a draining server waits for the conns which are in a transaction between commands
+		c.inTransaction.Set(c.status&mysql.SERVER_STATUS_IN_TRANS > 0)
+		atomic.StoreUint64(&c.runningCommand, 0)
+	}()
+
+	c.pkg.ResetSequence()
 	if err := c.writePacket(append(make([]byte, 4, 4+len(packet)), packet...)); err != nil {
 		return nil, err
 	}
@@ -16,11 +42,21 @@ func (c *Conn) transport(packet []byte) ([][]byte, error) {
 	cmd := packet[0]
 	switch cmd {
 	case mysql.COM_PING:
-		fallthrough
-	case mysql.COM_INIT_DB:
-		fallthrough
-	case mysql.COM_QUERY:
 		return c.handleQuery()
+	case mysql.COM_INIT_DB, mysql.COM_QUERY:
+		var (
+			packets [][]byte
+			err     error
+		)
+		if cmd == mysql.COM_QUERY && c.server.maxExecutionTime > 0 {
+			packets, err = c.handleQueryWithDeadline(seq, c.server.maxExecutionTime)
+		} else {
+			packets, err = c.handleQuery()
+		}
+		if err == nil {
+			c.recordSessionStatement(packet, packets)
+		}
+		return packets, err
 	case mysql.COM_QUIT:
 		return c.handleQuit()
 	case mysql.COM_FIELD_LIST:
@@ -33,37 +69,238 @@ func (c *Conn) transport(packet []byte) ([][]byte, error) {
 func (c *Conn) handleQuery() ([][]byte, error) {
 	// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_com_query_response.html
 	packets := make([][]byte, 0)
-	hasEof := false
-Loop:
+	// once a resultset exceeded the result limits the rest of the response is drained
+	draining := false
 	for {
 		packet, err := c.readPacket()
 		if err != nil {
 			return nil, err
 		}
 
-		packets = append(packets, packet)
+		if !draining {
+			packets = append(packets, packet)
+		}
 
+		var status uint16
 		switch packet[0] {
 		case mysql.OK_HEADER:
 			// ok
-			break Loop
-		case mysql.EOF_HEADER:
-			// eof
-			if hasEof {
-				break Loop
+			r, err := c.handleOKPacket(packet)
+			if err != nil {
+				return nil, err
+			}
+			status = r.Status
+			if !draining {
+				packets[len(packets)-1] = c.relayOKPacket(packet, r)
 			}
-			hasEof = true
 		case mysql.ERR_HEADER:
 			// error
-			break Loop
 		default:
-			// column_count | Field metadata | The row data
+			// column_count
+			var exceeded bool
+			columnCount, _, _ := mysql.LengthEncodedInt(packet)
+			packets, status, exceeded, err = c.readResultset(packets, columnCount, draining)
+			if err != nil {
+				return nil, err
+			}
+			draining = draining || exceeded
+		}
+
+		if status&mysql.SERVER_MORE_RESULTS_EXISTS == 0 {
+			break
 		}
 	}
 
+	if draining {
+		return c.limitResultset(packets), nil
+	}
+
 	return packets, nil
 }
 
+// handleQueryWithDeadline kills the query through a side connection when it runs longer than timeout
+func (c *Conn) handleQueryWithDeadline(seq uint64, timeout time.Duration) ([][]byte, error) {
+	timer := time.AfterFunc(timeout, func() {
+		log.Warnw("conn query exceeded the maximum execution time, kill it", "connId", c.id, "threadId", c.threadId, "timeout", timeout.String())
+		if err := c.killQuery(seq); err != nil {
+			log.Errorw("conn kill query error occurred", "connId", c.id, "threadId", c.threadId, "error", err.Error())
+		}
+	})
+
+	packets, err := c.handleQuery()
+	fired := !timer.Stop()
+	if err != nil {
+		return nil, err
+	}
+
+	// the backend answers the killed query with ER_QUERY_INTERRUPTED
+	if last := packets[len(packets)-1]; fired && last[0] == mysql.ERR_HEADER && binary.LittleEndian.Uint16(last[1:]) == mysql.ER_QUERY_INTERRUPTED {
+		return [][]byte{c.errorPacket(mysql.NewError(mysql.ER_QUERY_TIMEOUT, fmt.Sprintf("Query execution was interrupted, maximum statement execution time of %s exceeded", timeout)))}, nil
+	}
+
+	return packets, nil
+}
+
+// killQuery kills the statement running on the backend connection, nothing is killed if the command seq is no longer running
+func (c *Conn) killQuery(seq uint64) error {
+	return c.kill(KillQuery, seq)
+}
+
+// kill kills the statement running on the backend connection or the backend connection itself through a side connection,
+// if seq is not zero nothing is killed unless the command seq is still running
+func (c *Conn) kill(killType string, seq uint64) error {
+	// the read running on a replica is killed there
+	if seq == 0 {
+		if routed := c.getRouted(); routed != nil {
+			if err := routed.kill(KillQuery, 0); err != nil {
+				return err
+			}
+			if killType == KillQuery {
+				return nil
+			}
+		}
+	}
+
+	side, err := c.server.connectSide(c.addr, c.user, c.passwd, c.collation)
+	if err != nil {
+		return err
+	}
+	defer c.server.closeSide(side)
+
+	if seq > 0 && atomic.LoadUint64(&c.runningCommand) != seq {
+		return nil
+	}
+
+	switch killType {
+	case KillQuery:
+		return side.exec(fmt.Sprintf("KILL QUERY %d", c.threadId))
+	case KillConnection:
+		return side.exec(fmt.Sprintf("KILL CONNECTION %d", c.threadId))
+	default:
+		return fmt.Errorf("unknown kill type %s", killType)
+	}
+}
+
+// readResultset reads the column definitions and rows following the column count packet,
+// returns the status flags carried by the packet terminating the resultset. Once the rows exceed
+// the result limits the query is killed and the remaining rows and the terminating packet are dropped,
+// if discard is set nothing is kept at all
+func (c *Conn) readResultset(packets [][]byte, columnCount uint64, discard bool) ([][]byte, uint16, bool, error) {
+	// Field metadata
+	masker := new(resultsetMasker)
+	for i := uint64(0); i < columnCount; i++ {
+		packet, err := c.readPacket()
+		if err != nil {
+			return nil, 0, false, err
+		}
+
+		if len(c.server.maskingRules) > 0 {
+			if packet, err = masker.addColumn(packet, c.server.maskingRules); err != nil {
+				return nil, 0, false, err
+			}
+		}
+
+		if !discard {
+			packets = append(packets, packet)
+		}
+	}
+	masking := masker.masking()
+
+	if c.capability&mysql.CLIENT_DEPRECATE_EOF == 0 {
+		packet, err := c.readPacket()
+		if err != nil {
+			return nil, 0, false, err
+		}
+
+		if !isEOFPacket(packet) {
+			return nil, 0, false, ErrMalformPkt
+		}
+
+		// a client which negotiated CLIENT_DEPRECATE_EOF expects no EOF packet after the column definitions
+		if !discard && c.missingFraming()&mysql.CLIENT_DEPRECATE_EOF == 0 {
+			packets = append(packets, packet)
+		}
+	}
+
+	// The row data
+	var (
+		rows     int
+		size     int
+		exceeded bool
+	)
+	for {
+		packet, err := c.readPacket()
+		if err != nil {
+			return nil, 0, false, err
+		}
+
+		if packet[0] == mysql.ERR_HEADER {
+			if !discard && !exceeded {
+				packets = append(packets, packet)
+			}
+			return packets, 0, exceeded, nil
+		}
+
+		if isEOFPacket(packet) {
+			r, err := c.handleEOFPacket(packet)
+			if err != nil {
+				return nil, 0, false, err
+			}
+
+			if !discard && !exceeded {
+				packets = append(packets, c.relayEOFPacket(packet, r))
+			}
+			return packets, r.Status, exceeded, nil
+		}
+
+		if discard || exceeded {
+			continue
+		}
+
+		rows++
+		size += len(packet)
+		if (c.server.maxResultRows > 0 && rows > c.server.maxResultRows) || (c.server.maxResultBytes > 0 && size > c.server.maxResultBytes) {
+			exceeded = true
+			log.Warnw("conn resultset exceeded the result limits, kill the query", "connId", c.id, "threadId", c.threadId, "rows", rows, "size", size)
+
+			// stop the backend from sending the rest of the rows, they are drained meanwhile
+			seq := atomic.LoadUint64(&c.runningCommand)
+			go func() {
+				if err := c.killQuery(seq); err != nil {
+					log.Errorw("conn kill query error occurred", "connId", c.id, "threadId", c.threadId, "error", err.Error())
+				}
+			}()
+			continue
+		}
+
+		if masking {
+			if packet, err = masker.maskTextRow(packet); err != nil {
+				return nil, 0, false, err
+			}
+		}
+
+		packets = append(packets, packet)
+	}
+}
+
+// limitResultset returns the response of a query whose resultset exceeded the result limits,
+// the packets end with the rows within the limits
+func (c *Conn) limitResultset(packets [][]byte) [][]byte {
+	if c.server.resultLimitAction == ResultLimitTruncate {
+		// the warnings are kept by the backend, SHOW WARNINGS could not return one about the truncation,
+		// so none is announced. The truncation is logged when the limits are exceeded
+		return append(packets, c.eofPacket(c.status&^mysql.SERVER_MORE_RESULTS_EXISTS, 0))
+	}
+
+	return [][]byte{c.errorPacket(mysql.NewError(mysql.ER_TOO_BIG_SELECT, fmt.Sprintf("The resultset exceeds the limits of the hersql transport, max rows: %d, max bytes: %d", c.server.maxResultRows, c.server.maxResultBytes)))}
+}
+
+// isEOFPacket reports whether the packet is an EOF packet or an OK packet with the 0xFE header,
+// a row starting with 0xFE is always longer than a single packet
+func isEOFPacket(packet []byte) bool {
+	return packet[0] == mysql.EOF_HEADER && len(packet) < mysql.MaxPayloadLen
+}
+
 func (c *Conn) handleFieldList() ([][]byte, error) {
 	// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_com_field_list.html
 	packets := make([][]byte, 0)
@@ -82,7 +319,12 @@ Loop:
 			c.close()
 			log.Errorw("conn handle field list received an OK packet while parsing the COM_FIELD_LIST response")
 		case mysql.EOF_HEADER:
-			// eof
+			// eof, or ok with the 0xFE header if CLIENT_DEPRECATE_EOF is set
+			r, err := c.handleEOFPacket(packet)
+			if err != nil {
+				return nil, err
+			}
+			packets[len(packets)-1] = c.relayEOFPacket(packet, r)
 			break Loop
 		case mysql.ERR_HEADER:
 			// error
@@ -0,0 +1,153 @@
+package transport
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Orlion/hersql/log"
+	"gopkg.in/yaml.v3"
+)
+
+// Credential is a backend user and password the sidecars refer to by name instead of sending them
+type Credential struct {
+	User   string `yaml:"user"`
+	Passwd string `yaml:"passwd"`
+	// <provider name>:<key> of the password in a secret provider, it takes precedence over passwd
+	PasswdSecret string `yaml:"passwd_secret"`
+	// names of the backends the credential may be used for besides the backends referring to it with their
+	// credential setting. A credential is only sent to the addresses of these backends, never to an address
+	// given by a sidecar, which could be a server collecting the passwords
+	Backends []string `yaml:"backends"`
+	// patterns of the sidecar identities allowed to use the credential, empty allows every identity
+	Identities []string `yaml:"identities"`
+}
+
+// allows reports whether the credential of the name may be used by the sidecar identity for the backend
+func (c *Credential) allows(name string, backend *Backend, identity string) bool {
+	if backend == nil {
+		return false
+	}
+
+	bound := backend.Credential == name
+	for _, b := range c.Backends {
+		if b == backend.Name {
+			bound = true
+		}
+	}
+	if !bound {
+		return false
+	}
+
+	if len(c.Identities) == 0 {
+		return true
+	}
+
+	for _, pattern := range c.Identities {
+		if matchPattern(pattern, identity) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadCredentials reads the credentials file, a yaml map of credential names to credentials
+func loadCredentials(file string) (map[string]*Credential, error) {
+	credentials := make(map[string]*Credential)
+	if file == "" {
+		return credentials, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("credentials_file %s read error: %w", file, err)
+	}
+
+	if err := yaml.Unmarshal(data, &credentials); err != nil {
+		return nil, fmt.Errorf("credentials_file %s parse error: %w", file, err)
+	}
+
+	for name, credential := range credentials {
+		if credential == nil || credential.User == "" {
+			return nil, fmt.Errorf("credentials_file %s credential %s has no user", file, name)
+		}
+		log.AddSecret(credential.Passwd)
+	}
+
+	return credentials, nil
+}
+
+// credentialEnv returns the prefix of the environment variables of the credential,
+// e.g. HERSQL_CREDENTIAL_BLOG_RO for blog-ro
+func credentialEnv(name string) string {
+	return "HERSQL_CREDENTIAL_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// lookupCredential looks the credential up by name in the credentials file, or else in the environment variables
+// HERSQL_CREDENTIAL_<NAME>_USER, _PASSWD, and the comma separated _BACKENDS and _IDENTITIES
+func (s *Server) lookupCredential(name string) (*Credential, bool) {
+	if credential, exists := s.credentials[name]; exists {
+		return credential, true
+	}
+
+	env := credentialEnv(name)
+	user, exists := os.LookupEnv(env + "_USER")
+	if !exists {
+		return nil, false
+	}
+
+	return &Credential{
+		User:       user,
+		Passwd:     os.Getenv(env + "_PASSWD"),
+		Backends:   splitList(os.Getenv(env + "_BACKENDS")),
+		Identities: splitList(os.Getenv(env + "_IDENTITIES")),
+	}, true
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// resolveCredential resolves the credential of the name for a session of the sidecar identity on the backend,
+// its password possibly from a secret provider. The password is only resolved once the use is allowed
+func (s *Server) resolveCredential(name string, backend *Backend, identity string) (*Credential, error) {
+	credential, exists := s.lookupCredential(name)
+	if !exists {
+		return nil, fmt.Errorf("credential %s not found", name)
+	}
+
+	if !credential.allows(name, backend, identity) {
+		if backend == nil {
+			return nil, fmt.Errorf("credential %s can only be used for the backends of the transport", name)
+		}
+		return nil, fmt.Errorf("credential %s is not allowed for the backend %s and the identity %s", name, backend.Name, identity)
+	}
+
+	if credential.PasswdSecret == "" {
+		return credential, nil
+	}
+
+	// resolved on every connect, so rotated passwords are picked up
+	passwd, err := s.resolveSecret(credential.PasswdSecret)
+	if err != nil {
+		return nil, fmt.Errorf("credential %s password: %w", name, err)
+	}
+
+	return &Credential{User: credential.User, Passwd: passwd}, nil
+}
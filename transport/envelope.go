@@ -0,0 +1,251 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SealedContentType is the content type of the request and response bodies sealed by an Envelope
+const SealedContentType = "application/x-hersql-sealed"
+
+// SealedEncodingHeader is the header of the content coding of a sealed payload, the sealed bytes do not compress
+// so the payloads are compressed before they are sealed, and Content-Encoding is left to the bodies in plaintext
+const SealedEncodingHeader = "X-Hersql-Sealed-Encoding"
+
+// MaxSealedClockSkew is the maximum age of a sealed body, older bodies are rejected
+const MaxSealedClockSkew = 2 * time.Minute
+
+var (
+	ErrSealedExpired  = errors.New("the sealed payload has expired, please check the clocks of the sidecar and the transport")
+	ErrSealedReplayed = errors.New("the sealed payload has already been opened")
+)
+
+// Envelope seals the payloads of the tunnel with AES-256-GCM under a key shared by the sidecar and the transport,
+// so proxies and load balancers terminating tls can not read them. The path of the request is authenticated
+// with the payload, so a sealed body is only accepted by the api it was sealed for, and a sealed body
+// is only opened once
+type Envelope struct {
+	aead cipher.AEAD
+
+	mu sync.Mutex
+	// the nonces of the payloads opened within the clock skew, by the time they were sealed
+	seen      map[string]time.Time
+	lastPurge time.Time
+}
+
+// NewEnvelope returns the envelope of the base64 encoded 32 byte key
+func NewEnvelope(key string) (*Envelope, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key %w", err)
+	}
+
+	return &Envelope{aead: aead, seen: make(map[string]time.Time)}, nil
+}
+
+// newAEAD returns the AES-256-GCM cipher of the base64 encoded 32 byte key
+func newAEAD(key string) (cipher.AEAD, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("is not base64 encoded: %w", err)
+	}
+
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("must be 32 bytes, got %d", len(raw))
+	}
+
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Seal returns nonce | sealed(timestamp | payload), aad binds the sealed payload to its use
+func (e *Envelope) Seal(aad string, payload []byte) ([]byte, error) {
+	nonce := make([]byte, e.aead.NonceSize(), e.aead.NonceSize()+8+len(payload)+e.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint64(plaintext, uint64(time.Now().Unix()))
+	plaintext = append(plaintext, payload...)
+
+	return e.aead.Seal(nonce, nonce, plaintext, []byte(aad)), nil
+}
+
+// Open returns the payload of the sealed data
+func (e *Envelope) Open(aad string, sealed []byte) ([]byte, error) {
+	if len(sealed) < e.aead.NonceSize()+8+e.aead.Overhead() {
+		return nil, errors.New("the sealed payload is too short")
+	}
+
+	nonce, ciphertext := sealed[:e.aead.NonceSize()], sealed[e.aead.NonceSize():]
+	plaintext, err := e.aead.Open(nil, nonce, ciphertext, []byte(aad))
+	if err != nil {
+		return nil, errors.New("the sealed payload can not be opened, please check the encryption keys")
+	}
+
+	sealedAt := time.Unix(int64(binary.BigEndian.Uint64(plaintext)), 0)
+	if skew := time.Since(sealedAt); skew > MaxSealedClockSkew || skew < -MaxSealedClockSkew {
+		return nil, ErrSealedExpired
+	}
+
+	if !e.remember(string(nonce), sealedAt) {
+		return nil, ErrSealedReplayed
+	}
+
+	return plaintext[8:], nil
+}
+
+// remember records the nonce, it returns false if the nonce was already seen
+func (e *Envelope) remember(nonce string, sealedAt time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// payloads older than the clock skew are rejected anyway, so their nonces can be forgotten
+	if now := time.Now(); now.Sub(e.lastPurge) > MaxSealedClockSkew {
+		for n, t := range e.seen {
+			if now.Sub(t) > 2*MaxSealedClockSkew {
+				delete(e.seen, n)
+			}
+		}
+		e.lastPurge = now
+	}
+
+	if _, exists := e.seen[nonce]; exists {
+		return false
+	}
+	e.seen[nonce] = sealedAt
+
+	return true
+}
+
+// seenNonces returns the hex encoded nonces of the payloads opened within the clock skew by the unix time they were
+// sealed at, they are handed off to the new transport process so it rejects the replays of the payloads too
+func (e *Envelope) seenNonces() map[string]int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	nonces := make(map[string]int64, len(e.seen))
+	for nonce, sealedAt := range e.seen {
+		nonces[hex.EncodeToString([]byte(nonce))] = sealedAt.Unix()
+	}
+
+	return nonces
+}
+
+// rememberNonces records the nonces handed off by the previous transport process
+func (e *Envelope) rememberNonces(nonces map[string]int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for nonce, sealedAt := range nonces {
+		raw, err := hex.DecodeString(nonce)
+		if err != nil {
+			continue
+		}
+		e.seen[string(raw)] = time.Unix(sealedAt, 0)
+	}
+}
+
+// Nonce returns the nonce of the sealed data, the response to a sealed request is bound to it
+func (e *Envelope) Nonce(sealed []byte) []byte {
+	if len(sealed) < e.aead.NonceSize() {
+		return nil
+	}
+
+	return sealed[:e.aead.NonceSize()]
+}
+
+// ResponseAAD is the additional data of the response to the sealed request of the api path with the nonce and the
+// conn id, a request can not be replayed as a response and a response can not be swapped with the one of another request
+func ResponseAAD(path string, requestNonce []byte, connId string) string {
+	return "response:" + path + ":" + hex.EncodeToString(requestNonce) + ":" + connId
+}
+
+// withEnvelope opens the sealed request bodies of the tunnel apis and seals their responses,
+// requests which are not sealed are rejected
+func (s *Server) withEnvelope(next http.HandlerFunc) http.HandlerFunc {
+	if s.envelope == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != SealedContentType {
+			responseFail(w, "the transport requires sealed payloads, please configure the encryption key of the sidecar")
+			return
+		}
+
+		sealed, err := io.ReadAll(r.Body)
+		if err != nil {
+			responseFail(w, "read the sealed payload error: "+err.Error())
+			return
+		}
+
+		body, err := s.envelope.Open(r.URL.Path, sealed)
+		if err != nil {
+			responseFail(w, err.Error())
+			return
+		}
+
+		if encoding := r.Header.Get(SealedEncodingHeader); encoding != "" {
+			if body, err = Decompress(encoding, body); err != nil {
+				responseFail(w, "the sealed payload can not be decoded: "+err.Error())
+				return
+			}
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		// the responses of the transport are written in one piece
+		buf := &bufferedResponseWriter{ResponseWriter: w}
+		next(buf, r)
+
+		payload, encoding := buf.Bytes(), acceptedEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding != "" && len(payload) >= compressMinSize {
+			if payload, err = Compress(encoding, payload); err != nil {
+				responseFail(w, "compress the response error: "+err.Error())
+				return
+			}
+		} else {
+			encoding = ""
+		}
+
+		response, err := s.envelope.Seal(ResponseAAD(r.URL.Path, s.envelope.Nonce(sealed), r.PostFormValue("connId")), payload)
+		if err != nil {
+			responseFail(w, "seal the response error: "+err.Error())
+			return
+		}
+
+		if encoding != "" {
+			w.Header().Set(SealedEncodingHeader, encoding)
+		}
+		w.Header().Set("Content-Type", SealedContentType)
+		w.Write(response)
+	}
+}
+
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	return w.Buffer.Write(b)
+}
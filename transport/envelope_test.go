@@ -0,0 +1,266 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testEncryptionKey = "MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE="
+
+func newTestEnvelope(t *testing.T) *Envelope {
+	t.Helper()
+
+	e, err := NewEnvelope(testEncryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return e
+}
+
+// sealAt seals the payload as if it was sealed at the time
+func sealAt(t *testing.T, e *Envelope, aad string, payload []byte, at time.Time) []byte {
+	t.Helper()
+
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext := binary.BigEndian.AppendUint64(nil, uint64(at.Unix()))
+	plaintext = append(plaintext, payload...)
+
+	return e.aead.Seal(nonce, nonce, plaintext, []byte(aad))
+}
+
+func TestNewEnvelope(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		wantErr bool
+	}{
+		{"valid", testEncryptionKey, false},
+		{"not base64", "not a key!", true},
+		{"too short", "MDEyMzQ1Njc4OTAxMjM0NQ==", true},
+		{"empty", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewEnvelope(tt.key); (err != nil) != tt.wantErr {
+				t.Errorf("NewEnvelope() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEnvelopeOpen(t *testing.T) {
+	other, err := NewEnvelope("YWJjZGVmZ2hpamtsbW5vcHFyc3R1dnd4eXoxMjM0NTY=")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		seal    func(e *Envelope) []byte
+		aad     string
+		wantErr bool
+		// the error expected, if a specific one
+		is error
+	}{
+		{"sealed", func(e *Envelope) []byte { return sealAt(t, e, "/transport", []byte("payload"), time.Now()) }, "/transport", false, nil},
+		{"other path", func(e *Envelope) []byte { return sealAt(t, e, "/transport", []byte("payload"), time.Now()) }, "/kill", true, nil},
+		{"other key", func(e *Envelope) []byte { return sealAt(t, other, "/transport", []byte("payload"), time.Now()) }, "/transport", true, nil},
+		{"tampered", func(e *Envelope) []byte {
+			sealed := sealAt(t, e, "/transport", []byte("payload"), time.Now())
+			sealed[len(sealed)-1] ^= 1
+			return sealed
+		}, "/transport", true, nil},
+		{"too short", func(e *Envelope) []byte { return []byte("short") }, "/transport", true, nil},
+		{"expired", func(e *Envelope) []byte {
+			return sealAt(t, e, "/transport", []byte("payload"), time.Now().Add(-MaxSealedClockSkew-time.Minute))
+		}, "/transport", true, ErrSealedExpired},
+		{"from the future", func(e *Envelope) []byte {
+			return sealAt(t, e, "/transport", []byte("payload"), time.Now().Add(MaxSealedClockSkew+time.Minute))
+		}, "/transport", true, ErrSealedExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnvelope(t)
+
+			payload, err := e.Open(tt.aad, tt.seal(e))
+			if (err != nil) != tt.wantErr || tt.is != nil && err != tt.is {
+				t.Fatalf("Open() error = %v, wantErr %v %v", err, tt.wantErr, tt.is)
+			}
+			if !tt.wantErr && !bytes.Equal(payload, []byte("payload")) {
+				t.Errorf("Open() = %q, want %q", payload, "payload")
+			}
+		})
+	}
+}
+
+func TestEnvelopeReplay(t *testing.T) {
+	e := newTestEnvelope(t)
+
+	sealed, err := e.Seal("/transport", []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.Open("/transport", sealed); err != nil {
+		t.Fatalf("first Open() error = %v", err)
+	}
+
+	if _, err := e.Open("/transport", sealed); err != ErrSealedReplayed {
+		t.Errorf("second Open() error = %v, want %v", err, ErrSealedReplayed)
+	}
+}
+
+func TestWithEnvelope(t *testing.T) {
+	e := newTestEnvelope(t)
+	s := &Server{envelope: e}
+
+	handler := s.withEnvelope(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("packet " + r.PostFormValue("packet")))
+	})
+
+	form := url.Values{"connId": {"7"}, "packet": {"ping"}}
+	sealed, err := e.Seal("/transport", []byte(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/transport", bytes.NewReader(sealed))
+	req.Header.Set("Content-Type", SealedContentType)
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+
+	if ct := rec.Header().Get("Content-Type"); ct != SealedContentType {
+		t.Fatalf("response Content-Type = %q, want %q: %s", ct, SealedContentType, rec.Body.Bytes())
+	}
+	response := rec.Body.Bytes()
+
+	otherNonce := make([]byte, len(e.Nonce(sealed)))
+	tests := []struct {
+		name    string
+		aad     string
+		wantErr bool
+	}{
+		// the sidecar opens the response with the nonce of its request and the conn id
+		{"own request", ResponseAAD("/transport", e.Nonce(sealed), "7"), false},
+		{"other request", ResponseAAD("/transport", otherNonce, "7"), true},
+		{"other conn", ResponseAAD("/transport", e.Nonce(sealed), "8"), true},
+		{"other path", ResponseAAD("/kill", e.Nonce(sealed), "7"), true},
+		{"request aad", "/transport", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a fresh envelope of the same key, so the replay protection does not interfere
+			payload, err := newTestEnvelope(t).Open(tt.aad, response)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Open() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(payload) != "packet ping" {
+				t.Errorf("Open() = %q, want %q", payload, "packet ping")
+			}
+		})
+	}
+
+	t.Run("not sealed", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/transport", bytes.NewReader([]byte(form.Encode())))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+
+		if ct := rec.Header().Get("Content-Type"); ct == SealedContentType {
+			t.Errorf("response to a request in plaintext is sealed")
+		}
+		if bytes.Contains(rec.Body.Bytes(), []byte("packet")) {
+			t.Errorf("request in plaintext reached the handler: %s", rec.Body.Bytes())
+		}
+	})
+
+	t.Run("replayed", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/transport", bytes.NewReader(sealed))
+		req.Header.Set("Content-Type", SealedContentType)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+
+		if bytes.Contains(rec.Body.Bytes(), []byte("packet")) || rec.Header().Get("Content-Type") == SealedContentType {
+			t.Errorf("replayed request reached the handler")
+		}
+	})
+}
+
+func TestWithEnvelopeCompression(t *testing.T) {
+	e := newTestEnvelope(t)
+	s := &Server{envelope: e}
+
+	handler := s.withEnvelope(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat(r.PostFormValue("packet"), 2)))
+	})
+
+	tests := []struct {
+		name           string
+		packet         string
+		acceptEncoding string
+		// the coding of the sealed response, empty if not compressed
+		want string
+	}{
+		{"zstd", strings.Repeat("SELECT 1;", compressMinSize), EncodingZstd, EncodingZstd},
+		{"gzip", strings.Repeat("SELECT 1;", compressMinSize), EncodingGzip, EncodingGzip},
+		{"short", "SELECT 1", EncodingZstd, ""},
+		{"not accepted", strings.Repeat("SELECT 1;", compressMinSize), "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"connId": {"7"}, "packet": {tt.packet}}
+			// the sidecar compresses the request bodies before sealing them as well
+			body, err := Compress(EncodingGzip, []byte(form.Encode()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sealed, err := e.Seal("/transport", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/transport", bytes.NewReader(sealed))
+			req.Header.Set("Content-Type", SealedContentType)
+			req.Header.Set(SealedEncodingHeader, EncodingGzip)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+
+			encoding := rec.Header().Get(SealedEncodingHeader)
+			if encoding != tt.want {
+				t.Fatalf("response %s = %q, want %q: %.100s", SealedEncodingHeader, encoding, tt.want, rec.Body.Bytes())
+			}
+
+			payload, err := newTestEnvelope(t).Open(ResponseAAD("/transport", e.Nonce(sealed), "7"), rec.Body.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encoding != "" {
+				if payload, err = Decompress(encoding, payload); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if string(payload) != strings.Repeat(tt.packet, 2) {
+				t.Errorf("response payload of %d bytes, want %d", len(payload), 2*len(tt.packet))
+			}
+		})
+	}
+}
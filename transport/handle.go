@@ -1,22 +1,30 @@
 package transport
 
 import (
+	"errors"
 	"fmt"
-	"net"
 	"net/http"
+	"sort"
 	"strconv"
-	"time"
+	"sync/atomic"
 
 	"github.com/Orlion/hersql/log"
 	"github.com/Orlion/hersql/mysql"
 )
 
 func (s *Server) HandleConnect(w http.ResponseWriter, r *http.Request) {
+	if s.draining.Get() {
+		responseError(w, errServerShutdown)
+		return
+	}
+
 	addr := r.PostFormValue("addr")
 	dbname := r.PostFormValue("dbname")
 	user := r.PostFormValue("user")
 	passwd := r.PostFormValue("passwd")
+	credentialName := r.PostFormValue("credential")
 	collationStr := r.PostFormValue("collation")
+	capabilityStr := r.PostFormValue("capability")
 
 	collation, err := strconv.ParseUint(collationStr, 10, 8)
 	if err != nil {
@@ -24,37 +32,85 @@ func (s *Server) HandleConnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rwc, err := net.Dial("tcp", addr)
-	if err != nil {
-		responseFail(w, fmt.Sprintf("handleConnect dial to %s failed: %s", addr, err.Error()))
+	// sidecars which do not send the client capability get the fixed capability set
+	var capability uint64
+	if capabilityStr != "" {
+		capability, err = strconv.ParseUint(capabilityStr, 10, 32)
+		if err != nil {
+			responseFail(w, fmt.Sprintf("handleConnect parse capability %s error: %s", capabilityStr, err.Error()))
+			return
+		}
+	}
+
+	// the address may name a backend, the sessions are opened on its primary
+	backend := s.getBackend(addr)
+	if backend != nil {
+		addr = backend.pickPrimary()
+		if credentialName == "" {
+			credentialName = backend.Credential
+		}
+	}
+
+	identity := s.identity(r)
+
+	// credentials referred to by name are resolved here, they never travel through the tunnel
+	if credentialName != "" {
+		credential, err := s.resolveCredential(credentialName, backend, identity)
+		if err != nil {
+			log.Warnw("handleConnect resolve credential error occurred", "credential", credentialName, "addr", addr, "identity", identity, "error", err.Error())
+			// whether the credential exists is not revealed
+			responseError(w, mysql.NewError(mysql.ER_ACCESS_DENIED_ERROR, fmt.Sprintf("Access denied, the hersql transport credential %s can not be used for this backend", credentialName)))
+			return
+		}
+		user, passwd = credential.User, credential.Passwd
+	} else if s.denyInlineCredentials {
+		responseError(w, mysql.NewError(mysql.ER_ACCESS_DENIED_ERROR, "Access denied, the hersql transport only accepts credentials referred to by name"))
 		return
 	}
 
-	conn := &Conn{
-		id:        s.genConnId(),
-		rwc:       rwc,
-		createAt:  time.Now(),
-		server:    s,
-		pkg:       mysql.NewPacketIO(rwc),
-		dbname:    dbname,
-		user:      user,
-		passwd:    passwd,
-		collation: uint8(collation),
+	if err := s.acquireSession(identity); err != nil {
+		log.Warnw("handleConnect quota exhausted", "identity", identity, "error", err.Error())
+		responseError(w, err)
+		return
+	}
+
+	if err := s.acquireSlots(addr); err != nil {
+		s.releaseSession(identity)
+		log.Warnw("handleConnect too many sessions", "addr", addr, "identity", identity)
+		responseError(w, err)
+		return
 	}
 
-	log.Infow("handleConnect create conn", "connId", conn.id, "addr", addr, "dbname", dbname, "user", user, "collation", collation)
+	// the sessions under a policy run one statement per query. The statements of a query are classified as the transport
+	// splits them, a query the backend split otherwise, e.g. by quoting in another sql mode, would run unchecked statements
+	policy := s.getPolicy(addr, user, identity)
+	if policy != nil {
+		capability &^= uint64(mysql.CLIENT_MULTI_STATEMENTS)
+	}
+
+	log.Infow("handleConnect create conn", "addr", addr, "dbname", dbname, "credential", credentialName, "collation", collation, "identity", identity)
 
-	if err := conn.handshake(); err != nil {
-		rwc.Close()
-		responseFail(w, fmt.Sprintf("handleConnect handshake failed: %s", err.Error()))
+	// the password is redacted from the logs while the session lasts
+	log.HoldSecret(passwd)
+	conn, err := s.connect(addr, user, passwd, dbname, uint8(collation), uint32(capability))
+	if err != nil {
+		log.ReleaseSecret(passwd)
+		s.releaseSlots(addr)
+		s.releaseSession(identity)
+		responseFail(w, fmt.Sprintf("handleConnect %s", err.Error()))
 		return
 	}
+	conn.holdsSecret = true
+
+	conn.policy.Store(policy)
+	conn.identity = identity
+	conn.backend = backend
 
 	s.addConn(conn)
 
-	log.Infow("handleConnect success", "connId", conn.id, "addr", addr, "remoteAddr", r.RemoteAddr)
+	log.Infow("handleConnect success", "connId", conn.id, "addr", addr, "serverVersion", conn.serverVersion, "capability", conn.capability, "remoteAddr", r.RemoteAddr)
 
-	connectResponse(w, s.runid, conn.id)
+	connectResponse(w, s.runid, conn)
 }
 
 func (s *Server) HandleDisconnect(w http.ResponseWriter, r *http.Request) {
@@ -71,7 +127,7 @@ func (s *Server) HandleDisconnect(w http.ResponseWriter, r *http.Request) {
 	}
 
 	conn, exists := s.getConn(connId)
-	if !exists {
+	if !exists || !s.ownsConn(r, conn) {
 		responseFail(w, fmt.Sprintf("handleDisconnect conn %d not found", connId))
 		return
 	}
@@ -102,30 +158,175 @@ func (s *Server) HandleTransport(w http.ResponseWriter, r *http.Request) {
 	packet := r.PostFormValue("packet")
 
 	conn, exists := s.getConn(connId)
-	if !exists {
+	if !exists || !s.ownsConn(r, conn) {
+		if s.connEnded(connId) {
+			responseError(w, errServerShutdown)
+			return
+		}
 		responseFail(w, fmt.Sprintf("handleTransport conn %d not found, please try reconnect", connId))
 		return
 	}
 
+	// a draining server ends the sessions outside of transactions before their next command
+	if s.draining.Get() && !conn.inTransaction.Get() && packet[0] != mysql.COM_QUIT {
+		log.Infow("handleTransport server shutdown, ending the session", "connId", connId, "remoteAddr", r.RemoteAddr)
+		s.delConn(connId)
+		conn.close()
+		transportResponse(w, [][]byte{conn.errorPacket(errServerShutdown)})
+		return
+	}
+
 	log.Infow("handleTransport request", "connId", connId, "cmd", mysql.Cmd2Str(packet[0]), "length", len(packet))
 
+	// quitting is never limited
+	if packet[0] != mysql.COM_QUIT {
+		if err := s.allowCommand(conn.identity, len(packet)); err != nil {
+			log.Warnw("handleTransport quota exhausted", "connId", connId, "identity", conn.identity, "error", err.Error())
+			transportResponse(w, [][]byte{conn.errorPacket(err)})
+			return
+		}
+	}
+
+	conn.commandMu.Lock()
 	responsePackets, err := conn.transport([]byte(packet))
+	conn.commandMu.Unlock()
 	if err != nil {
 		log.Warnw("handleTransport fail", "connId", connId, "cmd", mysql.Cmd2Str(packet[0]), "length", len(packet), "responsePacketsNum", len(responsePackets), "err", err)
+
+		// the backend connection is out of sync after a read or write failure, e.g. a timeout
+		if errors.Is(err, mysql.ErrBadConn) {
+			s.delConn(connId)
+			conn.close()
+		}
+
 		responseFail(w, fmt.Sprintf("handleTransport error: %s", err.Error()))
 		return
 	}
 
 	log.Infow("handleTransport success", "connId", connId, "cmd", mysql.Cmd2Str(packet[0]), "length", len(packet), "responsePacketsNum", len(responsePackets))
 
+	size := 0
+	for _, responsePacket := range responsePackets {
+		size += len(responsePacket)
+	}
+	s.takeBytes(conn.identity, size)
+
 	transportResponse(w, responsePackets)
 }
 
+func (s *Server) HandleKill(w http.ResponseWriter, r *http.Request) {
+	runid := r.PostFormValue("runid")
+	if runid != s.runid {
+		responseFail(w, "handleKill the runid does not match, the server may have been restarted, please try to reconnect")
+		return
+	}
+	connIdStr := r.PostFormValue("connId")
+	connId, err := strconv.ParseUint(connIdStr, 10, 64)
+	if err != nil {
+		responseFail(w, fmt.Sprintf("handleKill connId %s parse error: %s", connIdStr, err.Error()))
+		return
+	}
+	killType := r.PostFormValue("type")
+
+	conn, exists := s.getConn(connId)
+	if !exists || !(s.ownsConn(r, conn) || s.isAdmin(r)) {
+		responseFail(w, fmt.Sprintf("handleKill conn %d not found", connId))
+		return
+	}
+
+	if err = conn.kill(killType, 0); err != nil {
+		log.Warnw("handleKill fail", "connId", connId, "threadId", conn.threadId, "type", killType, "err", err)
+		responseFail(w, fmt.Sprintf("handleKill error: %s", err.Error()))
+		return
+	}
+
+	log.Infow("handleKill success", "connId", connId, "threadId", conn.threadId, "type", killType, "remoteAddr", r.RemoteAddr)
+
+	killResponse(w)
+}
+
+// HandlePing answers the probes of the sidecars
+func (s *Server) HandlePing(w http.ResponseWriter, r *http.Request) {
+	pingResponse(w)
+}
+
+// HandleBackends reports the backends and the state of their addresses
+func (s *Server) HandleBackends(w http.ResponseWriter, r *http.Request) {
+	backends := s.getBackends()
+	data := make([]*BackendStatus, 0, len(backends))
+	for _, backend := range backends {
+		status := &BackendStatus{Name: backend.Name, Addrs: make([]*AddrStatus, 0)}
+		for _, addr := range backend.addrs() {
+			addrStatus := &AddrStatus{Addr: addr[0], Role: addr[1], Healthy: true}
+			if health := backend.getHealth(addr[0]); health != nil {
+				addrStatus.Healthy = health.healthy
+				addrStatus.CheckedAt = health.checkedAt.Format("2006-01-02 15:04:05")
+				addrStatus.Latency = health.latency.String()
+				addrStatus.Error = health.err
+			}
+			status.Addrs = append(status.Addrs, addrStatus)
+		}
+		data = append(data, status)
+	}
+
+	sort.Slice(data, func(i, j int) bool {
+		return data[i].Name < data[j].Name
+	})
+
+	backendsResponse(w, data)
+}
+
+// HandleSessions lists the sessions to the requests carrying the admin token, the sidecars authenticated
+// by their client certificates see their own. Without either the sessions of every sidecar would be exposed
+func (s *Server) HandleSessions(w http.ResponseWriter, r *http.Request) {
+	admin := s.isAdmin(r)
+	if !admin && !s.clientAuth {
+		responseError(w, errSessionsDenied)
+		return
+	}
+
+	s.mu.Lock()
+	sessions := make([]*SessionStatus, 0, len(s.conns))
+	for _, conn := range s.conns {
+		if !admin && !s.ownsConn(r, conn) {
+			continue
+		}
+
+		session := &SessionStatus{
+			ConnId:        conn.id,
+			Addr:          conn.addr,
+			User:          conn.user,
+			Dbname:        conn.dbname,
+			Identity:      conn.identity,
+			ThreadId:      conn.threadId,
+			CreateAt:      conn.createAt.Format("2006-01-02 15:04:05"),
+			InTransaction: conn.inTransaction.Get(),
+			Running:       atomic.LoadUint64(&conn.runningCommand) > 0,
+		}
+		if conn.backend != nil {
+			session.Backend = conn.backend.Name
+		}
+		sessions = append(sessions, session)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ConnId < sessions[j].ConnId
+	})
+
+	sessionsResponse(w, s.runid, sessions)
+}
+
+// HandleStatus reports the number of the sessions, the sessions themselves name their users and are only
+// listed to the requests carrying the admin token
 func (s *Server) HandleStatus(w http.ResponseWriter, r *http.Request) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	w.Write([]byte(fmt.Sprintf("conn num: %d", len(s.conns))))
+	if !s.isAdmin(r) {
+		return
+	}
 	for connId, conn := range s.conns {
 		w.Write([]byte(fmt.Sprintf("connId: %d, conn: %s \n", connId, conn.name())))
 	}
@@ -0,0 +1,104 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Orlion/hersql/mysql"
+)
+
+// slowBackend answers every command with an OK packet after the delay,
+// it counts the commands it received while it was still running another one
+func slowBackend(t *testing.T, rwc net.Conn, delay time.Duration) *int32 {
+	t.Helper()
+
+	var interleaved, running int32
+	commands := make(chan struct{})
+	go func() {
+		defer close(commands)
+		header := make([]byte, 4)
+		for {
+			if _, err := io.ReadFull(rwc, header); err != nil {
+				return
+			}
+			if _, err := io.ReadFull(rwc, make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)); err != nil {
+				return
+			}
+
+			if atomic.AddInt32(&running, 1) > 1 {
+				atomic.AddInt32(&interleaved, 1)
+			}
+			commands <- struct{}{}
+		}
+	}()
+
+	go func() {
+		for range commands {
+			time.Sleep(delay)
+			atomic.AddInt32(&running, -1)
+			// OK packet of sequence 1: no affected rows, no insert id, autocommit, no warnings
+			rwc.Write([]byte{7, 0, 0, 1, mysql.OK_HEADER, 0, 0, 2, 0, 0, 0})
+		}
+	}()
+
+	return &interleaved
+}
+
+// postTransport posts the packet of the session to /transport
+func postTransport(s *Server, connId uint64, packet string) *httptest.ResponseRecorder {
+	form := url.Values{"runid": {s.runid}, "connId": {strconv.FormatUint(connId, 10)}, "packet": {packet}}
+	req := httptest.NewRequest(http.MethodPost, "/transport", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	s.HandleTransport(rec, req)
+
+	return rec
+}
+
+func TestHandleTransportSerializesCommands(t *testing.T) {
+	s := newTestServer(t, &Config{})
+
+	backend, rwc := net.Pipe()
+	t.Cleanup(func() { backend.Close() })
+	interleaved := slowBackend(t, backend, 50*time.Millisecond)
+
+	conn := &Conn{
+		id:         s.genConnId(),
+		rwc:        rwc,
+		createAt:   time.Now(),
+		server:     s,
+		pkg:        mysql.NewPacketIO(rwc),
+		replicas:   make(map[string]*replicaConn),
+		capability: mysql.CLIENT_PROTOCOL_41,
+	}
+	s.addConn(conn)
+
+	// the sidecar gave up waiting for a command and sent the next ones
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			rec := postTransport(s, conn.id, "\x03SELECT 1")
+			if !strings.Contains(rec.Body.String(), `"status":true`) {
+				t.Errorf("HandleTransport() = %s", rec.Body.String())
+			}
+		}()
+	}
+
+	within(t, 5*time.Second, wg.Wait)
+
+	if n := atomic.LoadInt32(interleaved); n > 0 {
+		t.Errorf("%d commands reached the backend while another one was running", n)
+	}
+}
@@ -0,0 +1,421 @@
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/Orlion/hersql/log"
+	"github.com/Orlion/hersql/mysql"
+)
+
+// the sessions are handed off in batches of descriptors, below the limit of a single unix socket message
+const handoffBatchSize = 200
+
+// handoffState is the state handed off to the new transport process along with the descriptors
+// of the listener and of the backend connections, in the same order as the conns
+type handoffState struct {
+	Runid      string         `json:"runid"`
+	NextConnId uint64         `json:"next_conn_id"`
+	Conns      []*handoffConn `json:"conns"`
+	// the sessions which could not be handed off, they end with the running process
+	Ended []uint64 `json:"ended"`
+	// the hex encoded nonces of the sealed payloads the running process opened, by the unix time they were sealed at
+	Nonces map[string]int64 `json:"nonces,omitempty"`
+}
+
+type handoffConn struct {
+	Id                uint64    `json:"id"`
+	Addr              string    `json:"addr"`
+	Backend           string    `json:"backend"`
+	Identity          string    `json:"identity"`
+	CreateAt          time.Time `json:"create_at"`
+	ThreadId          uint32    `json:"thread_id"`
+	ServerVersion     string    `json:"server_version"`
+	ServerCapability  uint32    `json:"server_capability"`
+	ServerCollation   uint8     `json:"server_collation"`
+	ClientCapability  uint32    `json:"client_capability"`
+	Capability        uint32    `json:"capability"`
+	Collation         uint8     `json:"collation"`
+	Status            uint16    `json:"status"`
+	User              string    `json:"user"`
+	Passwd            string    `json:"passwd"`
+	Dbname            string    `json:"dbname"`
+	SessionStatements []string  `json:"session_statements"`
+	PrimaryOnly       bool      `json:"primary_only"`
+}
+
+// HandedOff is closed once the sessions have been handed off to a new transport process, the process may exit then
+func (s *Server) HandedOff() <-chan struct{} {
+	return s.handedOff
+}
+
+// listen listens on the address of the server, or takes over the listener and the sessions of the running
+// transport process if the handoff socket is served by one
+func (s *Server) listen() (net.Listener, error) {
+	if s.handoffSocket != "" {
+		ln, err := s.takeOver()
+		if err != nil {
+			return nil, fmt.Errorf("take over the sessions from %s error: %w", s.handoffSocket, err)
+		}
+		if ln != nil {
+			return ln, nil
+		}
+	}
+
+	return net.Listen("tcp", s.Addr)
+}
+
+// takeOver receives the listener and the sessions from the process serving the handoff socket,
+// it returns a nil listener if no process serves it
+func (s *Server) takeOver() (net.Listener, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: s.handoffSocket, Net: "unix"})
+	if err != nil {
+		// no transport is running, or the socket was left over by one which crashed
+		return nil, nil
+	}
+	defer conn.Close()
+
+	log.Infow("server take over the sessions", "socket", s.handoffSocket)
+
+	var size uint32
+	if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return nil, err
+	}
+
+	state := new(handoffState)
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+
+	files, err := recvFiles(conn, 1+len(state.Conns))
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := net.FileListener(files[0])
+	if err != nil {
+		closeFiles(files)
+		return nil, err
+	}
+
+	s.runid = state.Runid
+	atomic.StoreUint64(&s.nextConnId, state.NextConnId)
+	// the payloads the running process opened must not be replayed to this one
+	if s.envelope != nil {
+		s.envelope.rememberNonces(state.Nonces)
+	}
+
+	s.mu.Lock()
+	for _, connId := range state.Ended {
+		s.endedConns[connId] = true
+	}
+	s.mu.Unlock()
+
+	for i, hc := range state.Conns {
+		if err := s.restoreConn(hc, files[1+i]); err != nil {
+			log.Warnw("server take over session error occurred", "connId", hc.Id, "addr", hc.Addr, "error", err.Error())
+			s.mu.Lock()
+			s.endedConns[hc.Id] = true
+			s.mu.Unlock()
+		}
+	}
+	closeFiles(files)
+
+	// the running process releases the handoff socket once it has the acknowledgement
+	if _, err := conn.Write([]byte{1}); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	io.Copy(io.Discard, conn)
+
+	log.Infow("server take over success", "runid", s.runid, "sessions", len(state.Conns))
+
+	return ln, nil
+}
+
+func (s *Server) restoreConn(hc *handoffConn, file *os.File) error {
+	rwc, err := net.FileConn(file)
+	if err != nil {
+		return err
+	}
+
+	if err := s.acquireSession(hc.Identity); err != nil {
+		rwc.Close()
+		return err
+	}
+
+	if err := s.acquireSlots(hc.Addr); err != nil {
+		s.releaseSession(hc.Identity)
+		rwc.Close()
+		return err
+	}
+
+	pkg := mysql.NewPacketIO(rwc)
+	pkg.SetTimeout(s.readTimeout, s.writeTimeout)
+
+	conn := &Conn{
+		id:               hc.Id,
+		rwc:              rwc,
+		createAt:         hc.CreateAt,
+		server:           s,
+		pkg:              pkg,
+		addr:             hc.Addr,
+		replicas:         make(map[string]*replicaConn),
+		threadId:         hc.ThreadId,
+		serverVersion:    hc.ServerVersion,
+		serverCapability: hc.ServerCapability,
+		serverCollation:  hc.ServerCollation,
+		clientCapability: hc.ClientCapability,
+		capability:       hc.Capability,
+		collation:        hc.Collation,
+		status:           hc.Status,
+		user:             hc.User,
+		passwd:           hc.Passwd,
+		dbname:           hc.Dbname,
+		identity:         hc.Identity,
+		primaryOnly:      hc.PrimaryOnly,
+	}
+	for _, statement := range hc.SessionStatements {
+		conn.sessionStatements = append(conn.sessionStatements, sessionStatement{query: statement, key: sessionStatementKey(statement, conn.noBackslashEscapes())})
+	}
+
+	if hc.Backend != "" {
+		conn.backend = s.getBackends()[hc.Backend]
+	}
+
+	if conn.capability&mysql.CLIENT_COMPRESS > 0 {
+		pkg.EnableCompression()
+	}
+
+	conn.inTransaction.Set(conn.status&mysql.SERVER_STATUS_IN_TRANS > 0)
+	conn.policy.Store(s.getPolicy(conn.addr, conn.user, conn.identity))
+	log.HoldSecret(conn.passwd)
+	conn.holdsSecret = true
+
+	s.addConn(conn)
+
+	return nil
+}
+
+// serveHandoff hands the listener and the sessions off to the first new transport process connecting to the handoff socket
+func (s *Server) serveHandoff() error {
+	// the socket may have been left over by a process which crashed
+	os.Remove(s.handoffSocket)
+
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: s.handoffSocket, Net: "unix"})
+	if err != nil {
+		return err
+	}
+
+	// only processes of the same user may take the sessions over
+	if err := os.Chmod(s.handoffSocket, 0600); err != nil {
+		ln.Close()
+		return err
+	}
+
+	go func() {
+		for {
+			conn, err := ln.AcceptUnix()
+			if err != nil {
+				return
+			}
+
+			if s.handOff(conn) {
+				ln.Close()
+				conn.Close()
+				close(s.handedOff)
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	return nil
+}
+
+// handOff stops serving and hands the listener and the idle sessions off, it resumes serving if the new process fails
+func (s *Server) handOff(conn *net.UnixConn) bool {
+	log.Infow("server hand off the sessions", "socket", s.handoffSocket)
+
+	lnFile, err := s.listener.(*net.TCPListener).File()
+	if err != nil {
+		log.Errorw("server hand off listener error occurred", "error", err.Error())
+		return false
+	}
+	files := []*os.File{lnFile}
+	defer func() {
+		closeFiles(files)
+	}()
+
+	// the requests queue up in the backlog of the listener until the new process accepts them
+	ctx, cancel := context.WithTimeout(context.Background(), s.drainTimeout)
+	defer cancel()
+	if err := s.http.Shutdown(ctx); err != nil {
+		log.Warnw("server hand off the running requests did not finish", "error", err.Error())
+	}
+
+	state := &handoffState{Runid: s.runid, NextConnId: atomic.LoadUint64(&s.nextConnId)}
+	if s.envelope != nil {
+		state.Nonces = s.envelope.seenNonces()
+	}
+
+	s.mu.Lock()
+	conns := make([]*Conn, 0, len(s.conns))
+	var ended []*Conn
+	for _, c := range s.conns {
+		// the commands still running after the timeout can not be handed off, they finish in this process
+		// and the next requests of their sessions receive ER_SERVER_SHUTDOWN from the new one
+		if atomic.LoadUint64(&c.runningCommand) > 0 {
+			state.Ended = append(state.Ended, c.id)
+			ended = append(ended, c)
+			continue
+		}
+
+		file, err := c.rwc.(*net.TCPConn).File()
+		if err != nil {
+			log.Warnw("server hand off session error occurred", "connId", c.id, "error", err.Error())
+			state.Ended = append(state.Ended, c.id)
+			ended = append(ended, c)
+			continue
+		}
+
+		hc := &handoffConn{
+			Id:               c.id,
+			Addr:             c.addr,
+			Identity:         c.identity,
+			CreateAt:         c.createAt,
+			ThreadId:         c.threadId,
+			ServerVersion:    c.serverVersion,
+			ServerCapability: c.serverCapability,
+			ServerCollation:  c.serverCollation,
+			ClientCapability: c.clientCapability,
+			Capability:       c.capability,
+			Collation:        c.collation,
+			Status:           c.status,
+			User:             c.user,
+			Passwd:           c.passwd,
+			Dbname:           c.dbname,
+			PrimaryOnly:      c.primaryOnly,
+		}
+		for _, statement := range c.sessionStatements {
+			hc.SessionStatements = append(hc.SessionStatements, statement.query)
+		}
+		if c.backend != nil {
+			hc.Backend = c.backend.Name
+		}
+
+		state.Conns = append(state.Conns, hc)
+		files = append(files, file)
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	if err := sendHandoff(conn, state, files); err != nil {
+		log.Errorw("server hand off error occurred, resuming", "error", err.Error())
+		s.resume(lnFile)
+		return false
+	}
+
+	// the sessions live on in the new process, only the descriptors of this process are closed
+	s.mu.Lock()
+	for _, c := range conns {
+		delete(s.conns, c.id)
+	}
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		c.close()
+	}
+
+	s.endConns(ended)
+
+	select {
+	case <-s.doneChan:
+	default:
+		close(s.doneChan)
+	}
+
+	log.Infow("server hand off success", "sessions", len(conns))
+
+	return true
+}
+
+// endConns lets the commands of the sessions which were not handed off finish for another drain timeout,
+// so their responses reach the sidecars, and closes the sessions
+func (s *Server) endConns(conns []*Conn) {
+	deadline := time.Now().Add(s.drainTimeout)
+	for _, c := range conns {
+		for atomic.LoadUint64(&c.runningCommand) > 0 && time.Now().Before(deadline) {
+			time.Sleep(drainPollInterval)
+		}
+
+		log.Warnw("server hand off ended the session", "connId", c.id)
+		s.delConn(c.id)
+		c.close()
+	}
+}
+
+func sendHandoff(conn *net.UnixConn, state *handoffState, files []*os.File) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	if err := binary.Write(conn, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
+	}
+
+	if _, err := conn.Write(data); err != nil {
+		return err
+	}
+
+	if err := sendFiles(conn, files); err != nil {
+		return err
+	}
+
+	// the new process acknowledges once it took the sessions over
+	ack := make([]byte, 1)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return fmt.Errorf("the new process did not take the sessions over: %w", err)
+	}
+
+	return nil
+}
+
+// resume serves the listener again after a failed handoff
+func (s *Server) resume(lnFile *os.File) {
+	ln, err := net.FileListener(lnFile)
+	if err != nil {
+		log.Errorw("server resume error occurred", "error", err.Error())
+		return
+	}
+
+	s.http = &http.Server{Addr: s.Addr, Handler: s.http.Handler, TLSConfig: s.http.TLSConfig}
+	s.listener = ln
+
+	go func() {
+		if err := s.serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorw("server resume serve error occurred", "error", err.Error())
+		}
+	}()
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
@@ -0,0 +1,153 @@
+//go:build !windows
+
+package transport
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startHandoff serves the handoff socket of the server on a listener of its own
+func startHandoff(t *testing.T, s *Server) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.listener = ln
+
+	if err := s.serveHandoff(); err != nil {
+		ln.Close()
+		t.Fatal(err)
+	}
+}
+
+// takeOverHandoff takes the sessions over in a new server of the same configuration
+func takeOverHandoff(t *testing.T, conf *Config) *Server {
+	t.Helper()
+
+	s := newTestServer(t, conf)
+	within(t, 5*time.Second, func() {
+		ln, err := s.takeOver()
+		if err != nil {
+			t.Errorf("takeOver() error = %v", err)
+			return
+		}
+		t.Cleanup(func() { ln.Close() })
+	})
+
+	return s
+}
+
+func TestHandOffWithReplicas(t *testing.T) {
+	conf := &Config{
+		DrainTimeout:          time.Second,
+		HandoffSocket:         filepath.Join(t.TempDir(), "handoff.sock"),
+		MaxSessionsPerBackend: 4,
+		Quotas:                []*Quota{{MaxSessions: 4}},
+	}
+
+	old := newTestServer(t, conf)
+	startHandoff(t, old)
+
+	primary, replica := listenBackend(t), listenBackend(t)
+	conn := newTestConn(t, old, primary, "10.0.0.1")
+	openTestReplica(t, conn, replica)
+
+	taker := takeOverHandoff(t, conf)
+
+	select {
+	case <-old.HandedOff():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the sessions were not handed off")
+	}
+
+	if _, exists := old.getConn(conn.id); exists {
+		t.Error("the session stayed with the previous process")
+	}
+	if n := old.getBackendSessions(replica).Len(); n != 0 {
+		t.Errorf("replica sessions = %d after the handoff, want 0", n)
+	}
+
+	// the replica connections are opened again by the new process once reads are routed to them
+	taken, exists := taker.getConn(conn.id)
+	if !exists {
+		t.Fatal("the session was not taken over")
+	}
+	if taken.identity != conn.identity || taken.replicaNum() != 0 {
+		t.Errorf("taken over session identity %s with %d replicas", taken.identity, taken.replicaNum())
+	}
+	taken.close()
+}
+
+func TestHandOffRunningCommand(t *testing.T) {
+	conf := &Config{
+		DrainTimeout:  time.Second,
+		HandoffSocket: filepath.Join(t.TempDir(), "handoff.sock"),
+	}
+
+	old := newTestServer(t, conf)
+	startHandoff(t, old)
+
+	backend := listenBackend(t)
+	idle := newTestConn(t, old, backend, "10.0.0.1")
+	running := newTestConn(t, old, backend, "10.0.0.1")
+	atomic.StoreUint64(&running.runningCommand, 1)
+
+	taker := takeOverHandoff(t, conf)
+
+	// the command finishes in the previous process, which closes the session then
+	atomic.StoreUint64(&running.runningCommand, 0)
+	select {
+	case <-old.HandedOff():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the sessions were not handed off")
+	}
+	if _, exists := old.getConn(running.id); exists {
+		t.Error("the running session outlived the handoff")
+	}
+
+	if _, exists := taker.getConn(idle.id); !exists {
+		t.Error("the idle session was not taken over")
+	}
+	if _, exists := taker.getConn(running.id); exists {
+		t.Fatal("the session of the running command was taken over")
+	}
+
+	// the next command of the session learns it ended rather than that it is unknown
+	rec := postTransport(taker, running.id, "\x03SELECT 1")
+	if body := rec.Body.String(); !strings.Contains(body, `"code":1053`) {
+		t.Errorf("HandleTransport() of the ended session = %s, want ER_SERVER_SHUTDOWN", body)
+	}
+}
+
+func TestHandOffNonces(t *testing.T) {
+	conf := &Config{
+		DrainTimeout:  time.Second,
+		HandoffSocket: filepath.Join(t.TempDir(), "handoff.sock"),
+		EncryptionKey: testEncryptionKey,
+	}
+
+	old := newTestServer(t, conf)
+	startHandoff(t, old)
+
+	sealed, err := old.envelope.Seal("/transport", []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.envelope.Open("/transport", sealed); err != nil {
+		t.Fatal(err)
+	}
+
+	taker := takeOverHandoff(t, conf)
+
+	// a request the previous process answered is not answered again by the new one
+	if _, err := taker.envelope.Open("/transport", sealed); err != ErrSealedReplayed {
+		t.Errorf("Open() of a payload opened before the handoff error = %v, want %v", err, ErrSealedReplayed)
+	}
+}
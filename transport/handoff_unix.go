@@ -0,0 +1,72 @@
+//go:build !windows
+
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// sendFiles passes the descriptors of the files over the unix socket
+func sendFiles(conn *net.UnixConn, files []*os.File) error {
+	for start := 0; start < len(files); start += handoffBatchSize {
+		end := start + handoffBatchSize
+		if end > len(files) {
+			end = len(files)
+		}
+
+		fds := make([]int, 0, end-start)
+		for _, file := range files[start:end] {
+			fds = append(fds, int(file.Fd()))
+		}
+
+		if _, _, err := conn.WriteMsgUnix([]byte{byte(len(fds))}, syscall.UnixRights(fds...), nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recvFiles receives n descriptors passed over the unix socket
+func recvFiles(conn *net.UnixConn, n int) ([]*os.File, error) {
+	files := make([]*os.File, 0, n)
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(handoffBatchSize*4))
+
+	for len(files) < n {
+		_, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+
+		received := 0
+		for _, msg := range msgs {
+			fds, err := syscall.ParseUnixRights(&msg)
+			if err != nil {
+				continue
+			}
+			for _, fd := range fds {
+				files = append(files, os.NewFile(uintptr(fd), fmt.Sprintf("handoff-%d", len(files))))
+			}
+			received += len(fds)
+		}
+
+		if received == 0 {
+			closeFiles(files)
+			return nil, errors.New("the handoff message carries no descriptors")
+		}
+	}
+
+	return files, nil
+}
@@ -0,0 +1,17 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+var errHandoffUnsupported = errors.New("handing sessions off is not supported on windows")
+
+func sendFiles(conn *net.UnixConn, files []*os.File) error {
+	return errHandoffUnsupported
+}
+
+func recvFiles(conn *net.UnixConn, n int) ([]*os.File, error) {
+	return nil, errHandoffUnsupported
+}
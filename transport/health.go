@@ -0,0 +1,149 @@
+package transport
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Orlion/hersql/log"
+	"github.com/Orlion/hersql/mysql"
+)
+
+// the roles of the addresses of a backend
+const (
+	RolePrimary  = "primary"
+	RoleFallback = "fallback"
+	RoleReplica  = "replica"
+)
+
+// HealthCheck checks the addresses of the backends periodically by connecting,
+// completing the handshake and executing SELECT 1
+type HealthCheck struct {
+	// zero disables the health checks
+	Interval time.Duration `yaml:"interval"`
+	// the timeout of SELECT 1, the connection is bound by dial_timeout and handshake_timeout
+	Timeout time.Duration `yaml:"timeout"`
+	User    string        `yaml:"user"`
+	Passwd  string        `yaml:"passwd"`
+}
+
+func (hc *HealthCheck) init() error {
+	if hc.Interval <= 0 {
+		return nil
+	}
+
+	if hc.User == "" {
+		return errors.New("health_check user cannot be empty")
+	}
+
+	log.AddSecret(hc.Passwd)
+
+	if hc.Timeout == 0 {
+		hc.Timeout = 5 * time.Second
+	}
+
+	return nil
+}
+
+// addrHealth is the state of an address reported by the health checks
+type addrHealth struct {
+	healthy   bool
+	checkedAt time.Time
+	latency   time.Duration
+	err       string
+}
+
+// healthyLocked reports whether the address passed the last health check, addresses not checked yet are healthy
+func (b *Backend) healthyLocked(addr string) bool {
+	health, exists := b.health[addr]
+	return !exists || health.healthy
+}
+
+// addrs returns the addresses of the backend with their roles
+func (b *Backend) addrs() [][2]string {
+	addrs := make([][2]string, 0, 1+len(b.Fallbacks)+len(b.Replicas))
+	addrs = append(addrs, [2]string{b.Primary, RolePrimary})
+	for _, addr := range b.Fallbacks {
+		addrs = append(addrs, [2]string{addr, RoleFallback})
+	}
+	for _, addr := range b.Replicas {
+		addrs = append(addrs, [2]string{addr, RoleReplica})
+	}
+
+	return addrs
+}
+
+func (b *Backend) setHealth(addr string, health *addrHealth) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if prev, exists := b.health[addr]; !exists || prev.healthy != health.healthy {
+		if health.healthy {
+			log.Infow("backend addr healthy", "backend", b.Name, "addr", addr)
+		} else {
+			log.Warnw("backend addr unhealthy", "backend", b.Name, "addr", addr, "error", health.err)
+		}
+	}
+
+	b.health[addr] = health
+}
+
+func (b *Backend) getHealth(addr string) *addrHealth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.health[addr]
+}
+
+// checkBackends checks the addresses of the backends every interval until the server shuts down
+func (s *Server) checkBackends() {
+	ticker := time.NewTicker(s.healthCheck.Interval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, backend := range s.getBackends() {
+			for _, addr := range backend.addrs() {
+				wg.Add(1)
+				go func(backend *Backend, addr string) {
+					defer wg.Done()
+
+					start := time.Now()
+					err := s.checkAddr(addr)
+					health := &addrHealth{healthy: err == nil, checkedAt: start, latency: time.Since(start)}
+					if err != nil {
+						health.err = err.Error()
+					}
+					backend.setHealth(addr, health)
+				}(backend, addr[0])
+			}
+		}
+		wg.Wait()
+
+		select {
+		case <-s.doneChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) checkAddr(addr string) error {
+	conn, err := s.connectSide(addr, s.healthCheck.User, s.healthCheck.Passwd, mysql.DEFAULT_COLLATION_ID)
+	if err != nil {
+		return err
+	}
+	defer s.closeSide(conn)
+
+	conn.rwc.SetDeadline(time.Now().Add(s.healthCheck.Timeout))
+
+	packets, err := conn.transport(append([]byte{mysql.COM_QUERY}, "SELECT 1"...))
+	if err != nil {
+		return err
+	}
+
+	if packets[0][0] == mysql.ERR_HEADER {
+		return conn.handleErrorPacket(packets[0])
+	}
+
+	return nil
+}
@@ -0,0 +1,275 @@
+package transport
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/Orlion/hersql/mysql"
+)
+
+// the masking methods
+const (
+	MaskHash    = "hash"
+	MaskPartial = "partial"
+	MaskNull    = "null"
+)
+
+// MaskingRule masks the values of the columns matching the pattern in the rows relayed to the client.
+// The columns are told by their definitions in the resultset, the values of computed columns are not masked
+type MaskingRule struct {
+	// database.table.column pattern, e.g. *.users.email or *.*.phone
+	Column string `yaml:"column"`
+	// hash replaces the value with its hmac-sha256 under the masking key, partial keeps the first keep_prefix and the last keep_suffix
+	// characters and replaces the others with '*', null replaces the value with NULL.
+	// Values of columns which are neither strings nor blobs are always replaced with NULL
+	Method     string `yaml:"method"`
+	KeepPrefix int    `yaml:"keep_prefix"`
+	KeepSuffix int    `yaml:"keep_suffix"`
+
+	database string
+	table    string
+	column   string
+	// the masking key of the hash method
+	key []byte
+}
+
+func (r *MaskingRule) init() error {
+	parts := strings.Split(r.Column, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("masking column %s must be in the format database.table.column", r.Column)
+	}
+
+	for _, part := range parts {
+		if _, err := path.Match(part, ""); err != nil {
+			return fmt.Errorf("masking column %s is not a valid pattern: %w", r.Column, err)
+		}
+	}
+
+	r.database, r.table, r.column = parts[0], parts[1], parts[2]
+
+	switch r.Method {
+	case MaskHash, MaskPartial, MaskNull:
+	default:
+		return fmt.Errorf("masking method %s is not supported, please use %s, %s or %s", r.Method, MaskHash, MaskPartial, MaskNull)
+	}
+
+	return nil
+}
+
+// maskingKey returns the key of the hmac the hash masking method replaces the values with. An unkeyed hash of values
+// such as phone numbers is reversed by hashing the candidates, so the rules of the method require a key
+func (s *Server) maskingKey(conf *Config) ([]byte, error) {
+	key := conf.MaskingKey
+	if conf.MaskingKeySecret != "" {
+		secret, err := s.resolveSecret(conf.MaskingKeySecret)
+		if err != nil {
+			return nil, fmt.Errorf("masking_key_secret %s error: %w", conf.MaskingKeySecret, err)
+		}
+		key = secret
+	}
+
+	if key == "" {
+		for _, rule := range conf.Masking {
+			if rule.Method == MaskHash {
+				return nil, errors.New("masking method hash requires masking_key or masking_key_secret")
+			}
+		}
+	}
+
+	return []byte(key), nil
+}
+
+// match matches both the original names and the aliases, so renaming a masked column with an alias does not
+// hide it. Computed columns such as CONCAT(email) have no original names, they are only masked if their alias matches,
+// the rules do not stop a client who may run arbitrary queries from reading the values
+func (r *MaskingRule) match(def *columnDefinition) bool {
+	matchName := func(table, column string) bool {
+		return table != "" && column != "" &&
+			matchPattern(r.database, def.schema) && matchPattern(r.table, table) && matchPattern(r.column, column)
+	}
+
+	return matchName(def.orgTable, def.orgName) || matchName(def.table, def.name)
+}
+
+// appendMasked appends the masked value as a length encoded string, or NULL
+func (r *MaskingRule) appendMasked(data []byte, value []byte, def *columnDefinition) []byte {
+	method := r.Method
+	if !def.isString() {
+		method = MaskNull
+	}
+
+	switch method {
+	case MaskHash:
+		mac := hmac.New(sha256.New, r.key)
+		mac.Write(value)
+		masked := hex.EncodeToString(mac.Sum(nil))
+		data = mysql.AppendLengthEncodedInteger(data, uint64(len(masked)))
+		return append(data, masked...)
+	case MaskPartial:
+		runes := []rune(string(value))
+		// values too short to keep anything are masked completely
+		keep := len(runes) > r.KeepPrefix+r.KeepSuffix
+		for i := range runes {
+			if keep && (i < r.KeepPrefix || i >= len(runes)-r.KeepSuffix) {
+				continue
+			}
+			runes[i] = '*'
+		}
+		masked := string(runes)
+		data = mysql.AppendLengthEncodedInteger(data, uint64(len(masked)))
+		return append(data, masked...)
+	default:
+		return append(data, 0xfb)
+	}
+}
+
+// columnDefinition is the part of Protocol::ColumnDefinition41 the masking rules need
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_com_query_response_text_resultset_column_definition.html
+type columnDefinition struct {
+	schema   string
+	table    string
+	orgTable string
+	name     string
+	orgName  string
+	typ      byte
+	flags    uint16
+	// the position of the flags in the packet
+	flagsPos int
+}
+
+func parseColumnDefinition(data []byte) (*columnDefinition, error) {
+	def := new(columnDefinition)
+
+	// catalog, schema, table, org_table, name, org_name
+	var fields [6][]byte
+	pos := 0
+	for i := range fields {
+		if pos >= len(data) {
+			return nil, ErrMalformPkt
+		}
+
+		field, _, n, err := mysql.LengthEncodedString(data[pos:])
+		if err != nil {
+			return nil, ErrMalformPkt
+		}
+		fields[i] = field
+		pos += n
+	}
+
+	def.schema = string(fields[1])
+	def.table = string(fields[2])
+	def.orgTable = string(fields[3])
+	def.name = string(fields[4])
+	def.orgName = string(fields[5])
+
+	// length of fixed length fields, character set, column length
+	pos += 1 + 2 + 4
+	if pos+3 > len(data) {
+		return nil, ErrMalformPkt
+	}
+
+	def.typ = data[pos]
+	pos++
+
+	def.flagsPos = pos
+	def.flags = binary.LittleEndian.Uint16(data[pos:])
+
+	return def, nil
+}
+
+func (def *columnDefinition) isString() bool {
+	switch def.typ {
+	case mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_VAR_STRING, mysql.MYSQL_TYPE_STRING,
+		mysql.MYSQL_TYPE_TINY_BLOB, mysql.MYSQL_TYPE_MEDIUM_BLOB, mysql.MYSQL_TYPE_LONG_BLOB, mysql.MYSQL_TYPE_BLOB,
+		mysql.MYSQL_TYPE_ENUM, mysql.MYSQL_TYPE_SET, mysql.MYSQL_TYPE_JSON:
+		return true
+	default:
+		return false
+	}
+}
+
+// resultsetMasker masks the rows of a resultset, rules holds the masking rule of every column, nil if not masked
+type resultsetMasker struct {
+	defs  []*columnDefinition
+	rules []*MaskingRule
+}
+
+// addColumn registers the column definition and returns the packet relayed to the client,
+// masked columns may become NULL so they lose the NOT NULL flag
+func (m *resultsetMasker) addColumn(packet []byte, rules []*MaskingRule) ([]byte, error) {
+	def, err := parseColumnDefinition(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	var rule *MaskingRule
+	for _, r := range rules {
+		if r.match(def) {
+			rule = r
+			break
+		}
+	}
+
+	m.defs = append(m.defs, def)
+	m.rules = append(m.rules, rule)
+
+	if rule == nil || def.flags&mysql.NOT_NULL_FLAG == 0 {
+		return packet, nil
+	}
+
+	masked := append([]byte(nil), packet...)
+	binary.LittleEndian.PutUint16(masked[def.flagsPos:], def.flags&^mysql.NOT_NULL_FLAG)
+
+	return masked, nil
+}
+
+func (m *resultsetMasker) masking() bool {
+	for _, rule := range m.rules {
+		if rule != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// maskTextRow masks a row of the text protocol, every value is a length encoded string or 0xFB for NULL,
+// the lengths are encoded again so the packet stays consistent
+func (m *resultsetMasker) maskTextRow(row []byte) ([]byte, error) {
+	data := make([]byte, 0, len(row))
+
+	pos := 0
+	for i, rule := range m.rules {
+		if pos >= len(row) {
+			return nil, ErrMalformPkt
+		}
+
+		// NULL
+		if row[pos] == 0xfb {
+			data = append(data, 0xfb)
+			pos++
+			continue
+		}
+
+		value, _, n, err := mysql.LengthEncodedString(row[pos:])
+		if err != nil {
+			return nil, ErrMalformPkt
+		}
+
+		if rule == nil {
+			data = append(data, row[pos:pos+n]...)
+		} else {
+			data = rule.appendMasked(data, value, m.defs[i])
+		}
+
+		pos += n
+	}
+
+	return data, nil
+}
@@ -0,0 +1,241 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"github.com/Orlion/hersql/mysql"
+)
+
+// columnPacket builds a ColumnDefinition41 packet
+func columnPacket(schema, table, orgTable, name, orgName string, typ byte, flags uint16) []byte {
+	var data []byte
+	for _, field := range []string{"def", schema, table, orgTable, name, orgName} {
+		data = mysql.AppendLengthEncodedInteger(data, uint64(len(field)))
+		data = append(data, field...)
+	}
+
+	// length of fixed length fields, character set, column length
+	data = append(data, 0x0c, 33, 0, 0, 1, 0, 0)
+	data = append(data, typ)
+	data = binary.LittleEndian.AppendUint16(data, flags)
+	// decimals, filler
+	return append(data, 0, 0, 0)
+}
+
+// textRow builds a row of the text protocol, nil values are NULL
+func textRow(values ...[]byte) []byte {
+	var data []byte
+	for _, value := range values {
+		if value == nil {
+			data = append(data, 0xfb)
+			continue
+		}
+		data = mysql.AppendLengthEncodedInteger(data, uint64(len(value)))
+		data = append(data, value...)
+	}
+
+	return data
+}
+
+const testMaskingKey = "masking key"
+
+func hashOf(value string) string {
+	mac := hmac.New(sha256.New, []byte(testMaskingKey))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestMaskingRuleInit(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    MaskingRule
+		wantErr bool
+	}{
+		{"valid", MaskingRule{Column: "*.users.email", Method: MaskHash}, false},
+		{"partial", MaskingRule{Column: "blog.*.phone", Method: MaskPartial, KeepPrefix: 2}, false},
+		{"null", MaskingRule{Column: "*.*.ssn", Method: MaskNull}, false},
+		{"two parts", MaskingRule{Column: "users.email", Method: MaskHash}, true},
+		{"bad pattern", MaskingRule{Column: "*.[users.email", Method: MaskHash}, true},
+		{"unknown method", MaskingRule{Column: "*.users.email", Method: "shuffle"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rule.init(); (err != nil) != tt.wantErr {
+				t.Errorf("init() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMaskingRuleMatch(t *testing.T) {
+	rule := &MaskingRule{Column: "*.users.email", Method: MaskHash}
+	if err := rule.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		packet []byte
+		want   bool
+	}{
+		{"original names", columnPacket("blog", "users", "users", "email", "email", mysql.MYSQL_TYPE_VAR_STRING, 0), true},
+		{"aliased column", columnPacket("blog", "u", "users", "contact", "email", mysql.MYSQL_TYPE_VAR_STRING, 0), true},
+		{"alias matching", columnPacket("blog", "users", "accounts", "email", "mail", mysql.MYSQL_TYPE_VAR_STRING, 0), true},
+		{"other column", columnPacket("blog", "users", "users", "name", "name", mysql.MYSQL_TYPE_VAR_STRING, 0), false},
+		{"other table", columnPacket("blog", "posts", "posts", "email", "email", mysql.MYSQL_TYPE_VAR_STRING, 0), false},
+		// computed columns carry no original names, only their alias can match
+		{"computed column", columnPacket("", "", "", "CONCAT(email)", "", mysql.MYSQL_TYPE_VAR_STRING, 0), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			def, err := parseColumnDefinition(tt.packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := rule.match(def); got != tt.want {
+				t.Errorf("match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaskingRuleAppendMasked(t *testing.T) {
+	text := &columnDefinition{typ: mysql.MYSQL_TYPE_VAR_STRING}
+	number := &columnDefinition{typ: mysql.MYSQL_TYPE_LONG}
+
+	tests := []struct {
+		name  string
+		rule  MaskingRule
+		value string
+		def   *columnDefinition
+		want  []byte
+	}{
+		{"hash", MaskingRule{Method: MaskHash, key: []byte(testMaskingKey)}, "a@b.c", text, textRow([]byte(hashOf("a@b.c")))},
+		{"partial", MaskingRule{Method: MaskPartial, KeepPrefix: 2, KeepSuffix: 4}, "alice@mail.com", text, textRow([]byte("al********.com"))},
+		{"partial multibyte", MaskingRule{Method: MaskPartial, KeepPrefix: 1, KeepSuffix: 1}, "张三丰", text, textRow([]byte("张*丰"))},
+		{"partial too short", MaskingRule{Method: MaskPartial, KeepPrefix: 2, KeepSuffix: 2}, "abcd", text, textRow([]byte("****"))},
+		{"null", MaskingRule{Method: MaskNull}, "secret", text, textRow(nil)},
+		{"not a string", MaskingRule{Method: MaskPartial, KeepPrefix: 1}, "12345", number, textRow(nil)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.rule.appendMasked(nil, []byte(tt.value), tt.def)
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("appendMasked() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaskingKey(t *testing.T) {
+	t.Setenv("HERSQL_TEST_MASKING_KEY", "key of the provider")
+	providers := []*SecretProviderConfig{{Name: "env", Type: SecretProviderEnv, Prefix: "HERSQL_TEST_"}}
+	hash := []*MaskingRule{{Column: "*.*.phone", Method: MaskHash}}
+	partial := []*MaskingRule{{Column: "*.*.phone", Method: MaskPartial}}
+
+	tests := []struct {
+		name    string
+		conf    *Config
+		want    string
+		wantErr bool
+	}{
+		{"key", &Config{Masking: hash, MaskingKey: testMaskingKey}, testMaskingKey, false},
+		{"secret", &Config{Masking: hash, MaskingKey: testMaskingKey, MaskingKeySecret: "env:MASKING_KEY", SecretProviders: providers}, "key of the provider", false},
+		{"unknown secret", &Config{Masking: hash, MaskingKeySecret: "env:NO_KEY", SecretProviders: providers}, "", true},
+		// the values could be told from an unkeyed hash by hashing the candidates
+		{"hash without a key", &Config{Masking: hash}, "", true},
+		{"no hash rule", &Config{Masking: partial}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewServer(tt.conf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewServer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if key := string(tt.conf.Masking[0].key); key != tt.want {
+				t.Errorf("masking key = %q, want %q", key, tt.want)
+			}
+		})
+	}
+}
+
+func TestResultsetMasker(t *testing.T) {
+	rules := []*MaskingRule{
+		{Column: "*.users.email", Method: MaskPartial, KeepPrefix: 1, KeepSuffix: 1},
+		{Column: "*.*.phone", Method: MaskNull},
+	}
+	for _, rule := range rules {
+		if err := rule.init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	masker := new(resultsetMasker)
+	columns := []struct {
+		packet      []byte
+		wantNotNull bool
+	}{
+		{columnPacket("blog", "users", "users", "id", "id", mysql.MYSQL_TYPE_LONG, mysql.NOT_NULL_FLAG), true},
+		// masked columns may become NULL, they lose the NOT NULL flag
+		{columnPacket("blog", "users", "users", "email", "email", mysql.MYSQL_TYPE_VAR_STRING, mysql.NOT_NULL_FLAG), false},
+		{columnPacket("blog", "users", "users", "phone", "phone", mysql.MYSQL_TYPE_VAR_STRING, 0), false},
+	}
+	for i, column := range columns {
+		packet, err := masker.addColumn(column.packet, rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		def, err := parseColumnDefinition(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if notNull := def.flags&mysql.NOT_NULL_FLAG > 0; notNull != column.wantNotNull {
+			t.Errorf("column %d NOT NULL = %v, want %v", i, notNull, column.wantNotNull)
+		}
+	}
+
+	if !masker.masking() {
+		t.Fatal("masking() = false, want true")
+	}
+
+	tests := []struct {
+		name string
+		row  []byte
+		want []byte
+	}{
+		{"masked", textRow([]byte("7"), []byte("bob@mail"), []byte("555-0100")), textRow([]byte("7"), []byte("b******l"), nil)},
+		{"nulls", textRow(nil, nil, nil), textRow(nil, nil, nil)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := masker.maskTextRow(tt.row)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("maskTextRow() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := masker.maskTextRow(textRow([]byte("7"))); err != ErrMalformPkt {
+		t.Errorf("maskTextRow() of a short row error = %v, want %v", err, ErrMalformPkt)
+	}
+}
@@ -0,0 +1,80 @@
+package transport
+
+import (
+	"path"
+
+	"github.com/Orlion/hersql/mysql"
+)
+
+// Policy restricts the statements a session may execute on the backend,
+// the first policy matching the backend address and user of a session applies
+type Policy struct {
+	// backend address pattern, e.g. 10.10.123.*:3306, empty matches every backend
+	Addr string `yaml:"addr"`
+	// backend user pattern, empty matches every user
+	User string `yaml:"user"`
+	// sidecar identity pattern, empty matches every identity
+	Identity string `yaml:"identity"`
+	// only allow reads and session statements such as SET, USE and transactions
+	ReadOnly bool `yaml:"read_only"`
+	// deny CREATE, ALTER, DROP, TRUNCATE and RENAME
+	DenyDDL bool `yaml:"deny_ddl"`
+	// deny DROP and TRUNCATE
+	DenyDropTruncate bool `yaml:"deny_drop_truncate"`
+	// deny UPDATE and DELETE without a WHERE clause
+	DenyUpdateDeleteWithoutWhere bool `yaml:"deny_update_delete_without_where"`
+}
+
+func (p *Policy) match(addr, user, identity string) bool {
+	return matchPattern(p.Addr, addr) && matchPattern(p.User, user) && matchPattern(p.Identity, identity)
+}
+
+func matchPattern(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	matched, err := path.Match(pattern, s)
+	return err == nil && matched
+}
+
+// check returns the error the client receives if the command packet is not allowed,
+// noBackslashEscapes is the NO_BACKSLASH_ESCAPES sql mode of the session
+func (p *Policy) check(packet []byte, noBackslashEscapes bool) *mysql.SqlError {
+	switch packet[0] {
+	case mysql.COM_QUERY:
+	case mysql.COM_SET_OPTION:
+		// the sessions under a policy run one statement per query, see HandleConnect
+		return mysql.NewError(mysql.ER_SPECIFIC_ACCESS_DENIED_ERROR, "Access denied; the hersql transport policy does not allow multiple statements")
+	default:
+		return nil
+	}
+
+	for _, st := range ClassifyStatements(string(packet[1:]), noBackslashEscapes) {
+		if err := p.checkStatement(st); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *Policy) checkStatement(st *Statement) *mysql.SqlError {
+	if p.ReadOnly && st.Type != StatementRead && st.Type != StatementSession {
+		return mysql.NewError(mysql.ER_OPTION_PREVENTS_STATEMENT, "The hersql transport is running with a read-only policy so it cannot execute this statement")
+	}
+
+	if p.DenyDDL && st.Type == StatementDDL {
+		return mysql.NewError(mysql.ER_SPECIFIC_ACCESS_DENIED_ERROR, "Access denied; the hersql transport policy does not allow DDL statements")
+	}
+
+	if p.DenyDropTruncate && (st.Verb == "DROP" || st.Verb == "TRUNCATE") {
+		return mysql.NewError(mysql.ER_SPECIFIC_ACCESS_DENIED_ERROR, "Access denied; the hersql transport policy does not allow DROP and TRUNCATE statements")
+	}
+
+	if p.DenyUpdateDeleteWithoutWhere && (st.Verb == "UPDATE" || st.Verb == "DELETE") && !st.HasWhere {
+		return mysql.NewError(mysql.ER_UPDATE_WITHOUT_KEY_IN_SAFE_MODE, "The hersql transport policy does not allow UPDATE and DELETE statements without a WHERE clause")
+	}
+
+	return nil
+}
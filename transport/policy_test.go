@@ -0,0 +1,49 @@
+package transport
+
+import (
+	"testing"
+
+	"github.com/Orlion/hersql/mysql"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	readOnly := &Policy{ReadOnly: true}
+	safeUpdates := &Policy{DenyUpdateDeleteWithoutWhere: true}
+
+	query := func(query string) []byte {
+		return append([]byte{mysql.COM_QUERY}, query...)
+	}
+
+	tests := []struct {
+		name               string
+		policy             *Policy
+		packet             []byte
+		noBackslashEscapes bool
+		// the error code expected, zero if allowed
+		want uint16
+	}{
+		{"read", readOnly, query("SELECT 1"), false, 0},
+		{"write", readOnly, query("DELETE FROM t WHERE id = 1"), false, mysql.ER_OPTION_PREVENTS_STATEMENT},
+		{"second statement", readOnly, query("SELECT 1; DROP TABLE t"), false, mysql.ER_OPTION_PREVENTS_STATEMENT},
+		{"statement after a backslash", readOnly, query(`SELECT '\'; DROP TABLE t; -- '`), true, mysql.ER_OPTION_PREVENTS_STATEMENT},
+		{"escaped quote", readOnly, query(`SELECT '\'; DROP TABLE t; -- '`), false, 0},
+		{"where after a backslash", safeUpdates, query(`UPDATE t SET a = '\' WHERE id = 1 -- '`), true, 0},
+		{"where in a literal", safeUpdates, query(`UPDATE t SET a = '\' WHERE id = 1 -- '`), false, mysql.ER_UPDATE_WITHOUT_KEY_IN_SAFE_MODE},
+		// COM_SET_OPTION would turn multiple statements on again
+		{"multiple statements on", readOnly, []byte{mysql.COM_SET_OPTION, 0, 0}, false, mysql.ER_SPECIFIC_ACCESS_DENIED_ERROR},
+		{"init db", readOnly, append([]byte{mysql.COM_INIT_DB}, "blog"...), false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got uint16
+			if err := tt.policy.check(tt.packet, tt.noBackslashEscapes); err != nil {
+				got = err.Code
+			}
+
+			if got != tt.want {
+				t.Errorf("check() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
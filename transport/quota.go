@@ -0,0 +1,187 @@
+package transport
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+
+	"github.com/Orlion/hersql/mysql"
+	"github.com/Orlion/hersql/pkg/ratelimit"
+)
+
+// Quota limits the sessions and the traffic of a sidecar identity,
+// the first quota matching the identity applies
+type Quota struct {
+	// identity pattern, e.g. 10.10.123.*, empty matches every identity
+	Identity string `yaml:"identity"`
+	// zero means no limit
+	MaxSessions          int     `yaml:"max_sessions"`
+	MaxCommandsPerSecond float64 `yaml:"max_commands_per_second"`
+	MaxBytesPerSecond    float64 `yaml:"max_bytes_per_second"`
+}
+
+// quotaUsage is the usage of the quota by an identity
+type quotaUsage struct {
+	quota    *Quota
+	sessions int
+	commands *ratelimit.Limiter
+	bytes    *ratelimit.Limiter
+}
+
+// identity returns the identity of the sidecar sending the request, the subject of its verified
+// client certificate or else its source ip
+func (s *Server) identity(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return certIdentity(r.TLS.VerifiedChains[0][0])
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// ownsConn reports whether the sidecar sending the request created the conn, sidecars authenticated
+// by their client certificates only reach their own conns, source ips are not trusted for that
+func (s *Server) ownsConn(r *http.Request, conn *Conn) bool {
+	return !s.clientAuth || s.identity(r) == conn.identity
+}
+
+// isAdmin reports whether the request carries the admin token, it reaches the conns of every sidecar
+func (s *Server) isAdmin(r *http.Request) bool {
+	token := r.PostFormValue(AdminTokenField)
+	return s.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1
+}
+
+// getQuotaUsageLocked returns the usage of the identity, nil if no quota applies to it
+func (s *Server) getQuotaUsageLocked(identity string) *quotaUsage {
+	if usage, exists := s.quotaUsages[identity]; exists {
+		return usage
+	}
+
+	usage := s.newQuotaUsageLocked(identity)
+	if usage != nil {
+		// the identities come and go, e.g. the source ips of the sidecars, the usages they left are dropped
+		// as a new one comes
+		for other, idle := range s.quotaUsages {
+			if idle.idle() {
+				delete(s.quotaUsages, other)
+			}
+		}
+		s.quotaUsages[identity] = usage
+	}
+
+	return usage
+}
+
+// idle reports whether the identity has no session and its rates are fully refilled,
+// a fresh usage would then behave the same
+func (u *quotaUsage) idle() bool {
+	return u.sessions == 0 && (u.commands == nil || u.commands.Full()) && (u.bytes == nil || u.bytes.Full())
+}
+
+// newQuotaUsageLocked returns a fresh usage of the quota matching the identity, nil if no quota applies to it
+func (s *Server) newQuotaUsageLocked(identity string) *quotaUsage {
+	var quota *Quota
+	for _, q := range s.quotas {
+		if matchPattern(q.Identity, identity) {
+			quota = q
+			break
+		}
+	}
+
+	if quota == nil {
+		return nil
+	}
+
+	usage := &quotaUsage{quota: quota}
+	if quota.MaxCommandsPerSecond > 0 {
+		usage.commands = ratelimit.NewLimiter(quota.MaxCommandsPerSecond, math.Max(quota.MaxCommandsPerSecond, 1))
+	}
+	if quota.MaxBytesPerSecond > 0 {
+		usage.bytes = ratelimit.NewLimiter(quota.MaxBytesPerSecond, quota.MaxBytesPerSecond)
+	}
+
+	return usage
+}
+
+// acquireSession reserves a session of the identity, returns the error the client receives if the quota is exhausted
+func (s *Server) acquireSession(identity string) *mysql.SqlError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := s.getQuotaUsageLocked(identity)
+	if usage == nil {
+		return nil
+	}
+
+	if usage.quota.MaxSessions > 0 && usage.sessions >= usage.quota.MaxSessions {
+		return mysql.NewError(mysql.ER_TOO_MANY_USER_CONNECTIONS, fmt.Sprintf("Sidecar %s already has more than %d active sessions", identity, usage.quota.MaxSessions))
+	}
+
+	usage.sessions++
+
+	return nil
+}
+
+func (s *Server) releaseSession(identity string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseSessionLocked(identity)
+}
+
+func (s *Server) releaseSessionLocked(identity string) {
+	usage, exists := s.quotaUsages[identity]
+	if !exists {
+		return
+	}
+
+	if usage.sessions > 0 {
+		usage.sessions--
+	}
+
+	if usage.idle() {
+		delete(s.quotaUsages, identity)
+	}
+}
+
+// allowCommand takes a command and its size from the quota of the identity,
+// returns the error the client receives if the quota is exhausted
+func (s *Server) allowCommand(identity string, size int) *mysql.SqlError {
+	s.mu.Lock()
+	usage := s.getQuotaUsageLocked(identity)
+	s.mu.Unlock()
+
+	if usage == nil {
+		return nil
+	}
+
+	if usage.bytes != nil && !usage.bytes.Available() {
+		return mysql.NewError(mysql.ER_USER_LIMIT_REACHED, fmt.Sprintf("Sidecar %s has exceeded the 'max_bytes_per_second' resource (current value: %v)", identity, usage.quota.MaxBytesPerSecond))
+	}
+
+	if usage.commands != nil && !usage.commands.Allow(1) {
+		return mysql.NewError(mysql.ER_USER_LIMIT_REACHED, fmt.Sprintf("Sidecar %s has exceeded the 'max_commands_per_second' resource (current value: %v)", identity, usage.quota.MaxCommandsPerSecond))
+	}
+
+	if usage.bytes != nil {
+		usage.bytes.Take(float64(size))
+	}
+
+	return nil
+}
+
+// takeBytes takes the size of a response from the quota of the identity, it delays the following commands
+func (s *Server) takeBytes(identity string, size int) {
+	s.mu.Lock()
+	usage := s.getQuotaUsageLocked(identity)
+	s.mu.Unlock()
+
+	if usage != nil && usage.bytes != nil {
+		usage.bytes.Take(float64(size))
+	}
+}
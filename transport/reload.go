@@ -0,0 +1,77 @@
+package transport
+
+// Reload applies the policies, the quotas and the backends of the configuration to the running server
+// without dropping the sessions, the other settings take effect after a restart. An invalid configuration
+// is rejected and the running one is kept
+func (s *Server) Reload(conf *Config) error {
+	if err := withDefaultConf(conf); err != nil {
+		return err
+	}
+
+	running := s.getBackends()
+	backends := make(map[string]*Backend, len(conf.Backends))
+	for _, backend := range conf.Backends {
+		if prev, exists := running[backend.Name]; exists {
+			backend.inheritHealth(prev)
+		}
+		backends[backend.Name] = backend
+	}
+
+	// the sessions keep the backend they were opened on, new sessions use the reloaded one
+	s.confMu.Lock()
+	s.policies = conf.Policies
+	s.backends = backends
+	s.confMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.quotas = conf.Quotas
+	usages := make(map[string]*quotaUsage, len(s.quotaUsages))
+	for identity, usage := range s.quotaUsages {
+		// the sessions of the identity are carried over, the rates start afresh
+		reloaded := s.newQuotaUsageLocked(identity)
+		if reloaded == nil {
+			continue
+		}
+		reloaded.sessions = usage.sessions
+		usages[identity] = reloaded
+	}
+
+	// the sessions of the identities no quota applied to were not counted, they count against the quota applying now
+	for _, conn := range s.conns {
+		if _, counted := s.quotaUsages[conn.identity]; counted {
+			continue
+		}
+
+		usage, exists := usages[conn.identity]
+		if !exists {
+			if usage = s.newQuotaUsageLocked(conn.identity); usage == nil {
+				continue
+			}
+			usages[conn.identity] = usage
+		}
+		usage.sessions += 1 + conn.replicaNum()
+	}
+	s.quotaUsages = usages
+
+	// the policies apply to the running sessions as well
+	for _, conn := range s.conns {
+		conn.setPolicy(s.getPolicy(conn.addr, conn.user, conn.identity))
+	}
+
+	return nil
+}
+
+// inheritHealth takes over the health of the addresses the backend shares with the running one,
+// so a reload does not route sessions to addresses known to be down
+func (b *Backend) inheritHealth(prev *Backend) {
+	prev.mu.Lock()
+	defer prev.mu.Unlock()
+
+	for _, addr := range b.addrs() {
+		if health, exists := prev.health[addr[0]]; exists {
+			b.health[addr[0]] = health
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Orlion/hersql/log"
+	"github.com/Orlion/hersql/mysql"
+)
+
+// replicaFramingCapability are the flags the packets relayed from the replica must be framed by like those of the primary,
+// otherwise the client could not parse them
+var replicaFramingCapability uint32 = mysql.CLIENT_PROTOCOL_41 | mysql.CLIENT_SESSION_TRACK | mysql.CLIENT_DEPRECATE_EOF
+
+// the session statements replayed on the replicas of a conn at most, the reads of conns changing
+// the state of their session more often run on the primary
+const maxSessionStatements = 256
+
+// sessionFunctions return or change the state of the session, reads calling them run on the primary
+var sessionFunctions = map[string]bool{
+	"LAST_INSERT_ID":    true,
+	"FOUND_ROWS":        true,
+	"ROW_COUNT":         true,
+	"CONNECTION_ID":     true,
+	"GET_LOCK":          true,
+	"RELEASE_LOCK":      true,
+	"RELEASE_ALL_LOCKS": true,
+	"IS_FREE_LOCK":      true,
+	"IS_USED_LOCK":      true,
+}
+
+// sessionStatement is a SET or USE statement replayed on the replicas, key is what it sets if it is known
+type sessionStatement struct {
+	query string
+	key   string
+}
+
+// replicaConn is a connection to a replica of the backend of a conn
+type replicaConn struct {
+	conn *Conn
+	// the number of session statements of the conn replayed on the replica
+	applied int
+}
+
+// routable reports whether the command is a read which may run on a replica of the backend
+func (c *Conn) routable(packet []byte) bool {
+	if c.backend == nil || len(c.backend.Replicas) == 0 || c.primaryOnly || packet[0] != mysql.COM_QUERY {
+		return false
+	}
+
+	// within a transaction, explicit or because autocommit is disabled, everything runs on the primary
+	if c.status&mysql.SERVER_STATUS_IN_TRANS > 0 || c.status&mysql.SERVER_STATUS_AUTOCOMMIT == 0 {
+		return false
+	}
+
+	query := string(packet[1:])
+	for _, st := range ClassifyStatements(query, c.noBackslashEscapes()) {
+		// SHOW and EXPLAIN may ask for the state of the session, e.g. SHOW WARNINGS
+		switch st.Verb {
+		case "SELECT", "TABLE", "VALUES":
+		default:
+			return false
+		}
+
+		if st.Type != StatementRead {
+			return false
+		}
+	}
+
+	tokens := tokenize(query, c.noBackslashEscapes())
+	for i, token := range tokens {
+		switch token {
+		// locking reads, SELECT ... INTO @var and @var := ... change the state of the session
+		case "FOR", "LOCK", "INTO", ":":
+			return false
+		default:
+			if sessionFunctions[token] && i+1 < len(tokens) && tokens[i+1] == "(" {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// transportReplica runs the read on a replica, it returns false if the read has to run on the primary.
+// Reads are safe to run twice, so the primary runs the read if the replica failed it
+func (c *Conn) transportReplica(packet []byte) ([][]byte, bool) {
+	addr := c.backend.pickReplica()
+	if addr == "" {
+		return nil, false
+	}
+
+	replica, err := c.getReplica(addr)
+	if err != nil {
+		log.Warnw("conn replica unavailable, read on the primary", "connId", c.id, "replica", addr, "error", err.Error())
+		return nil, false
+	}
+
+	c.setRouted(replica.conn)
+	defer c.setRouted(nil)
+
+	start := time.Now()
+	packets, err := replica.conn.transport(packet)
+	if err != nil {
+		log.Warnw("conn replica read error occurred, read on the primary", "connId", c.id, "replica", addr, "error", err.Error())
+		c.dropReplica(addr)
+		return nil, false
+	}
+
+	c.backend.observe(addr, time.Since(start))
+
+	log.Debugw("conn read routed to replica", "connId", c.id, "replica", addr)
+
+	return packets, true
+}
+
+// getReplica returns the connection to the replica, opening it if needed, with the session statements replayed
+func (c *Conn) getReplica(addr string) (*replicaConn, error) {
+	c.replicasMu.Lock()
+	replica, exists := c.replicas[addr]
+	c.replicasMu.Unlock()
+
+	if !exists {
+		// replica connections count against the session caps and the quota of the sidecar like the sessions
+		if !c.server.acquireSideSlots(addr, c.identity) {
+			return nil, errors.New("the session caps or the quota of the sidecar are exhausted")
+		}
+
+		conn, err := c.server.connect(addr, c.user, c.passwd, c.dbname, c.collation, c.clientCapability)
+		if err != nil {
+			c.server.releaseSideSlots(addr, c.identity)
+			return nil, err
+		}
+
+		if mismatch := (conn.relayedCapability() ^ c.relayedCapability()) & replicaFramingCapability; mismatch > 0 {
+			c.closeReplica(conn)
+			return nil, fmt.Errorf("the replica does not support the capability flags %d negotiated by the primary", mismatch)
+		}
+
+		conn.policy.Store(c.policy.Load())
+		conn.identity = c.identity
+
+		replica = &replicaConn{conn: conn}
+
+		c.replicasMu.Lock()
+		c.replicas[addr] = replica
+		c.replicasMu.Unlock()
+	}
+
+	for ; replica.applied < len(c.sessionStatements); replica.applied++ {
+		statement := c.sessionStatements[replica.applied].query
+		if err := replica.conn.exec(statement); err != nil {
+			c.dropReplica(addr)
+			return nil, fmt.Errorf("replay %s error: %w", statement, err)
+		}
+	}
+
+	return replica, nil
+}
+
+// replicaNum returns the number of the connections to the replicas
+func (c *Conn) replicaNum() int {
+	c.replicasMu.Lock()
+	defer c.replicasMu.Unlock()
+	return len(c.replicas)
+}
+
+func (c *Conn) dropReplica(addr string) {
+	c.replicasMu.Lock()
+	replica, exists := c.replicas[addr]
+	delete(c.replicas, addr)
+	c.replicasMu.Unlock()
+
+	if exists {
+		c.closeReplica(replica.conn)
+	}
+}
+
+func (c *Conn) closeReplicas() {
+	c.replicasMu.Lock()
+	replicas := c.replicas
+	c.replicas = make(map[string]*replicaConn)
+	c.replicasMu.Unlock()
+
+	for _, replica := range replicas {
+		c.closeReplica(replica.conn)
+	}
+}
+
+// closeReplica closes the replica connection and releases its slots
+func (c *Conn) closeReplica(conn *Conn) {
+	conn.close()
+	c.server.releaseSideSlots(conn.addr, c.identity)
+}
+
+// setRouted sets the replica connection running the current command, kills are aimed at it
+func (c *Conn) setRouted(conn *Conn) {
+	c.replicasMu.Lock()
+	defer c.replicasMu.Unlock()
+	c.routed = conn
+}
+
+func (c *Conn) getRouted() *Conn {
+	c.replicasMu.Lock()
+	defer c.replicasMu.Unlock()
+	return c.routed
+}
+
+// setPolicy changes the policy of the conn and of its replica connections
+func (c *Conn) setPolicy(policy *Policy) {
+	c.policy.Store(policy)
+
+	c.replicasMu.Lock()
+	defer c.replicasMu.Unlock()
+	for _, replica := range c.replicas {
+		replica.conn.policy.Store(policy)
+	}
+}
+
+// recordSessionStatement records the SET and USE statements which succeeded on the primary,
+// they are replayed on the replicas so the reads see the same session state
+func (c *Conn) recordSessionStatement(packet []byte, packets [][]byte) {
+	if c.backend == nil || len(c.backend.Replicas) == 0 {
+		return
+	}
+
+	for _, p := range packets {
+		if p[0] != mysql.OK_HEADER {
+			return
+		}
+	}
+
+	switch packet[0] {
+	case mysql.COM_INIT_DB:
+		c.addSessionStatement("USE `"+strings.ReplaceAll(string(packet[1:]), "`", "``")+"`", "USE")
+	case mysql.COM_QUERY:
+		query := string(packet[1:])
+		statements := ClassifyStatements(query, c.noBackslashEscapes())
+		for _, st := range statements {
+			if st.Type != StatementSession || (st.Verb != "SET" && st.Verb != "USE") {
+				return
+			}
+		}
+
+		key := ""
+		if len(statements) == 1 {
+			key = sessionStatementKey(query, c.noBackslashEscapes())
+		}
+		c.addSessionStatement(query, key)
+	}
+}
+
+// sessionStatementKey returns what the statement sets: USE for a USE and the variable of a SET of a single variable.
+// A statement supersedes the earlier one of the same key. Other statements have no key and are all replayed
+func sessionStatementKey(query string, noBackslashEscapes bool) string {
+	tokens := tokenize(query, noBackslashEscapes)
+	if len(tokens) > 0 && tokens[len(tokens)-1] == ";" {
+		tokens = tokens[:len(tokens)-1]
+	}
+
+	if len(tokens) > 0 && tokens[0] == "USE" {
+		return "USE"
+	}
+
+	assign := -1
+	for i, token := range tokens {
+		if token == "=" {
+			assign = i
+			break
+		}
+	}
+
+	if assign < 2 || tokens[0] != "SET" {
+		return ""
+	}
+
+	for _, token := range tokens[:assign] {
+		// quoted variables are not told apart by their tokens
+		if token == "?" || token == "," {
+			return ""
+		}
+	}
+
+	depth := 0
+	for _, token := range tokens[assign:] {
+		switch token {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		case ",":
+			// the statement sets several variables
+			if depth == 0 {
+				return ""
+			}
+		}
+	}
+
+	return strings.Join(tokens[:assign], " ")
+}
+
+// addSessionStatement records the statement, dropping the earlier one of the same key
+func (c *Conn) addSessionStatement(statement, key string) {
+	if key != "" {
+		for i, recorded := range c.sessionStatements {
+			if recorded.key != key {
+				continue
+			}
+
+			c.sessionStatements = append(c.sessionStatements[:i], c.sessionStatements[i+1:]...)
+			// the replicas which replayed the dropped statement replay the new one all the same
+			c.replicasMu.Lock()
+			for _, replica := range c.replicas {
+				if replica.applied > i {
+					replica.applied--
+				}
+			}
+			c.replicasMu.Unlock()
+			break
+		}
+	}
+
+	if len(c.sessionStatements) >= maxSessionStatements {
+		log.Warnw("conn changed the session too often to replay it on the replicas, reads run on the primary", "connId", c.id)
+		c.primaryOnly = true
+		c.sessionStatements = nil
+		c.closeReplicas()
+		return
+	}
+
+	c.sessionStatements = append(c.sessionStatements, sessionStatement{query: statement, key: key})
+}
@@ -2,12 +2,30 @@ package transport
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+
+	"github.com/Orlion/hersql/mysql"
 )
 
+// AdminTokenField is the form field of the admin token of the transport
+const AdminTokenField = "admin_token"
+
 type Response struct {
 	Success bool   `json:"status"`
 	Msg     string `json:"msg"`
+	// the mysql error of a failed request, the sidecar relays it to the client as is
+	Code  uint16 `json:"code,omitempty"`
+	State string `json:"state,omitempty"`
+}
+
+// Err returns the error of a failed request
+func (r *Response) Err() error {
+	if r.Code > 0 {
+		return &mysql.SqlError{Code: r.Code, State: r.State, Message: r.Msg}
+	}
+
+	return errors.New(r.Msg)
 }
 
 type ConnectResponse struct {
@@ -16,8 +34,58 @@ type ConnectResponse struct {
 }
 
 type ConnectResponseData struct {
-	Runid  string `json:"runid"`
-	ConnId uint64 `json:"conn_id"`
+	Runid      string `json:"runid"`
+	ConnId     uint64 `json:"conn_id"`
+	Capability uint32 `json:"capability"`
+	// the capability flags the relayed packets are framed by, the framing flags are those the client negotiated
+	RelayCapability  uint32 `json:"relay_capability"`
+	ServerVersion    string `json:"server_version"`
+	ServerCapability uint32 `json:"server_capability"`
+	ServerCollation  uint8  `json:"server_collation"`
+}
+
+type BackendsResponse struct {
+	Response
+	Data []*BackendStatus `json:"data"`
+}
+
+type BackendStatus struct {
+	Name  string        `json:"name"`
+	Addrs []*AddrStatus `json:"addrs"`
+}
+
+// AddrStatus is the state of an address of a backend, addresses not checked yet are healthy
+type AddrStatus struct {
+	Addr      string `json:"addr"`
+	Role      string `json:"role"`
+	Healthy   bool   `json:"healthy"`
+	CheckedAt string `json:"checked_at,omitempty"`
+	Latency   string `json:"latency,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type SessionsResponse struct {
+	Response
+	Data *SessionsResponseData `json:"data"`
+}
+
+type SessionsResponseData struct {
+	Runid    string           `json:"runid"`
+	Sessions []*SessionStatus `json:"sessions"`
+}
+
+// SessionStatus is a session as listed by the hersql sessions command
+type SessionStatus struct {
+	ConnId        uint64 `json:"conn_id"`
+	Addr          string `json:"addr"`
+	Backend       string `json:"backend,omitempty"`
+	User          string `json:"user"`
+	Dbname        string `json:"dbname"`
+	Identity      string `json:"identity"`
+	ThreadId      uint32 `json:"thread_id"`
+	CreateAt      string `json:"create_at"`
+	InTransaction bool   `json:"in_transaction"`
+	Running       bool   `json:"running"`
 }
 
 type TransportResponse struct {
@@ -25,14 +93,19 @@ type TransportResponse struct {
 	Data [][]byte `json:"data"`
 }
 
-func connectResponse(w http.ResponseWriter, runid string, connId uint64) {
+func connectResponse(w http.ResponseWriter, runid string, conn *Conn) {
 	b, err := json.Marshal(&ConnectResponse{
 		Response: Response{
 			Success: true,
 		},
 		Data: &ConnectResponseData{
-			Runid:  runid,
-			ConnId: connId,
+			Runid:            runid,
+			ConnId:           conn.id,
+			Capability:       conn.capability,
+			RelayCapability:  conn.relayedCapability(),
+			ServerVersion:    conn.serverVersion,
+			ServerCapability: conn.serverCapability,
+			ServerCollation:  conn.serverCollation,
 		},
 	})
 	if err != nil {
@@ -53,6 +126,28 @@ func disconnectResponse(w http.ResponseWriter) {
 	w.Write(b)
 }
 
+func killResponse(w http.ResponseWriter) {
+	b, err := json.Marshal(&Response{
+		Success: true,
+	})
+	if err != nil {
+		return
+	}
+
+	w.Write(b)
+}
+
+func pingResponse(w http.ResponseWriter) {
+	b, err := json.Marshal(&Response{
+		Success: true,
+	})
+	if err != nil {
+		return
+	}
+
+	w.Write(b)
+}
+
 func transportResponse(w http.ResponseWriter, data [][]byte) {
 	b, err := json.Marshal(&TransportResponse{
 		Response: Response{
@@ -67,6 +162,50 @@ func transportResponse(w http.ResponseWriter, data [][]byte) {
 	w.Write(b)
 }
 
+func backendsResponse(w http.ResponseWriter, data []*BackendStatus) {
+	b, err := json.Marshal(&BackendsResponse{
+		Response: Response{
+			Success: true,
+		},
+		Data: data,
+	})
+	if err != nil {
+		return
+	}
+
+	w.Write(b)
+}
+
+func sessionsResponse(w http.ResponseWriter, runid string, sessions []*SessionStatus) {
+	b, err := json.Marshal(&SessionsResponse{
+		Response: Response{
+			Success: true,
+		},
+		Data: &SessionsResponseData{
+			Runid:    runid,
+			Sessions: sessions,
+		},
+	})
+	if err != nil {
+		return
+	}
+
+	w.Write(b)
+}
+
+func responseError(w http.ResponseWriter, e *mysql.SqlError) {
+	b, err := json.Marshal(&Response{
+		Msg:   e.Message,
+		Code:  e.Code,
+		State: e.State,
+	})
+	if err != nil {
+		return
+	}
+
+	w.Write(b)
+}
+
 func responseFail(w http.ResponseWriter, msg string) {
 	b, err := json.Marshal(&Response{
 		Msg: msg,
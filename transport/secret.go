@@ -0,0 +1,373 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// the types of the secret providers built into the transport
+const (
+	SecretProviderEnv           = "env"
+	SecretProviderCommand       = "command"
+	SecretProviderFile          = "file"
+	SecretProviderEncryptedFile = "encrypted_file"
+)
+
+// DefaultSecretCacheTTL is how long the secrets printed by a command are reused
+const DefaultSecretCacheTTL = time.Minute
+
+// DefaultSecretCommandTimeout bounds a run of the command of a command provider
+const DefaultSecretCommandTimeout = 10 * time.Second
+
+var ErrSecretNotFound = errors.New("secret not found")
+
+// SecretProvider resolves the passwords of the credentials, a credential refers to its password
+// with passwd_secret as <provider name>:<key>. Secret is called on every connect using the credential,
+// so rotated passwords are picked up without a restart, it returns ErrSecretNotFound for unknown keys
+type SecretProvider interface {
+	Secret(key string) (string, error)
+}
+
+// SecretProviderConfig configures a secret provider, the fields used depend on the type
+type SecretProviderConfig struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	// env: prefix of the environment variables, the key is appended
+	Prefix string `yaml:"prefix"`
+	// command: the command printing the secret, the key is appended as the last argument
+	Command []string `yaml:"command"`
+	// command: how long a printed secret is reused, defaults to 1m
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+	// command: defaults to 10s
+	Timeout time.Duration `yaml:"timeout"`
+	// file and encrypted_file: yaml map of keys to secrets, read again whenever it changes
+	Path string `yaml:"path"`
+	// encrypted_file: the environment variable holding the base64 encoded 32 byte key of the file
+	KeyEnv string `yaml:"key_env"`
+	// options of the providers registered with RegisterSecretProvider
+	Options map[string]string `yaml:"options"`
+}
+
+// SecretProviderFactory builds a secret provider from its configuration
+type SecretProviderFactory func(conf *SecretProviderConfig) (SecretProvider, error)
+
+var (
+	secretProviderFactoriesMu sync.Mutex
+	secretProviderFactories   = map[string]SecretProviderFactory{
+		SecretProviderEnv:           newEnvSecretProvider,
+		SecretProviderCommand:       newCommandSecretProvider,
+		SecretProviderFile:          newFileSecretProvider,
+		SecretProviderEncryptedFile: newEncryptedFileSecretProvider,
+	}
+)
+
+// RegisterSecretProvider makes the secret providers of the type available to the configuration,
+// it must be called before NewServer
+func RegisterSecretProvider(typ string, factory SecretProviderFactory) {
+	secretProviderFactoriesMu.Lock()
+	defer secretProviderFactoriesMu.Unlock()
+	secretProviderFactories[typ] = factory
+}
+
+func newSecretProviders(confs []*SecretProviderConfig) (map[string]SecretProvider, error) {
+	secretProviderFactoriesMu.Lock()
+	defer secretProviderFactoriesMu.Unlock()
+
+	providers := make(map[string]SecretProvider, len(confs))
+	for _, conf := range confs {
+		if conf == nil || conf.Name == "" {
+			return nil, errors.New("secret provider name cannot be empty")
+		}
+
+		if _, exists := providers[conf.Name]; exists {
+			return nil, fmt.Errorf("secret provider name %s is duplicated", conf.Name)
+		}
+
+		factory, exists := secretProviderFactories[conf.Type]
+		if !exists {
+			return nil, fmt.Errorf("secret provider %s type %s is not supported", conf.Name, conf.Type)
+		}
+
+		provider, err := factory(conf)
+		if err != nil {
+			return nil, fmt.Errorf("secret provider %s: %w", conf.Name, err)
+		}
+		providers[conf.Name] = provider
+	}
+
+	return providers, nil
+}
+
+// resolveSecret resolves a reference of the form <provider name>:<key>
+func (s *Server) resolveSecret(ref string) (string, error) {
+	name, key, found := strings.Cut(ref, ":")
+	if !found || key == "" {
+		return "", fmt.Errorf("secret reference %s must be <provider>:<key>", ref)
+	}
+
+	provider, exists := s.secretProviders[name]
+	if !exists {
+		return "", fmt.Errorf("secret provider %s not found", name)
+	}
+
+	return provider.Secret(key)
+}
+
+type envSecretProvider struct {
+	prefix string
+}
+
+func newEnvSecretProvider(conf *SecretProviderConfig) (SecretProvider, error) {
+	return &envSecretProvider{prefix: conf.Prefix}, nil
+}
+
+func (p *envSecretProvider) Secret(key string) (string, error) {
+	secret, exists := os.LookupEnv(p.prefix + key)
+	if !exists {
+		return "", ErrSecretNotFound
+	}
+
+	return secret, nil
+}
+
+// commandSecretProvider runs a command, e.g. a vault cli, and takes its stdout as the secret
+type commandSecretProvider struct {
+	command []string
+	ttl     time.Duration
+	timeout time.Duration
+
+	// guards the cache and the runs in flight, the command runs outside of it
+	mu    sync.Mutex
+	cache map[string]*cachedSecret
+	// the runs of the command in flight by key, the connects needing the same secret wait for the same run
+	calls map[string]*secretCall
+}
+
+type cachedSecret struct {
+	secret    string
+	fetchedAt time.Time
+}
+
+type secretCall struct {
+	done   chan struct{}
+	secret string
+	err    error
+}
+
+func newCommandSecretProvider(conf *SecretProviderConfig) (SecretProvider, error) {
+	if len(conf.Command) == 0 {
+		return nil, errors.New("command cannot be empty")
+	}
+
+	p := &commandSecretProvider{
+		command: conf.Command,
+		ttl:     conf.CacheTTL,
+		timeout: conf.Timeout,
+		cache:   make(map[string]*cachedSecret),
+		calls:   make(map[string]*secretCall),
+	}
+
+	if p.ttl == 0 {
+		p.ttl = DefaultSecretCacheTTL
+	}
+
+	if p.timeout == 0 {
+		p.timeout = DefaultSecretCommandTimeout
+	}
+
+	return p, nil
+}
+
+func (p *commandSecretProvider) Secret(key string) (string, error) {
+	p.mu.Lock()
+	if cached, exists := p.cache[key]; exists && time.Since(cached.fetchedAt) < p.ttl {
+		p.mu.Unlock()
+		return cached.secret, nil
+	}
+
+	if call, exists := p.calls[key]; exists {
+		p.mu.Unlock()
+		<-call.done
+		return call.secret, call.err
+	}
+
+	call := &secretCall{done: make(chan struct{})}
+	p.calls[key] = call
+	p.mu.Unlock()
+
+	// a slow command only holds up the connects needing the same secret
+	call.secret, call.err = p.run(key)
+
+	p.mu.Lock()
+	delete(p.calls, key)
+	if call.err == nil {
+		p.cache[key] = &cachedSecret{secret: call.secret, fetchedAt: time.Now()}
+	}
+	p.mu.Unlock()
+	close(call.done)
+
+	return call.secret, call.err
+}
+
+// run runs the command printing the secret of the key
+func (p *commandSecretProvider) run(key string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	// the key is passed as an argument, it never goes through a shell
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.command[0], append(p.command[1:], key)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("command %s error: %w: %s", p.command[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	secret := strings.TrimRight(stdout.String(), "\r\n")
+	if secret == "" {
+		return "", ErrSecretNotFound
+	}
+
+	return secret, nil
+}
+
+// fileSecretProvider reads a yaml map of keys to secrets and reads it again once its size or modification time changes,
+// so rotated secrets are picked up
+type fileSecretProvider struct {
+	path string
+	// decodes the content of the file before it is parsed
+	decode func(data []byte) ([]byte, error)
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	secrets map[string]string
+}
+
+func newFileSecretProvider(conf *SecretProviderConfig) (SecretProvider, error) {
+	if conf.Path == "" {
+		return nil, errors.New("path cannot be empty")
+	}
+
+	p := &fileSecretProvider{path: conf.Path}
+	if _, err := p.load(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func newEncryptedFileSecretProvider(conf *SecretProviderConfig) (SecretProvider, error) {
+	if conf.Path == "" {
+		return nil, errors.New("path cannot be empty")
+	}
+
+	if conf.KeyEnv == "" {
+		return nil, errors.New("key_env cannot be empty")
+	}
+
+	aead, err := newAEAD(os.Getenv(conf.KeyEnv))
+	if err != nil {
+		return nil, fmt.Errorf("key_env %s %w", conf.KeyEnv, err)
+	}
+
+	p := &fileSecretProvider{
+		path: conf.Path,
+		decode: func(data []byte) ([]byte, error) {
+			if len(data) < aead.NonceSize()+aead.Overhead() {
+				return nil, errors.New("the encrypted file is too short")
+			}
+			plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+			if err != nil {
+				return nil, errors.New("the encrypted file can not be decrypted, please check the key")
+			}
+			return plaintext, nil
+		},
+	}
+	if _, err := p.load(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// load reads the file again if it changed since the last read
+func (p *fileSecretProvider) load() (map[string]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("file %s error: %w", p.path, err)
+	}
+
+	if p.secrets != nil && info.ModTime().Equal(p.modTime) && info.Size() == p.size {
+		return p.secrets, nil
+	}
+
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("file %s read error: %w", p.path, err)
+	}
+
+	if p.decode != nil {
+		if data, err = p.decode(data); err != nil {
+			return nil, fmt.Errorf("file %s: %w", p.path, err)
+		}
+	}
+
+	secrets := make(map[string]string)
+	if err := yaml.Unmarshal(data, &secrets); err != nil {
+		return nil, fmt.Errorf("file %s parse error: %w", p.path, err)
+	}
+
+	p.secrets, p.modTime, p.size = secrets, info.ModTime(), info.Size()
+
+	return secrets, nil
+}
+
+func (p *fileSecretProvider) Secret(key string) (string, error) {
+	secrets, err := p.load()
+	if err != nil {
+		return "", err
+	}
+
+	secret, exists := secrets[key]
+	if !exists {
+		return "", ErrSecretNotFound
+	}
+
+	return secret, nil
+}
+
+// EncryptSecrets encrypts a yaml map of keys to secrets for an encrypted_file provider
+// with the base64 encoded 32 byte key
+func EncryptSecrets(key string, plaintext []byte) ([]byte, error) {
+	secrets := make(map[string]string)
+	if err := yaml.Unmarshal(plaintext, &secrets); err != nil {
+		return nil, fmt.Errorf("the secrets are not a yaml map: %w", err)
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, fmt.Errorf("key %w", err)
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
@@ -2,66 +2,326 @@ package transport
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/Orlion/hersql/log"
+	"github.com/Orlion/hersql/mysql"
+	"github.com/Orlion/hersql/pkg/atomicx"
+	"github.com/Orlion/hersql/pkg/semaphore"
 )
 
+var drainPollInterval = 500 * time.Millisecond
+
 type Server struct {
-	mu         sync.Mutex
-	runid      string
-	Addr       string
-	http       *http.Server
-	nextConnId uint64
-	conns      map[uint64]*Conn
+	mu                sync.Mutex
+	runid             string
+	Addr              string
+	http              *http.Server
+	nextConnId        uint64
+	conns             map[uint64]*Conn
+	dialTimeout       time.Duration
+	handshakeTimeout  time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	maxExecutionTime  time.Duration
+	maxResultRows     int
+	maxResultBytes    int
+	resultLimitAction string
+	maskingRules      []*MaskingRule
+	// guards the policies and the backends, which are replaced when the configuration is reloaded
+	confMu      sync.RWMutex
+	policies    []*Policy
+	quotas      []*Quota
+	quotaUsages map[string]*quotaUsage
+	// caps of the sessions in total and per backend address
+	sessions              *semaphore.Semaphore
+	backendSessions       map[string]*semaphore.Semaphore
+	sideConns             map[string]*semaphore.Semaphore
+	maxSessionsPerBackend int
+	sessionQueueSize      int
+	sessionQueueTimeout   time.Duration
+	backends              map[string]*Backend
+	healthCheck           *HealthCheck
+	envelope              *Envelope
+	credentials           map[string]*Credential
+	secretProviders       map[string]SecretProvider
+	denyInlineCredentials bool
+	adminToken            string
+	tls                   bool
+	// whether the sidecars are authenticated by their client certificates
+	clientAuth bool
+	doneChan   chan struct{}
+	// set once the server shuts down, new sessions are rejected and the sessions end with their transactions
+	draining     atomicx.Bool
+	drainTimeout time.Duration
+	listener     net.Listener
+	// the unix socket a new transport process takes the listener and the sessions over from
+	handoffSocket string
+	handedOff     chan struct{}
+	// the sessions the previous process could not hand off, their requests receive ER_SERVER_SHUTDOWN
+	endedConns map[uint64]bool
 }
 
-func NewServer(conf *Config) *Server {
-	withDefaultConf(conf)
+func NewServer(conf *Config) (*Server, error) {
+	if err := withDefaultConf(conf); err != nil {
+		return nil, err
+	}
+
+	backends := make(map[string]*Backend, len(conf.Backends))
+	for _, backend := range conf.Backends {
+		backends[backend.Name] = backend
+	}
 
 	s := &Server{
-		runid: strconv.FormatInt(time.Now().UnixNano(), 10),
-		Addr:  conf.Addr,
-		conns: make(map[uint64]*Conn),
+		runid:                 strconv.FormatInt(time.Now().UnixNano(), 10),
+		Addr:                  conf.Addr,
+		conns:                 make(map[uint64]*Conn),
+		dialTimeout:           conf.DialTimeout,
+		handshakeTimeout:      conf.HandshakeTimeout,
+		readTimeout:           conf.ReadTimeout,
+		writeTimeout:          conf.WriteTimeout,
+		maxExecutionTime:      conf.MaxExecutionTime,
+		maxResultRows:         conf.MaxResultRows,
+		maxResultBytes:        conf.MaxResultBytes,
+		resultLimitAction:     conf.ResultLimitAction,
+		maskingRules:          conf.Masking,
+		policies:              conf.Policies,
+		quotas:                conf.Quotas,
+		quotaUsages:           make(map[string]*quotaUsage),
+		sessions:              semaphore.New(conf.MaxSessions, conf.SessionQueueSize, conf.SessionQueueTimeout),
+		backendSessions:       make(map[string]*semaphore.Semaphore),
+		sideConns:             make(map[string]*semaphore.Semaphore),
+		endedConns:            make(map[uint64]bool),
+		maxSessionsPerBackend: conf.MaxSessionsPerBackend,
+		sessionQueueSize:      conf.SessionQueueSize,
+		sessionQueueTimeout:   conf.SessionQueueTimeout,
+		backends:              backends,
+		healthCheck:           conf.HealthCheck,
+		denyInlineCredentials: conf.DenyInlineCredentials,
+		adminToken:            conf.AdminToken,
+		doneChan:              make(chan struct{}),
+		drainTimeout:          conf.DrainTimeout,
+		handoffSocket:         conf.HandoffSocket,
+		handedOff:             make(chan struct{}),
+	}
+
+	credentials, err := loadCredentials(conf.CredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	s.credentials = credentials
+
+	secretProviders, err := newSecretProviders(conf.SecretProviders)
+	if err != nil {
+		return nil, err
+	}
+	s.secretProviders = secretProviders
+
+	for name, credential := range credentials {
+		if credential.PasswdSecret == "" {
+			continue
+		}
+		provider, _, _ := strings.Cut(credential.PasswdSecret, ":")
+		if _, exists := secretProviders[provider]; !exists {
+			return nil, fmt.Errorf("credential %s refers to the unknown secret provider %s", name, provider)
+		}
+	}
+
+	maskingKey, err := s.maskingKey(conf)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range conf.Masking {
+		rule.key = maskingKey
+	}
+
+	if conf.EncryptionKey != "" {
+		envelope, err := NewEnvelope(conf.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		s.envelope = envelope
 	}
 
 	serveMux := http.NewServeMux()
-	serveMux.HandleFunc("/connect", s.HandleConnect)
-	serveMux.HandleFunc("/disconnect", s.HandleDisconnect)
-	serveMux.HandleFunc("/transport", s.HandleTransport)
-	serveMux.HandleFunc("/status", s.HandleStatus)
+	serveMux.HandleFunc("/connect", s.withEnvelope(s.HandleConnect))
+	serveMux.HandleFunc("/disconnect", s.withEnvelope(s.HandleDisconnect))
+	serveMux.HandleFunc("/transport", s.withEnvelope(s.HandleTransport))
+	serveMux.HandleFunc("/kill", s.withEnvelope(s.HandleKill))
+	serveMux.HandleFunc("/sessions", s.withEnvelope(s.HandleSessions))
+	serveMux.HandleFunc("/status", s.withEnvelope(s.HandleStatus))
+	serveMux.HandleFunc("/backends", s.withEnvelope(s.HandleBackends))
+	serveMux.HandleFunc("/ping", s.HandlePing)
 	s.http = &http.Server{
 		Addr:    conf.Addr,
-		Handler: serveMux,
+		Handler: withCompression(serveMux),
+	}
+
+	if conf.TLS != nil {
+		tlsConfig, err := conf.TLS.serverTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		s.http.TLSConfig = tlsConfig
+		s.tls = true
+		s.clientAuth = tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert
 	}
 
-	return s
+	return s, nil
 }
 
 func (s *Server) ListenAndServe() error {
-	log.Infow("server serve", "addr", s.Addr)
-	return s.http.ListenAndServe()
+	ln, err := s.listen()
+	if err != nil {
+		return err
+	}
+	s.listener = ln
+
+	log.Infow("server serve", "addr", s.Addr, "runid", s.runid)
+
+	if s.handoffSocket != "" {
+		if err := s.serveHandoff(); err != nil {
+			ln.Close()
+			return fmt.Errorf("handoff socket %s error: %w", s.handoffSocket, err)
+		}
+	}
+
+	// backends may be added by reloading the configuration, so the health checks run even without them
+	if s.healthCheck != nil && s.healthCheck.Interval > 0 {
+		go s.checkBackends()
+	}
+
+	return s.serve(ln)
+}
+
+func (s *Server) serve(ln net.Listener) error {
+	if s.tls {
+		// the certificates are already loaded into the tls configuration
+		return s.http.ServeTLS(ln, "", "")
+	}
+
+	return s.http.Serve(ln)
 }
 
+// Shutdown drains the server: new sessions are rejected, the sessions outside of transactions are ended with
+// ER_SERVER_SHUTDOWN on their next command, and the running commands and the open transactions are waited for
+// until ctx is done. The remaining sessions are closed then
 func (s *Server) Shutdown(ctx context.Context) error {
 	log.Infow("server shutdown...")
+	s.draining.SetTrue()
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+drain:
+	for s.busyConnNum() > 0 {
+		select {
+		case <-ctx.Done():
+			log.Warnw("server shutdown drain timeout, closing the busy sessions", "busy", s.busyConnNum())
+			break drain
+		case <-ticker.C:
+		}
+	}
+
 	err := s.http.Shutdown(ctx)
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	select {
+	case <-s.doneChan:
+	default:
+		close(s.doneChan)
+	}
 
+	// the conns are closed outside of the lock, closing their replica connections releases slots under it
+	s.mu.Lock()
+	conns := make([]*Conn, 0, len(s.conns))
 	for connId, conn := range s.conns {
 		delete(s.conns, connId)
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+
+	for _, conn := range conns {
 		conn.close()
 	}
 
 	return err
 }
 
+// busyConnNum returns the number of sessions running a command or in a transaction
+func (s *Server) busyConnNum() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	busy := 0
+	for _, conn := range s.conns {
+		if atomic.LoadUint64(&conn.runningCommand) > 0 || conn.inTransaction.Get() {
+			busy++
+		}
+	}
+
+	return busy
+}
+
+// connect dials the backend and completes the handshake with it
+func (s *Server) connect(addr, user, passwd, dbname string, collation uint8, clientCapability uint32) (*Conn, error) {
+	rwc, err := net.DialTimeout("tcp", addr, s.dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("dial to %s failed: %w", addr, err)
+	}
+
+	pkg := mysql.NewPacketIO(rwc)
+	pkg.SetTimeout(s.readTimeout, s.writeTimeout)
+
+	conn := &Conn{
+		id:               s.genConnId(),
+		rwc:              rwc,
+		createAt:         time.Now(),
+		server:           s,
+		pkg:              pkg,
+		addr:             addr,
+		replicas:         make(map[string]*replicaConn),
+		dbname:           dbname,
+		user:             user,
+		passwd:           passwd,
+		collation:        collation,
+		clientCapability: clientCapability,
+	}
+
+	if s.handshakeTimeout > 0 {
+		rwc.SetDeadline(time.Now().Add(s.handshakeTimeout))
+	}
+
+	if err := conn.handshake(); err != nil {
+		rwc.Close()
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+
+	rwc.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// getPolicy returns the first policy matching the backend address, user and sidecar identity, nil if none matches
+func (s *Server) getPolicy(addr, user, identity string) *Policy {
+	s.confMu.RLock()
+	defer s.confMu.RUnlock()
+
+	for _, policy := range s.policies {
+		if policy.match(addr, user, identity) {
+			return policy
+		}
+	}
+
+	return nil
+}
+
 func (s *Server) addConn(conn *Conn) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -73,9 +333,28 @@ func (s *Server) genConnId() uint64 {
 }
 
 func (s *Server) delConn(connId uint64) {
+	s.mu.Lock()
+	conn, exists := s.conns[connId]
+	if exists {
+		delete(s.conns, connId)
+		s.releaseSessionLocked(conn.identity)
+	}
+	s.mu.Unlock()
+
+	if exists {
+		s.releaseSlots(conn.addr)
+	}
+}
+
+// connEnded reports whether the session ended with the server, by a shutdown or a handoff which could not take it over
+func (s *Server) connEnded(connId uint64) bool {
+	if s.draining.Get() {
+		return true
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	delete(s.conns, connId)
+	return s.endedConns[connId]
 }
 
 func (s *Server) getConn(connId uint64) (*Conn, bool) {
@@ -0,0 +1,257 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Orlion/hersql/log"
+	"github.com/Orlion/hersql/mysql"
+)
+
+func TestMain(m *testing.M) {
+	// the servers log, only their failures are of interest
+	log.Init(&log.Config{StdoutLevel: "fatal"})
+	os.Exit(m.Run())
+}
+
+// listenBackend returns the address of a fake backend accepting connections, they are closed with the test
+func listenBackend(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func newTestServer(t *testing.T, conf *Config) *Server {
+	t.Helper()
+
+	if conf.Addr == "" {
+		conf.Addr = "127.0.0.1:0"
+	}
+
+	s, err := NewServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// newTestConn adds a session to the backend address holding its slots and quota session, as HandleConnect does
+func newTestConn(t *testing.T, s *Server, addr, identity string) *Conn {
+	t.Helper()
+
+	if err := s.acquireSession(identity); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.acquireSlots(addr); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := dialTestConn(t, s, addr)
+	conn.identity = identity
+	s.addConn(conn)
+
+	return conn
+}
+
+// openTestReplica opens a replica connection of the session holding its side slots, as getReplica does
+func openTestReplica(t *testing.T, c *Conn, addr string) {
+	t.Helper()
+
+	if !c.server.acquireSideSlots(addr, c.identity) {
+		t.Fatal("acquireSideSlots() = false, want true")
+	}
+
+	conn := dialTestConn(t, c.server, addr)
+	conn.identity = c.identity
+
+	c.replicasMu.Lock()
+	c.replicas[addr] = &replicaConn{conn: conn}
+	c.replicasMu.Unlock()
+}
+
+func dialTestConn(t *testing.T, s *Server, addr string) *Conn {
+	t.Helper()
+
+	rwc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Conn{
+		id:       s.genConnId(),
+		rwc:      rwc,
+		createAt: time.Now(),
+		server:   s,
+		pkg:      mysql.NewPacketIO(rwc),
+		addr:     addr,
+		replicas: make(map[string]*replicaConn),
+	}
+}
+
+// within fails the test if fn does not return in time, e.g. as it deadlocks
+func within(t *testing.T, timeout time.Duration, fn func()) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatalf("did not return within %s", timeout)
+	}
+}
+
+func TestAcquireSlots(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+
+	tests := []struct {
+		name string
+		conf *Config
+		// the other backend address has slots of its own
+		otherBackend bool
+	}{
+		{"max sessions", &Config{MaxSessions: 1, SessionQueueSize: 1, SessionQueueTimeout: timeout}, false},
+		// the slot of the total sessions is released again as the backend has none free
+		{"max sessions per backend", &Config{MaxSessions: 2, MaxSessionsPerBackend: 1, SessionQueueSize: 1, SessionQueueTimeout: timeout}, false},
+		{"other backend", &Config{MaxSessionsPerBackend: 1, SessionQueueSize: 1, SessionQueueTimeout: timeout}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.conf)
+			if err := s.acquireSlots("10.0.0.1:3306"); err != nil {
+				t.Fatal(err)
+			}
+
+			addr := "10.0.0.1:3306"
+			if tt.otherBackend {
+				addr = "10.0.0.2:3306"
+			}
+
+			start := time.Now()
+			err := s.acquireSlots(addr)
+			if tt.otherBackend {
+				if err != nil {
+					t.Fatalf("acquireSlots() of the other backend error = %v", err)
+				}
+				return
+			}
+
+			// the connect waits in the queue for the timeout and receives ER_CON_COUNT_ERROR
+			if err != errTooManySessions {
+				t.Fatalf("acquireSlots() beyond the caps error = %v, want %v", err, errTooManySessions)
+			}
+			if waited := time.Since(start); waited < timeout {
+				t.Errorf("acquireSlots() gave up after %s, before the queue timeout %s", waited, timeout)
+			}
+
+			// a connect which timed out holds no slot of the total sessions
+			if n := s.sessions.Len(); n != 1 {
+				t.Errorf("sessions = %d after the queue timeout, want 1", n)
+			}
+
+			s.releaseSlots("10.0.0.1:3306")
+			if err := s.acquireSlots(addr); err != nil {
+				t.Errorf("acquireSlots() after a release error = %v", err)
+			}
+		})
+	}
+}
+
+func TestSideSlots(t *testing.T) {
+	tests := []struct {
+		name string
+		conf *Config
+		// the replica connections acquired before the one expected to fail
+		acquired int
+	}{
+		{"max sessions", &Config{MaxSessions: 2}, 1},
+		{"max sessions per backend", &Config{MaxSessionsPerBackend: 3}, 2},
+		{"quota", &Config{Quotas: []*Quota{{MaxSessions: 2}}}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.conf)
+			addr := listenBackend(t)
+			conn := newTestConn(t, s, addr, "10.0.0.1")
+
+			for i := 0; i < tt.acquired; i++ {
+				if !s.acquireSideSlots(addr, conn.identity) {
+					t.Fatalf("acquireSideSlots() %d = false, want true", i)
+				}
+			}
+
+			// replica connections never wait for a slot
+			if s.acquireSideSlots(addr, conn.identity) {
+				t.Fatal("acquireSideSlots() beyond the caps = true, want false")
+			}
+
+			s.releaseSideSlots(addr, conn.identity)
+			if !s.acquireSideSlots(addr, conn.identity) {
+				t.Error("acquireSideSlots() after a release = false, want true")
+			}
+		})
+	}
+}
+
+func TestShutdownWithReplicas(t *testing.T) {
+	s := newTestServer(t, &Config{MaxSessions: 4, MaxSessionsPerBackend: 4, Quotas: []*Quota{{MaxSessions: 4}}})
+	primary, replica := listenBackend(t), listenBackend(t)
+
+	conn := newTestConn(t, s, primary, "10.0.0.1")
+	openTestReplica(t, conn, replica)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	within(t, 5*time.Second, func() {
+		if err := s.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown() error = %v", err)
+		}
+	})
+
+	if _, exists := s.getConn(conn.id); exists {
+		t.Error("the session outlived the shutdown")
+	}
+	if n := s.getBackendSessions(replica).Len(); n != 0 {
+		t.Errorf("replica sessions = %d after the shutdown, want 0", n)
+	}
+}
@@ -0,0 +1,124 @@
+package transport
+
+import (
+	"math"
+	"time"
+
+	"github.com/Orlion/hersql/mysql"
+	"github.com/Orlion/hersql/pkg/semaphore"
+)
+
+var errTooManySessions = mysql.NewError(mysql.ER_CON_COUNT_ERROR, "Too many connections")
+
+var errServerShutdown = mysql.NewError(mysql.ER_SERVER_SHUTDOWN, "Server shutdown in progress")
+
+var errTooManySideConns = mysql.NewError(mysql.ER_CON_COUNT_ERROR, "Too many connections killing the queries and checking the health of the backend")
+
+// the KILL and health check connections to a backend address at most. They are not counted against the session caps,
+// a backend whose sessions are full still has its queries killed and its health checked, but the mysql servers need
+// this headroom on top of max_sessions_per_backend
+const maxSideConnsPerBackend = 4
+
+// the time a KILL or a health check waits for a side connection at most
+const sideConnTimeout = 10 * time.Second
+
+var errSessionsDenied = mysql.NewError(mysql.ER_SPECIFIC_ACCESS_DENIED_ERROR, "Access denied; the sessions are only listed with the admin token or to the sidecars authenticated by their client certificates")
+
+// getBackendSessions returns the session cap of the backend address, nil if not limited
+func (s *Server) getBackendSessions(addr string) *semaphore.Semaphore {
+	if s.maxSessionsPerBackend <= 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions, exists := s.backendSessions[addr]
+	if !exists {
+		sessions = semaphore.New(s.maxSessionsPerBackend, s.sessionQueueSize, s.sessionQueueTimeout)
+		s.backendSessions[addr] = sessions
+	}
+
+	return sessions
+}
+
+// acquireSlots reserves a slot of the total sessions and of the sessions of the backend address,
+// waiting in the queue if they are full. It returns the error the client receives if no slot is free in time
+func (s *Server) acquireSlots(addr string) *mysql.SqlError {
+	if !s.sessions.Acquire() {
+		return errTooManySessions
+	}
+
+	if !s.getBackendSessions(addr).Acquire() {
+		s.sessions.Release()
+		return errTooManySessions
+	}
+
+	return nil
+}
+
+func (s *Server) releaseSlots(addr string) {
+	s.getBackendSessions(addr).Release()
+	s.sessions.Release()
+}
+
+// acquireSideSlots reserves the slots and the quota session of a connection opened besides the session of a sidecar,
+// such as a replica connection. It does not wait, the command waiting for the connection has another way to run
+func (s *Server) acquireSideSlots(addr, identity string) bool {
+	if !s.sessions.TryAcquire() {
+		return false
+	}
+
+	if !s.getBackendSessions(addr).TryAcquire() {
+		s.sessions.Release()
+		return false
+	}
+
+	if s.acquireSession(identity) != nil {
+		s.releaseSlots(addr)
+		return false
+	}
+
+	return true
+}
+
+func (s *Server) releaseSideSlots(addr, identity string) {
+	s.releaseSession(identity)
+	s.releaseSlots(addr)
+}
+
+// getSideConns returns the cap of the KILL and health check connections to the backend address
+func (s *Server) getSideConns(addr string) *semaphore.Semaphore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sideConns, exists := s.sideConns[addr]
+	if !exists {
+		sideConns = semaphore.New(maxSideConnsPerBackend, math.MaxInt32, sideConnTimeout)
+		s.sideConns[addr] = sideConns
+	}
+
+	return sideConns
+}
+
+// connectSide opens a connection besides the sessions to kill a query or check the health of the backend address,
+// it is closed with closeSide
+func (s *Server) connectSide(addr, user, passwd string, collation uint8) (*Conn, error) {
+	sideConns := s.getSideConns(addr)
+	if !sideConns.Acquire() {
+		return nil, errTooManySideConns
+	}
+
+	conn, err := s.connect(addr, user, passwd, "", collation, 0)
+	if err != nil {
+		sideConns.Release()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (s *Server) closeSide(conn *Conn) {
+	conn.close()
+	s.getSideConns(conn.addr).Release()
+}
@@ -0,0 +1,233 @@
+package transport
+
+import "strings"
+
+type StatementType int
+
+const (
+	StatementRead    StatementType = iota // SELECT, SHOW, DESCRIBE, EXPLAIN ...
+	StatementSession                      // USE, SET, BEGIN, COMMIT, KILL ...
+	StatementDML                          // INSERT, UPDATE, DELETE, REPLACE, LOAD, CALL ...
+	StatementDDL                          // CREATE, ALTER, DROP, TRUNCATE, RENAME
+	StatementAdmin                        // GRANT, REVOKE, FLUSH, SET GLOBAL and everything unknown
+)
+
+func (t StatementType) String() string {
+	switch t {
+	case StatementRead:
+		return "read"
+	case StatementSession:
+		return "session"
+	case StatementDML:
+		return "dml"
+	case StatementDDL:
+		return "ddl"
+	default:
+		return "admin"
+	}
+}
+
+type Statement struct {
+	Type StatementType
+	// the leading keyword, e.g. SELECT
+	Verb string
+	// whether the statement has a WHERE clause outside of subqueries
+	HasWhere bool
+}
+
+// ClassifyStatements classifies every statement of the query, statements are separated by ';'.
+// noBackslashEscapes is the NO_BACKSLASH_ESCAPES sql mode of the session, backslashes in literals are no escapes then
+func ClassifyStatements(query string, noBackslashEscapes bool) []*Statement {
+	statements := make([]*Statement, 0, 1)
+
+	tokens := tokenize(query, noBackslashEscapes)
+	for start := 0; start <= len(tokens); {
+		end := start
+		for end < len(tokens) && tokens[end] != ";" {
+			end++
+		}
+
+		if end > start {
+			statements = append(statements, classify(tokens[start:end]))
+		}
+
+		start = end + 1
+	}
+
+	return statements
+}
+
+func classify(tokens []string) *Statement {
+	// (SELECT ...) UNION (SELECT ...)
+	for len(tokens) > 0 && tokens[0] == "(" {
+		tokens = tokens[1:]
+	}
+
+	if len(tokens) == 0 {
+		return &Statement{Type: StatementAdmin}
+	}
+
+	st := &Statement{Verb: tokens[0], HasWhere: hasTopLevel(tokens, "WHERE")}
+
+	switch st.Verb {
+	case "SELECT", "TABLE", "VALUES":
+		st.Type = StatementRead
+		// SELECT ... INTO OUTFILE writes files on the server
+		if hasTopLevel(tokens, "OUTFILE") || hasTopLevel(tokens, "DUMPFILE") {
+			st.Type = StatementAdmin
+		}
+	case "SHOW", "HELP":
+		st.Type = StatementRead
+	case "EXPLAIN", "DESCRIBE", "DESC":
+		st.Type = StatementRead
+		// EXPLAIN ANALYZE executes the statement
+		if len(tokens) > 1 && tokens[1] == "ANALYZE" {
+			return classify(tokens[2:])
+		}
+	case "WITH":
+		// the statement following the common table expressions decides
+		depth := 0
+		for i, token := range tokens {
+			switch token {
+			case "(":
+				depth++
+			case ")":
+				depth--
+			case "SELECT", "UPDATE", "DELETE", "INSERT", "REPLACE", "TABLE", "VALUES":
+				if depth == 0 {
+					return classify(tokens[i:])
+				}
+			}
+		}
+		st.Type = StatementAdmin
+	case "INSERT", "UPDATE", "DELETE", "REPLACE", "LOAD", "CALL", "DO", "HANDLER", "IMPORT":
+		st.Type = StatementDML
+	case "CREATE", "ALTER", "DROP", "TRUNCATE", "RENAME":
+		st.Type = StatementDDL
+	case "USE", "BEGIN", "COMMIT", "ROLLBACK", "SAVEPOINT", "RELEASE", "XA", "LOCK", "UNLOCK", "KILL":
+		st.Type = StatementSession
+	case "START":
+		// START TRANSACTION, but not START REPLICA
+		st.Type = StatementAdmin
+		if len(tokens) > 1 && tokens[1] == "TRANSACTION" {
+			st.Type = StatementSession
+		}
+	case "SET":
+		// SET GLOBAL, SET PERSIST and SET PASSWORD change more than the session
+		st.Type = StatementSession
+		for _, token := range tokens[1:] {
+			switch token {
+			case "GLOBAL", "PERSIST", "PERSIST_ONLY", "PASSWORD", "@@GLOBAL", "@@PERSIST", "@@PERSIST_ONLY":
+				st.Type = StatementAdmin
+			}
+		}
+	default:
+		st.Type = StatementAdmin
+	}
+
+	return st
+}
+
+// hasTopLevel reports whether the keyword appears outside of parentheses
+func hasTopLevel(tokens []string, keyword string) bool {
+	depth := 0
+	for _, token := range tokens {
+		switch token {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		case keyword:
+			if depth == 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// tokenize splits the query into upper cased words and punctuation,
+// comments are skipped and literals and quoted identifiers are replaced by "?"
+func tokenize(query string, noBackslashEscapes bool) []string {
+	tokens := make([]string, 0, 16)
+	inVersionComment := false
+
+	for i := 0; i < len(query); {
+		ch := query[i]
+
+		switch {
+		case isSpace(ch):
+			i++
+		case ch == '#' || (ch == '-' && strings.HasPrefix(query[i:], "--") && (i+2 == len(query) || isSpace(query[i+2]))):
+			if end := strings.IndexByte(query[i:], '\n'); end != -1 {
+				i += end + 1
+			} else {
+				i = len(query)
+			}
+		case ch == '/' && strings.HasPrefix(query[i:], "/*!"):
+			// /*!50100 ... */ is executed by the server, only skip the markers
+			i += 3
+			for i < len(query) && query[i] >= '0' && query[i] <= '9' {
+				i++
+			}
+			inVersionComment = true
+		case ch == '*' && inVersionComment && strings.HasPrefix(query[i:], "*/"):
+			i += 2
+			inVersionComment = false
+		case ch == '/' && strings.HasPrefix(query[i:], "/*"):
+			if end := strings.Index(query[i+2:], "*/"); end != -1 {
+				i += 2 + end + 2
+			} else {
+				i = len(query)
+			}
+		case ch == '\'' || ch == '"' || ch == '`':
+			i = skipQuoted(query, i, noBackslashEscapes)
+			tokens = append(tokens, "?")
+		case isWordChar(ch):
+			start := i
+			for i < len(query) && isWordChar(query[i]) {
+				i++
+			}
+			tokens = append(tokens, strings.ToUpper(query[start:i]))
+		default:
+			tokens = append(tokens, string(ch))
+			i++
+		}
+	}
+
+	return tokens
+}
+
+// skipQuoted returns the position after the quoted string starting at i
+func skipQuoted(query string, i int, noBackslashEscapes bool) int {
+	quote := query[i]
+	i++
+	for i < len(query) {
+		switch query[i] {
+		case '\\':
+			if quote != '`' && !noBackslashEscapes {
+				i += 2
+				continue
+			}
+		case quote:
+			// a doubled quote is an escaped quote
+			if i+1 < len(query) && query[i+1] == quote {
+				i += 2
+				continue
+			}
+			return i + 1
+		}
+		i++
+	}
+
+	return i
+}
+
+func isSpace(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == '\f' || ch == '\v'
+}
+
+func isWordChar(ch byte) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '_' || ch == '$' || ch == '@' || ch >= 0x80
+}
@@ -0,0 +1,116 @@
+package transport
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClassifyStatements(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  []Statement
+	}{
+		{"select", "SELECT * FROM users", []Statement{{Type: StatementRead, Verb: "SELECT"}}},
+		{"select where", "select id from users where id = 1", []Statement{{Type: StatementRead, Verb: "SELECT", HasWhere: true}}},
+		{"where in subquery only", "SELECT * FROM (SELECT * FROM users WHERE id = 1) t", []Statement{{Type: StatementRead, Verb: "SELECT"}}},
+		{"union in parentheses", "(SELECT 1) UNION (SELECT 2)", []Statement{{Type: StatementRead, Verb: "SELECT"}}},
+		{"into outfile", "SELECT * FROM users INTO OUTFILE '/tmp/users'", []Statement{{Type: StatementAdmin, Verb: "SELECT"}}},
+		{"into dumpfile", "SELECT data FROM blobs INTO DUMPFILE '/tmp/blob'", []Statement{{Type: StatementAdmin, Verb: "SELECT"}}},
+		{"show", "SHOW TABLES", []Statement{{Type: StatementRead, Verb: "SHOW"}}},
+		{"describe", "DESC users", []Statement{{Type: StatementRead, Verb: "DESC"}}},
+		{"explain", "EXPLAIN SELECT * FROM users", []Statement{{Type: StatementRead, Verb: "EXPLAIN"}}},
+		{"explain analyze delete", "EXPLAIN ANALYZE DELETE FROM users WHERE id = 1", []Statement{{Type: StatementDML, Verb: "DELETE", HasWhere: true}}},
+		{"with select", "WITH t AS (DELETE FROM x) SELECT * FROM t", []Statement{{Type: StatementRead, Verb: "SELECT"}}},
+		{"with update", "WITH t AS (SELECT id FROM users) UPDATE users SET a = 1", []Statement{{Type: StatementDML, Verb: "UPDATE"}}},
+		{"insert", "INSERT INTO users VALUES (1)", []Statement{{Type: StatementDML, Verb: "INSERT"}}},
+		{"delete without where", "DELETE FROM users", []Statement{{Type: StatementDML, Verb: "DELETE"}}},
+		{"update with where", "UPDATE users SET name = 'a' WHERE id = 1", []Statement{{Type: StatementDML, Verb: "UPDATE", HasWhere: true}}},
+		{"where in a literal", "UPDATE users SET name = 'where'", []Statement{{Type: StatementDML, Verb: "UPDATE"}}},
+		{"call", "CALL refresh()", []Statement{{Type: StatementDML, Verb: "CALL"}}},
+		{"create", "CREATE TABLE t (id INT)", []Statement{{Type: StatementDDL, Verb: "CREATE"}}},
+		{"drop", "drop table users", []Statement{{Type: StatementDDL, Verb: "DROP"}}},
+		{"truncate", "TRUNCATE users", []Statement{{Type: StatementDDL, Verb: "TRUNCATE"}}},
+		{"use", "USE `blog`", []Statement{{Type: StatementSession, Verb: "USE"}}},
+		{"set session", "SET autocommit = 0", []Statement{{Type: StatementSession, Verb: "SET"}}},
+		{"set global", "SET GLOBAL max_connections = 10", []Statement{{Type: StatementAdmin, Verb: "SET"}}},
+		{"set @@global", "SET @@GLOBAL.max_connections = 10", []Statement{{Type: StatementAdmin, Verb: "SET"}}},
+		{"set persist", "SET PERSIST max_connections = 10", []Statement{{Type: StatementAdmin, Verb: "SET"}}},
+		{"set password", "SET PASSWORD = 'secret'", []Statement{{Type: StatementAdmin, Verb: "SET"}}},
+		{"start transaction", "START TRANSACTION", []Statement{{Type: StatementSession, Verb: "START"}}},
+		{"start replica", "START REPLICA", []Statement{{Type: StatementAdmin, Verb: "START"}}},
+		{"kill", "KILL QUERY 12", []Statement{{Type: StatementSession, Verb: "KILL"}}},
+		{"grant", "GRANT ALL ON *.* TO 'u'", []Statement{{Type: StatementAdmin, Verb: "GRANT"}}},
+		{"unknown", "FLUSH PRIVILEGES", []Statement{{Type: StatementAdmin, Verb: "FLUSH"}}},
+		{"comments", "/* DROP TABLE users */ -- DELETE\nSELECT 1 # UPDATE", []Statement{{Type: StatementRead, Verb: "SELECT"}}},
+		{"version comment", "/*!40101 SET NAMES utf8mb4 */", []Statement{{Type: StatementSession, Verb: "SET"}}},
+		{"several statements", "SELECT 1; DROP TABLE users;", []Statement{{Type: StatementRead, Verb: "SELECT"}, {Type: StatementDDL, Verb: "DROP"}}},
+		{"separator in a literal", "SELECT ';DROP TABLE users'", []Statement{{Type: StatementRead, Verb: "SELECT"}}},
+		{"empty", " ; ", []Statement{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]Statement, 0)
+			for _, st := range ClassifyStatements(tt.query, false) {
+				got = append(got, *st)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ClassifyStatements(%q) = %+v, want %+v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyStatementsNoBackslashEscapes(t *testing.T) {
+	tests := []struct {
+		name               string
+		query              string
+		noBackslashEscapes bool
+		want               []Statement
+	}{
+		{"escaped quote", `SELECT '\'; DROP TABLE t; -- '`, false, []Statement{{Type: StatementRead, Verb: "SELECT"}}},
+		{"backslash", `SELECT '\'; DROP TABLE t; -- '`, true, []Statement{{Type: StatementRead, Verb: "SELECT"}, {Type: StatementDDL, Verb: "DROP"}}},
+		{"where in a literal", `UPDATE t SET a = '\' WHERE id = 1 -- '`, false, []Statement{{Type: StatementDML, Verb: "UPDATE"}}},
+		{"where after a backslash", `UPDATE t SET a = '\' WHERE id = 1 -- '`, true, []Statement{{Type: StatementDML, Verb: "UPDATE", HasWhere: true}}},
+		{"identifier", "SELECT `a\\`; DROP TABLE t", false, []Statement{{Type: StatementRead, Verb: "SELECT"}, {Type: StatementDDL, Verb: "DROP"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]Statement, 0)
+			for _, st := range ClassifyStatements(tt.query, tt.noBackslashEscapes) {
+				got = append(got, *st)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ClassifyStatements(%q, %v) = %+v, want %+v", tt.query, tt.noBackslashEscapes, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionStatementKey(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SET @a = 1", "SET @A"},
+		{"set session sql_mode = 'STRICT_ALL_TABLES'", "SET SESSION SQL_MODE"},
+		{"SET a = IF(1, 2, 3);", "SET A"},
+		{"SET a = 1, b = 2", ""},
+		{"SET @`quoted` = 1", ""},
+		{"SET NAMES utf8mb4", ""},
+		{"USE `blog`", "USE"},
+		{"use blog;", "USE"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := sessionStatementKey(tt.query, false); got != tt.want {
+				t.Errorf("sessionStatementKey(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Validate returns all the problems of the configuration instead of the first one, the configuration is not changed
+func (conf *Config) Validate() []error {
+	var problems []error
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	if conf.Addr != "" {
+		if _, _, err := net.SplitHostPort(conf.Addr); err != nil {
+			problem("addr %s is not a host:port address: %w", conf.Addr, err)
+		}
+	}
+
+	if conf.TLS != nil {
+		if err := conf.TLS.init(); err != nil {
+			problems = append(problems, err)
+		}
+		for _, file := range []struct{ key, path string }{{"cert_file", conf.TLS.CertFile}, {"key_file", conf.TLS.KeyFile}, {"client_ca_file", conf.TLS.ClientCAFile}} {
+			if file.path == "" {
+				continue
+			}
+			if _, err := os.Stat(file.path); err != nil {
+				problem("tls %s %w", file.key, err)
+			}
+		}
+	}
+
+	if conf.EncryptionKey != "" {
+		if _, err := NewEnvelope(conf.EncryptionKey); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	providers, err := newSecretProviders(conf.SecretProviders)
+	if err != nil {
+		problems = append(problems, err)
+	}
+
+	credentials, err := loadCredentials(conf.CredentialsFile)
+	if err != nil {
+		problems = append(problems, err)
+	}
+	backendNames := make(map[string]bool, len(conf.Backends))
+	for _, backend := range conf.Backends {
+		if backend != nil {
+			backendNames[backend.Name] = true
+		}
+	}
+	names := make([]string, 0, len(credentials))
+	for name := range credentials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		credential := credentials[name]
+		for _, backend := range credential.Backends {
+			if !backendNames[backend] {
+				problem("credential %s refers to the unknown backend %s", name, backend)
+			}
+		}
+		for _, pattern := range credential.Identities {
+			if err := validatePattern(pattern); err != nil {
+				problem("credential %s identities %w", name, err)
+			}
+		}
+		if credential.PasswdSecret == "" || providers == nil {
+			continue
+		}
+		provider, _, _ := strings.Cut(credential.PasswdSecret, ":")
+		if _, exists := providers[provider]; !exists {
+			problem("credential %s refers to the unknown secret provider %s", name, provider)
+		}
+	}
+
+	durations := []struct {
+		key   string
+		value int64
+	}{
+		{"dial_timeout", int64(conf.DialTimeout)},
+		{"handshake_timeout", int64(conf.HandshakeTimeout)},
+		{"read_timeout", int64(conf.ReadTimeout)},
+		{"write_timeout", int64(conf.WriteTimeout)},
+		{"max_execution_time", int64(conf.MaxExecutionTime)},
+		{"drain_timeout", int64(conf.DrainTimeout)},
+		{"session_queue_timeout", int64(conf.SessionQueueTimeout)},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			problem("%s cannot be negative", d.key)
+		}
+	}
+
+	limits := []struct {
+		key   string
+		value int
+	}{
+		{"max_result_rows", conf.MaxResultRows},
+		{"max_result_bytes", conf.MaxResultBytes},
+		{"max_sessions", conf.MaxSessions},
+		{"max_sessions_per_backend", conf.MaxSessionsPerBackend},
+		{"session_queue_size", conf.SessionQueueSize},
+	}
+	for _, l := range limits {
+		if l.value < 0 {
+			problem("%s cannot be negative", l.key)
+		}
+	}
+
+	switch conf.ResultLimitAction {
+	case "", ResultLimitError, ResultLimitTruncate:
+	default:
+		problem("result_limit_action %s is not supported, please use %s or %s", conf.ResultLimitAction, ResultLimitError, ResultLimitTruncate)
+	}
+
+	if conf.MaskingKeySecret != "" && providers != nil {
+		provider, _, _ := strings.Cut(conf.MaskingKeySecret, ":")
+		if _, exists := providers[provider]; !exists {
+			problem("masking_key_secret refers to the unknown secret provider %s", provider)
+		}
+	}
+
+	for i, rule := range conf.Masking {
+		if rule == nil {
+			problem("masking[%d] cannot be empty", i)
+			continue
+		}
+		if rule.Method == MaskHash && conf.MaskingKey == "" && conf.MaskingKeySecret == "" {
+			problem("masking[%d] method hash requires masking_key or masking_key_secret", i)
+		}
+		// init only fills in the parsed pattern, which a copy may as well hold
+		r := *rule
+		if err := r.init(); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	backends := make(map[string]bool, len(conf.Backends))
+	for i, backend := range conf.Backends {
+		if backend == nil || backend.Name == "" {
+			problem("backends[%d] name cannot be empty", i)
+			continue
+		}
+		if backends[backend.Name] {
+			problem("backend name %s is duplicated", backend.Name)
+		}
+		backends[backend.Name] = true
+
+		problems = append(problems, backend.validate()...)
+	}
+
+	if conf.HealthCheck != nil {
+		hc := *conf.HealthCheck
+		if err := hc.init(); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	for i, policy := range conf.Policies {
+		if policy == nil {
+			problem("policies[%d] cannot be empty", i)
+			continue
+		}
+		for _, pattern := range []struct{ key, value string }{{"addr", policy.Addr}, {"user", policy.User}, {"identity", policy.Identity}} {
+			if err := validatePattern(pattern.value); err != nil {
+				problem("policies[%d] %s %w", i, pattern.key, err)
+			}
+		}
+	}
+
+	for i, quota := range conf.Quotas {
+		if quota == nil {
+			problem("quotas[%d] cannot be empty", i)
+			continue
+		}
+		if err := validatePattern(quota.Identity); err != nil {
+			problem("quotas[%d] identity %w", i, err)
+		}
+		if quota.MaxSessions < 0 || quota.MaxCommandsPerSecond < 0 || quota.MaxBytesPerSecond < 0 {
+			problem("quotas[%d] limits cannot be negative", i)
+		}
+	}
+
+	return problems
+}
+
+// validate returns the problems of the backend without initializing it
+func (b *Backend) validate() []error {
+	var problems []error
+
+	if b.Primary == "" {
+		problems = append(problems, fmt.Errorf("backend %s primary cannot be empty", b.Name))
+	}
+
+	addrs := append([]string{b.Primary}, b.Fallbacks...)
+	addrs = append(addrs, b.Replicas...)
+	for _, addr := range addrs {
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			problems = append(problems, fmt.Errorf("backend %s address %s is not a host:port address: %w", b.Name, addr, err))
+		}
+	}
+
+	switch b.Balance {
+	case "", BalanceRoundRobin, BalanceLeastLatency:
+	default:
+		problems = append(problems, fmt.Errorf("backend %s balance %s is not supported, please use %s or %s", b.Name, b.Balance, BalanceRoundRobin, BalanceLeastLatency))
+	}
+
+	return problems
+}
+
+// validatePattern checks a pattern of a policy or a quota, which would never match if malformed
+func validatePattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		if errors.Is(err, path.ErrBadPattern) {
+			return fmt.Errorf("%s is not a valid pattern", pattern)
+		}
+		return err
+	}
+
+	return nil
+}